@@ -1,7 +1,9 @@
 package bloom
 
 import (
+	"encoding/gob"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -90,3 +92,63 @@ func testFilter(t *testing.T, f createFilter, tolerance float64) {
 	}
 	assert.InDelta(t, 0.01, float64(fp)/float64(total), tolerance)
 }
+
+func TestBloomFilterV2MarshalBinary(t *testing.T) {
+	filter, err := NewBloomFilterV2(10_000, 0.01)
+	assert.NoError(t, err)
+
+	keys := make([][]byte, 0)
+	for range 10_000 {
+		bytes := make([]byte, 32)
+		rand.Read(bytes)
+		filter.Add(bytes)
+		keys = append(keys, bytes)
+	}
+
+	b, err := filter.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := &BloomFilterV2{}
+	assert.NoError(t, decoded.UnmarshalBinary(b))
+
+	assert.Equal(t, filter, decoded)
+	for _, key := range keys {
+		require.True(t, decoded.In(key))
+	}
+}
+
+// baselineBloomFilterV2 is BloomFilterV2 as it was before it had a
+// BinaryMarshaler, which Encode wrote with gob.
+type baselineBloomFilterV2 struct {
+	Bitset []bool
+	K      int
+}
+
+func TestBloomFilterV2DecodeBaseline(t *testing.T) {
+	filter, err := NewBloomFilterV2(1_000, 0.01)
+	assert.NoError(t, err)
+	for i := range 1_000 {
+		filter.Add([]byte{byte(i), byte(i >> 8)})
+	}
+
+	// A file written by the baseline Encode is decoded.
+	path := filepath.Join(t.TempDir(), "baseline.bloom")
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, gob.NewEncoder(file).Encode(&baselineBloomFilterV2{Bitset: filter.Bitset, K: filter.K}))
+	assert.NoError(t, file.Close())
+
+	decoded := &BloomFilterV2{}
+	assert.NoError(t, decoded.Decode(path))
+	assert.Equal(t, filter, decoded)
+
+	// Encode still writes the baseline format.
+	path = filepath.Join(t.TempDir(), "new.bloom")
+	assert.NoError(t, filter.Encode(path))
+	file, err = os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	var baseline baselineBloomFilterV2
+	assert.NoError(t, gob.NewDecoder(file).Decode(&baseline))
+	assert.Equal(t, filter.Bitset, baseline.Bitset)
+	assert.Equal(t, filter.K, baseline.K)
+}
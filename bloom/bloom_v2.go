@@ -1,6 +1,7 @@
 package bloom
 
 import (
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"os"
@@ -13,6 +14,14 @@ type BloomFilterV2 struct {
 	K      int
 }
 
+// gobBloomFilterV2 has the fields of BloomFilterV2 without its
+// BinaryMarshaler methods, which gob would use instead of the fields, so
+// that Encode and Decode keep the format of existing bloom files.
+type gobBloomFilterV2 struct {
+	Bitset []bool
+	K      int
+}
+
 func NewBloomFilterV2(n int, fpr float64) (*BloomFilterV2, error) {
 	k, m := optimalKM(float64(n), fpr)
 	if k < 0 || m < 0 {
@@ -52,11 +61,11 @@ func (bf *BloomFilterV2) Encode(filename string) error {
 	}
 	defer file.Close()
 
-	err = gob.NewEncoder(file).Encode(bf)
+	err = gob.NewEncoder(file).Encode(gobBloomFilterV2{Bitset: bf.Bitset, K: bf.K})
 	if err != nil {
 		return fmt.Errorf("unable to encode bloom filter: %w", err)
 	}
-	return nil
+	return file.Sync()
 }
 
 func (bf *BloomFilterV2) Decode(filename string) error {
@@ -66,16 +75,55 @@ func (bf *BloomFilterV2) Decode(filename string) error {
 	}
 	defer file.Close()
 
-	var nbf BloomFilterV2
+	var nbf gobBloomFilterV2
 	err = gob.NewDecoder(file).Decode(&nbf)
 	if err != nil {
 		return fmt.Errorf("unable to decode bloom filter: %w", err)
 	}
-	*bf = nbf
+	*bf = BloomFilterV2{Bitset: nbf.Bitset, K: nbf.K}
 
 	return nil
 }
 
+// MarshalBinary packs the bitset into bytes, which is far smaller than
+// the gob encoding used by Encode.
+func (bf *BloomFilterV2) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(bf.K))
+	b = binary.AppendUvarint(b, uint64(len(bf.Bitset)))
+
+	packed := make([]byte, (len(bf.Bitset)+7)/8)
+	for i, set := range bf.Bitset {
+		if set {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return append(b, packed...), nil
+}
+
+func (bf *BloomFilterV2) UnmarshalBinary(b []byte) error {
+	k, n := binary.Uvarint(b)
+	if n <= 0 {
+		return fmt.Errorf("unable to decode k")
+	}
+	b = b[n:]
+
+	m, n := binary.Uvarint(b)
+	if n <= 0 {
+		return fmt.Errorf("unable to decode m")
+	}
+	b = b[n:]
+	if uint64(len(b)) != (m+7)/8 {
+		return fmt.Errorf("unexpected bitset length: %d", len(b))
+	}
+
+	bitset := make([]bool, m)
+	for i := range bitset {
+		bitset[i] = b[i/8]&(1<<(i%8)) != 0
+	}
+	bf.K, bf.Bitset = int(k), bitset
+	return nil
+}
+
 func cheatHash(h uint64, i int) uint32 {
 	return uint32(h) + uint32(i)*uint32(h>>32)
 }
@@ -9,10 +9,17 @@ import (
 
 type EvictFunc func(key, value any)
 
+// SizeFunc returns the size of an entry, for caches bounded by size
+// rather than by number of entries.
+type SizeFunc func(key, value any) int
+
 type Cache struct {
 	mu sync.RWMutex
 
 	maxEntries int
+	maxSize    int
+	size       int
+	sizeOf     SizeFunc
 	onEvict    EvictFunc
 	ttl        time.Duration
 
@@ -45,6 +52,15 @@ func NewCache(maxEntries int, ttl time.Duration, onEvict EvictFunc) *Cache {
 	return c
 }
 
+// NewSizedCache returns a cache which evicts entries once the sum of their
+// sizes exceeds maxSize.
+func NewSizedCache(maxSize int, sizeOf SizeFunc, ttl time.Duration, onEvict EvictFunc) *Cache {
+	c := NewCache(0, ttl, onEvict)
+	c.maxSize = maxSize
+	c.sizeOf = sizeOf
+	return c
+}
+
 func (c *Cache) Add(key, value any) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -52,14 +68,16 @@ func (c *Cache) Add(key, value any) {
 	newEntry := entry{key: key, value: value, lastAccessed: time.Now()}
 
 	if ele, ok := c.cache[key]; ok {
+		c.size -= c.entrySize(ele.Value.(entry))
 		ele.Value = newEntry
 		c.ll.MoveToFront(ele)
-		return
+	} else {
+		c.ll.PushFront(newEntry)
+		c.cache[key] = c.ll.Front()
 	}
-	c.ll.PushFront(newEntry)
-	c.cache[key] = c.ll.Front()
+	c.size += c.entrySize(newEntry)
 
-	if c.cacheSizeExceeded() {
+	for c.cacheSizeExceeded() {
 		c.removeElement(c.ll.Back())
 	}
 }
@@ -125,6 +143,7 @@ func (c *Cache) removeElement(e *list.Element) {
 
 	c.ll.Remove(e)
 	delete(c.cache, e.Value.(entry).key)
+	c.size -= c.entrySize(e.Value.(entry))
 	atomic.AddUint64(&c.stats.Evicted, 1)
 
 	if c.onEvict != nil {
@@ -133,12 +152,22 @@ func (c *Cache) removeElement(e *list.Element) {
 }
 
 func (c *Cache) cacheSizeExceeded() bool {
+	if c.maxSize > 0 && c.size > c.maxSize {
+		return true
+	}
 	if c.maxEntries == 0 {
 		return false
 	}
 	return len(c.cache) > c.maxEntries
 }
 
+func (c *Cache) entrySize(e entry) int {
+	if c.sizeOf == nil {
+		return 0
+	}
+	return c.sizeOf(e.key, e.value)
+}
+
 func (c *Cache) periodicallyEvict() {
 	if c.ttl == 0 {
 		return
@@ -93,3 +93,36 @@ func TestEvictFunc(t *testing.T) {
 	time.Sleep(2 * time.Second)
 	assert.Equal(t, 16, int(counter))
 }
+
+func TestSizedCache(t *testing.T) {
+	sizeOf := func(k, v any) int {
+		return len(v.(string))
+	}
+	c := NewSizedCache(10, sizeOf, 0, nil)
+	c.Add("a", "aaaa")
+	c.Add("b", "bbbb")
+	c.Add("c", "cc")
+
+	vals := c.Head(10)
+	assert.Len(t, vals, 3)
+
+	// Evicts the oldest entries until the new one fits.
+	c.Add("d", "dddddd")
+	_, found := c.Get("a")
+	assert.False(t, found)
+	_, found = c.Get("b")
+	assert.False(t, found)
+	_, found = c.Get("c")
+	assert.True(t, found)
+
+	// Replacing an entry replaces its size.
+	c.Add("d", "d")
+	c.Add("e", "eeeeeee")
+	vals = c.Head(10)
+	assert.Len(t, vals, 3)
+
+	// Entries larger than the cache are not kept.
+	c.Add("f", "fffffffffff")
+	vals = c.Head(10)
+	assert.Len(t, vals, 0)
+}
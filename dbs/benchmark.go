@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"runtime/pprof"
+	"sync"
 	"time"
 )
 
@@ -65,4 +66,55 @@ func main() {
 		db.Get(fmt.Sprintf("key_%d", rand.Intn(1_000_000)))
 	}
 	fmt.Println("reading 250,000 entries", time.Since(t))
+
+	benchMemtables()
+}
+
+// benchMemtables compares the time taken to write 1,000,000 entries to
+// each memtable, from a single writer and from several concurrent ones.
+func benchMemtables() {
+	memtables := []struct {
+		name    string
+		factory func() lsm.Memtable
+	}{
+		{"aa tree", func() lsm.Memtable { return lsm.NewAATree() }},
+		{"skiplist", func() lsm.Memtable { return lsm.NewSkipList() }},
+	}
+
+	for _, mt := range memtables {
+		for _, writers := range []int{1, 8} {
+			os.RemoveAll(TESTDIR)
+			db, err := lsm.NewLSMTree(
+				TESTDIR,
+				lsm.WithMemTableSize(1024*1024*64),
+				lsm.WithMemtableFactory(mt.factory),
+			)
+			if err != nil {
+				panic(err)
+			}
+
+			t := time.Now()
+			var wg sync.WaitGroup
+			b := make([]byte, 128)
+			for w := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := w; i < 1_000_000; i += writers {
+						db.Put(fmt.Sprintf("key_%d", i), b)
+					}
+				}()
+			}
+			wg.Wait()
+			fmt.Printf("writing 1,000,000 entries to %s with %d writers %s\n", mt.name, writers, time.Since(t))
+
+			t = time.Now()
+			for range 250_000 {
+				db.Get(fmt.Sprintf("key_%d", rand.Intn(1_000_000)))
+			}
+			fmt.Printf("reading 250,000 entries from %s %s\n", mt.name, time.Since(t))
+			db.Close()
+		}
+	}
+	os.RemoveAll(TESTDIR)
 }
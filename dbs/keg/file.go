@@ -3,6 +3,7 @@ package keg
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 const MAX_FILE_SIZE = 1024 * 1024 * 1024 * 2 // 2GB
@@ -11,6 +12,24 @@ type Hint struct {
 	FileID      uint32
 	ValueOffset uint32
 	ValueSize   uint32
+	// Expiry is the unix time in seconds the key expires at, or 0 if it
+	// never expires.
+	Expiry uint32
+}
+
+// expired returns true if the key of the hint has expired by now.
+func (h Hint) expired(now time.Time) bool {
+	return h.Expiry != 0 && uint32(now.Unix()) >= h.Expiry
+}
+
+// expiryAfter returns the expiry of a key written now with the given TTL,
+// rounded up to the next second so the key lives for at least the TTL.
+func expiryAfter(ttl time.Duration) uint32 {
+	t := time.Now().Add(ttl)
+	if t.Truncate(time.Second).Equal(t) {
+		return uint32(t.Unix())
+	}
+	return uint32(t.Unix()) + 1
 }
 
 type ActiveFile struct {
@@ -23,6 +42,7 @@ type ActiveFile struct {
 type StaleFile struct {
 	Reader io.ReaderAt
 	FileID uint32
+	Size   uint32
 }
 
 func kegFile(dir string, fileID uint32) string {
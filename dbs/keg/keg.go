@@ -4,12 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 type Keg struct {
@@ -21,9 +25,21 @@ type Keg struct {
 
 	active ActiveFile
 	stale  map[uint32]StaleFile
+
+	// discarded is the size of the torn tail removed from the active file
+	// when it was loaded.
+	discarded uint32
+
+	// mergeMu is held by the merge in progress.
+	mergeMu       sync.Mutex
+	mergeRatio    float64
+	mergeInterval time.Duration
+	logger        *slog.Logger
+	done          chan struct{}
+	wg            sync.WaitGroup
 }
 
-func New(dir string) (*Keg, error) {
+func New(dir string, opts ...KegOption) (*Keg, error) {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize directory: %w", err)
@@ -35,7 +51,20 @@ func New(dir string) (*Keg, error) {
 		bufPool: sync.Pool{New: func() any {
 			return bytes.NewBuffer([]byte{})
 		}},
-		stale: make(map[uint32]StaleFile),
+		stale:      make(map[uint32]StaleFile),
+		mergeRatio: DEFAULT_MERGE_RATIO,
+		logger:     slog.Default(),
+	}
+	for _, opt := range opts {
+		k = opt(k)
+	}
+
+	if err := recoverMerge(dir); err != nil {
+		return nil, fmt.Errorf("unable to recover merge: %w", err)
+	}
+
+	if err := migrateLegacyFiles(dir); err != nil {
+		return nil, fmt.Errorf("unable to migrate legacy files: %w", err)
 	}
 
 	if err := k.loadKeyDir(); err != nil {
@@ -46,36 +75,36 @@ func New(dir string) (*Keg, error) {
 		return nil, fmt.Errorf("unable to load active file: %w", err)
 	}
 
+	if k.mergeInterval > 0 && k.mergeRatio > 0 {
+		k.done = make(chan struct{})
+		k.wg.Add(1)
+		go k.mergeLoop()
+	}
+
 	return k, nil
 }
 
-func (k *Keg) Put(key, value []byte) error {
-	if err := k.put(key, value); err != nil {
-		return err
-	}
-	k.keyDir.Add(key, Hint{
-		FileID:      k.active.FileID,
-		ValueOffset: k.active.Offset - uint32(len(value)+len(key)),
-		ValueSize:   uint32(len(value)),
-	})
-	return nil
+// DiscardedBytes returns the number of bytes New discarded from the end of
+// the active file, which were left by a write interrupted by a crash.
+func (k *Keg) DiscardedBytes() uint32 {
+	return k.discarded
 }
 
-func (k *Keg) Get(key []byte) ([]byte, error) {
-	hint, err := k.keyDir.Get(key)
-	if err != nil {
-		return []byte{}, nil
-	}
-	v := make([]byte, hint.ValueSize)
+func (k *Keg) Put(key, value []byte) error {
+	return k.put(key, value, 0)
+}
 
-	k.mu.RLock()
-	reader := k.active.Reader
-	if hint.FileID != k.active.FileID {
-		reader = k.stale[hint.FileID].Reader
-	}
-	k.mu.RUnlock()
+// PutWithTTL puts a key which expires after the TTL, at a granularity of
+// seconds. Once it has expired, Get no longer returns it, Fold skips it and
+// Compact drops it.
+func (k *Keg) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return k.put(key, value, expiryAfter(ttl))
+}
 
-	_, err = reader.ReadAt(v, int64(hint.ValueOffset))
+// Get returns the value of the key, or an empty value if the key doesn't
+// exist or has expired.
+func (k *Keg) Get(key []byte) ([]byte, error) {
+	v, _, err := k.get(key)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read value for get %s: %w", key, err)
 	}
@@ -84,126 +113,107 @@ func (k *Keg) Get(key []byte) ([]byte, error) {
 
 func (k *Keg) Delete(key []byte) (uint32, error) {
 	h, err := k.keyDir.Get(key)
-	if err != nil {
+	if err != nil || h.ValueSize == 0 || h.expired(time.Now()) {
 		return 0, nil
 	}
 
-	err = k.put(key, []byte{})
+	err = k.put(key, []byte{}, 0)
 	if err != nil {
 		return 0, fmt.Errorf("unable to delete key: %w", err)
 	}
-
-	k.keyDir.Delete(key)
 	return h.ValueSize + HEADER_SIZE, nil
 }
 
+// Fold calls f with every key and value, skipping expired keys. Keys
+// written during the fold may or may not be included.
 func (k *Keg) Fold(f func(k []byte, v []byte)) error {
+	keys := make([][]byte, 0)
 	k.keyDir.Fold(func(key []byte, hint Hint) error {
-		k.mu.RLock()
-		var reader io.ReaderAt
-		if hint.FileID != k.active.FileID {
-			reader = k.stale[hint.FileID].Reader
-		} else {
-			reader = k.active.Reader
+		if hint.ValueSize > 0 {
+			keys = append(keys, key)
 		}
-		k.mu.RUnlock()
+		return nil
+	})
 
-		v := make([]byte, hint.ValueSize)
-		_, err := reader.ReadAt(v, int64(hint.ValueOffset))
+	for _, key := range keys {
+		v, ok, err := k.get(key)
 		if err != nil {
 			return fmt.Errorf("unable to read value for fold: %w", err)
 		}
-		f(key, v)
-
-		return nil
-	})
+		if ok {
+			f(key, v)
+		}
+	}
 	return nil
 }
 
-// Compact is minimally blocking (hopefully).
-func (k *Keg) Compact() error {
-	staleKeys, staleFileIDs := k.getStaleKeysFileIDs()
-	if len(staleFileIDs) == 0 {
-		return nil
-	}
-
-	tempKeg, err := New(filepath.Join(k.dir, "temp"))
-	if err != nil {
-		return fmt.Errorf("unable to create temp keg: %w", err)
+// Close stops background merges, waiting for one in progress, and closes
+// every file.
+func (k *Keg) Close() {
+	if k.done != nil {
+		close(k.done)
+		k.wg.Wait()
+		k.done = nil
 	}
 
-	for _, sk := range staleKeys {
-		v, _ := k.Get(sk)
-		if len(v) == 0 {
-			continue
-		}
-		if err = tempKeg.Put(sk, v); err != nil {
-			return fmt.Errorf("unable to put in temp keg: %w", err)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active.Writer.Close()
+	for _, sf := range k.stale {
+		if c, ok := sf.Reader.(io.Closer); ok {
+			c.Close()
 		}
 	}
-	tempKeg.Close()
-	numFiles := int(tempKeg.active.FileID) + 1
+}
 
-	// Rotate files to make space for temp files.
-	k.mu.Lock()
-	baseFileID := k.active.FileID
-	k.rotate(uint32(numFiles + 1))
-	k.mu.Unlock()
+// get returns the value of the key, and false if it doesn't exist, was
+// deleted or has expired. The hint is read under the lock, so that a merge
+// can't remove its file first.
+func (k *Keg) get(key []byte) ([]byte, bool, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
 
-	err = k.moveTempFiles(tempKeg.dir, baseFileID)
-	if err != nil {
-		return fmt.Errorf("unable to move temp files: %w", err)
+	hint, err := k.keyDir.Get(key)
+	if err != nil || hint.ValueSize == 0 || hint.expired(time.Now()) {
+		return []byte{}, false, nil
 	}
-
-	k.mu.Lock()
-	for i := 0; i < numFiles; i++ {
-		fID := baseFileID + uint32(i+1)
-		fName := kegFile(k.dir, fID)
-
-		f, err := os.Open(fName)
-		if err != nil {
-			return fmt.Errorf("unable to open file %s: %w", fName, err)
-		}
-		k.stale[fID] = StaleFile{Reader: f, FileID: fID}
+	v := make([]byte, hint.ValueSize)
+	if _, err := k.reader(hint.FileID).ReadAt(v, int64(hint.ValueOffset)); err != nil {
+		return nil, false, err
 	}
-	k.mu.Unlock()
+	return v, true, nil
+}
 
-	newFKDirs := make([]FileKeyDir, len(tempKeg.keyDir.FKDirs))
-	for idx, fkd := range tempKeg.keyDir.FKDirs {
-		nfkd := fkd
-		nfkd.FileID += baseFileID + 1
-		for key, hint := range nfkd.Hints {
-			hint.FileID = nfkd.FileID
-			nfkd.Hints[key] = hint
-		}
-		newFKDirs[idx] = nfkd
-		k.keyDir.AddFileKeyDir(nfkd)
-	}
+// read returns the value the hint points to.
+func (k *Keg) read(hint Hint) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
 
-	err = k.removeStaleFiles(staleFileIDs)
-	if err != nil {
-		return fmt.Errorf("unable to remove stale files: %w", err)
-	}
-	err = k.generateHintFiles(newFKDirs, numFiles, baseFileID)
-	if err != nil {
-		return fmt.Errorf("unable to generate hint files: %w", err)
+	v := make([]byte, hint.ValueSize)
+	if _, err := k.reader(hint.FileID).ReadAt(v, int64(hint.ValueOffset)); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return v, nil
 }
 
-func (k *Keg) Close() {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-	k.active.Writer.Close()
+// reader returns the reader of a file.
+// Assumes that the caller has acquired the lock.
+func (k *Keg) reader(fileID uint32) io.ReaderAt {
+	if fileID == k.active.FileID {
+		return k.active.Reader
+	}
+	return k.stale[fileID].Reader
 }
 
-func (k *Keg) put(key, value []byte) error {
+// put appends a record to the active file, and adds its hint to the
+// keyDir. An empty value is a tombstone.
+func (k *Keg) put(key, value []byte, expiry uint32) error {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
 	header := Header{
 		Timestamp: uint32(time.Now().Unix()),
+		Expiry:    expiry,
 		KeySize:   uint32(len(key)),
 		ValueSize: uint32(len(value)),
 	}
@@ -212,14 +222,8 @@ func (k *Keg) put(key, value []byte) error {
 	defer k.bufPool.Put(buf)
 	defer buf.Reset()
 
-	if err := header.encode(buf); err != nil {
-		return fmt.Errorf("unable to encode header: %w", err)
-	}
-	if _, err := buf.Write(value); err != nil {
-		return fmt.Errorf("unable to write value: %w", err)
-	}
-	if _, err := buf.Write(key); err != nil {
-		return fmt.Errorf("unable to write key: %w", err)
+	if err := encodeRecord(buf, header, key, value); err != nil {
+		return err
 	}
 
 	if k.active.Offset+uint32(buf.Len()) > MAX_FILE_SIZE {
@@ -233,94 +237,40 @@ func (k *Keg) put(key, value []byte) error {
 	if err != nil {
 		return fmt.Errorf("unable to write buffer to file: %w", err)
 	}
-	k.active.Offset += uint32(n)
-
-	return nil
-}
-
-func (k *Keg) getStaleKeysFileIDs() ([][]byte, map[uint32]any) {
-	staleKeys := make([][]byte, 0)
-	staleFileIDs := make(map[uint32]any)
-
-	k.mu.RLock()
-	activeFileID := k.active.FileID
-	k.mu.RUnlock()
-
-	k.keyDir.Fold(func(key []byte, hint Hint) error {
-		if hint.FileID < activeFileID {
-			staleKeys = append(staleKeys, []byte(key))
-			staleFileIDs[hint.FileID] = struct{}{}
-		}
-		return nil
+	k.keyDir.Add(key, Hint{
+		FileID:      k.active.FileID,
+		ValueOffset: k.active.Offset + HEADER_SIZE,
+		ValueSize:   uint32(len(value)),
+		Expiry:      expiry,
 	})
-
-	return staleKeys, staleFileIDs
-}
-
-func (k *Keg) moveTempFiles(tempDir string, baseFileID uint32) error {
-	tempFiles, err := filepath.Glob(fmt.Sprintf("%s/*.keg", tempDir))
-	if err != nil {
-		return fmt.Errorf("unable to glob temp files: %w", err)
-	}
-
-	for idx, file := range tempFiles {
-		newFileName := kegFile(k.dir, baseFileID+uint32(idx+1))
-		err := os.Rename(file, newFileName)
-		if err != nil {
-			return fmt.Errorf("unable to rename temp file: %w", err)
-		}
-	}
+	k.active.Offset += uint32(n)
 
 	return nil
 }
 
-func (k *Keg) removeStaleFiles(fileIDs map[uint32]any) error {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-
-	for id := range fileIDs {
-		file := kegFile(k.dir, id)
-		if err := os.Remove(file); err != nil {
-			return fmt.Errorf("unable to remove file: %w", err)
+// rotate closes the current file, writes its hint file and opens a new one.
+// Assumes that the caller has acquired the lock.
+func (k *Keg) rotate(incr uint32) error {
+	// The file is synced before its hint file is written, so the hint file
+	// never points past the end of the file.
+	if s, ok := k.active.Writer.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("unable to sync file: %w", err)
 		}
-		delete(k.stale, id)
 	}
-	return nil
-}
-
-func (k *Keg) generateHintFiles(fileKeyDirs []FileKeyDir, n int, baseFileID uint32) error {
-	for i := 0; i < n; i++ {
-		fName := hintFile(k.dir, baseFileID+uint32(i+1))
-
-		f, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("unable to open file: %w", err)
-		}
-
-		buf := new(bytes.Buffer)
-		encoder := gob.NewEncoder(buf)
-
-		err = encoder.Encode(fileKeyDirs[i].Hints)
-		if err != nil {
-			return fmt.Errorf("unable to encode keyDir: %w", err)
-		}
-
-		_, err = f.Write(buf.Bytes())
-		if err != nil {
-			return fmt.Errorf("unable to write bytes to hint file: %w", err)
-		}
+	fkd := k.keyDir.FileKeyDir(k.active.FileID)
+	if err := writeHintFile(hintFile(k.dir, k.active.FileID), fkd); err != nil {
+		return err
 	}
-	return nil
-}
-
-// rotate closes the current file and opens a new one.
-// Assumes that the caller has acquired the lock.
-func (k *Keg) rotate(incr uint32) error {
 	if err := k.active.Writer.Close(); err != nil {
 		return fmt.Errorf("unable to close file: %w", err)
 	}
 
-	k.stale[k.active.FileID] = StaleFile{Reader: k.active.Reader, FileID: k.active.FileID}
+	k.stale[k.active.FileID] = StaleFile{
+		Reader: k.active.Reader,
+		FileID: k.active.FileID,
+		Size:   k.active.Offset,
+	}
 	k.active.FileID += incr
 	k.active.Offset = 0
 
@@ -346,11 +296,24 @@ func (k *Keg) rotate(incr uint32) error {
 	return nil
 }
 
+// getDataFiles returns every data file in order of ID, so the active file
+// is last.
 func getDataFiles(dir string) ([]string, error) {
 	files, err := filepath.Glob(filepath.Join(dir, "*.keg"))
 	if err != nil {
 		return nil, fmt.Errorf("error globbing data files: %s", err)
 	}
+	ids := make(map[string]uint32, len(files))
+	for _, f := range files {
+		id, err := getIDFromFile(f)
+		if err != nil {
+			return nil, err
+		}
+		ids[f] = id
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return ids[files[i]] < ids[files[j]]
+	})
 	return files, nil
 }
 
@@ -424,50 +387,72 @@ func (k *Keg) loadKeyDir() error {
 			return fmt.Errorf("unable to open file: %w", err)
 		}
 
+		sfs, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("unable to stat file: %w", err)
+		}
+		size := uint32(sfs.Size())
+
 		if i != len(dataFiles)-1 {
-			k.stale[id] = StaleFile{Reader: file, FileID: id}
+			k.stale[id] = StaleFile{Reader: file, FileID: id, Size: size}
 		}
 
+		// A hint file that can't be decoded is ignored, and the keys are
+		// read from the data file instead.
 		hintFileName := hintFile(k.dir, id)
 		hintFile, err := os.Open(hintFileName)
 		if err == nil {
-			err = k.decodeKeyDirFromHint(hintFile)
-			if err != nil {
-				return err
+			err = k.decodeKeyDirFromHint(hintFile, id)
+			hintFile.Close()
+			if err == nil {
+				continue
 			}
-			continue
 		}
 
-		sfs, err := file.Stat()
-		if err != nil {
-			return fmt.Errorf("unable to stat file: %w", err)
+		valid, err := k.populateKeyDirFromData(file, id, size)
+		if err == nil {
+			continue
 		}
 
-		err = k.populateKeyDirFromData(file, id, uint32(sfs.Size()))
-		if err != nil {
+		// The end of the active file may have been torn by a crash, and
+		// is discarded. Every other file was complete when rotated.
+		torn := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorruptRecord)
+		if i != len(dataFiles)-1 || !torn {
 			return fmt.Errorf("unable to populate keys: %w", err)
 		}
+		if err := os.Truncate(df, int64(valid)); err != nil {
+			return fmt.Errorf("unable to truncate torn file: %w", err)
+		}
+		k.discarded = size - valid
 	}
 
 	return nil
 }
 
 // decodeKeyDirFromHint populates keyDir from the hint file.
-func (k *Keg) decodeKeyDirFromHint(file *os.File) error {
+func (k *Keg) decodeKeyDirFromHint(file *os.File, fileID uint32) error {
 	decoder := gob.NewDecoder(bufio.NewReader(file))
-	var fileKeyDir FileKeyDir
+	fileKeyDir := FileKeyDir{FileID: fileID}
 
 	err := decoder.Decode(&fileKeyDir.Hints)
 	if err != nil {
 		return fmt.Errorf("unable to decode from hint file: %w", err)
 	}
+	// Hint files written before dead records were counted end here.
+	var stats hintStats
+	if err := decoder.Decode(&stats); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to decode stats from hint file: %w", err)
+	}
+	fileKeyDir.DeadKeys = stats.DeadKeys
+	fileKeyDir.DeadBytes = stats.DeadBytes
 	k.keyDir.AddFileKeyDir(fileKeyDir)
 
 	return nil
 }
 
-// populateKeys populates keyDir from the data file.
-func (k *Keg) populateKeyDirFromData(reader io.ReaderAt, fileID, size uint32) error {
+// populateKeys populates keyDir from the data file, and returns the
+// offset after the last record read.
+func (k *Keg) populateKeyDirFromData(reader io.ReaderAt, fileID, size uint32) (uint32, error) {
 	offset := uint32(0)
 
 	k.keyDir.AddFileKeyDir(FileKeyDir{
@@ -478,21 +463,18 @@ func (k *Keg) populateKeyDirFromData(reader io.ReaderAt, fileID, size uint32) er
 	for offset < size {
 		r, err := readRecord(reader, offset)
 		if err != nil {
-			return fmt.Errorf("%d unable to read record: %w", offset, err)
+			return offset, fmt.Errorf("%d unable to read record: %w", offset, err)
 		}
 
 		size := HEADER_SIZE + uint32(len(r.Value)) + uint32(len(r.Key))
-		if r.Header.ValueSize > 0 {
-			k.keyDir.Add(r.Key, Hint{
-				FileID:      fileID,
-				ValueOffset: offset + HEADER_SIZE,
-				ValueSize:   uint32(len(r.Value)),
-			})
-		} else {
-			k.keyDir.Delete(r.Key)
-		}
+		k.keyDir.Add(r.Key, Hint{
+			FileID:      fileID,
+			ValueOffset: offset + HEADER_SIZE,
+			ValueSize:   uint32(len(r.Value)),
+			Expiry:      r.Header.Expiry,
+		})
 		offset += size
 	}
 
-	return nil
+	return offset, nil
 }
@@ -1,9 +1,13 @@
 package keg
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -175,3 +179,417 @@ func TestDeleteCompact(t *testing.T) {
 		cleanupKeg()
 	})
 }
+
+func TestTornTail(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	for i := 0; i < 10; i++ {
+		err := k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		assert.Nil(t, err)
+	}
+	k.Close()
+
+	// Tear the last record in half.
+	path := kegFile(TEST_DIR, 0)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	recordSize := int64(HEADER_SIZE) + int64(len("key_9")+len("val_9"))
+	assert.Nil(t, os.Truncate(path, fi.Size()-recordSize/2))
+
+	k = initKeg()
+	assert.Equal(t, uint32(recordSize-recordSize/2), k.DiscardedBytes())
+	for i := 0; i < 9; i++ {
+		v, err := k.Get([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(v))
+	}
+	v, err := k.Get([]byte("key_9"))
+	assert.Nil(t, err)
+	assert.Empty(t, v)
+
+	// Writes after the truncated tail are read back.
+	assert.Nil(t, k.Put([]byte("key_9"), []byte("val_9")))
+	k.Close()
+	k = initKeg()
+	assert.Equal(t, uint32(0), k.DiscardedBytes())
+	v, err = k.Get([]byte("key_9"))
+	assert.Nil(t, err)
+	assert.Equal(t, "val_9", string(v))
+	k.Close()
+}
+
+func TestCorruptRecord(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	assert.Nil(t, k.Put([]byte("key"), []byte("val")))
+	k.Close()
+
+	// Flip a bit of the value.
+	path := kegFile(TEST_DIR, 0)
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[HEADER_SIZE] ^= 1
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	_, err = readRecord(bytes.NewReader(b), 0)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = readRecord(bytes.NewReader(b[:HEADER_SIZE+1]), 0)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// A corrupt record in a file that isn't active is never discarded.
+	assert.Nil(t, os.WriteFile(kegFile(TEST_DIR, 1), nil, 0644))
+	_, err = New(TEST_DIR)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+}
+
+// TestLegacyFiles opens files written before records had a checksum. The
+// keys were written in one file, merged into another, and then every fifth
+// deleted and every other third overwritten in the active file.
+func TestLegacyFiles(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	t.Cleanup(cleanupKeg)
+
+	files, err := filepath.Glob(filepath.Join("testdata", "baseline", "*"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(TEST_DIR, filepath.Base(f)), b, 0644))
+	}
+
+	check := func(k *Keg) {
+		for i := 0; i < 100; i++ {
+			v, err := k.Get([]byte(fmt.Sprintf("key_%03d", i)))
+			assert.Nil(t, err)
+			switch {
+			case i%5 == 0:
+				assert.Empty(t, v)
+			case i%3 == 0:
+				assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(v))
+			default:
+				assert.Equal(t, fmt.Sprintf("val_%d", i), string(v))
+			}
+		}
+	}
+
+	// Legacy files are migrated rather than discarded as torn.
+	k := initKeg()
+	assert.Equal(t, uint32(0), k.DiscardedBytes())
+	check(k)
+	assert.Nil(t, k.Put([]byte("key_000"), []byte("val_0")))
+	k.Close()
+
+	k = initKeg()
+	v, err := k.Get([]byte("key_000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "val_0", string(v))
+	_, err = k.Delete([]byte("key_000"))
+	assert.Nil(t, err)
+	check(k)
+	assert.Nil(t, k.Compact())
+	check(k)
+	k.Close()
+}
+
+func TestTTL(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	assert.Nil(t, k.Put([]byte("forever"), []byte("val")))
+	assert.Nil(t, k.PutWithTTL([]byte("live"), []byte("val"), time.Hour))
+	assert.Nil(t, k.PutWithTTL([]byte("expired"), []byte("val"), -time.Second))
+
+	check := func(k *Keg) {
+		for _, key := range []string{"forever", "live"} {
+			v, err := k.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, "val", string(v))
+		}
+		v, err := k.Get([]byte("expired"))
+		assert.Nil(t, err)
+		assert.Empty(t, v)
+
+		keys := make([]string, 0)
+		assert.Nil(t, k.Fold(func(k, v []byte) {
+			keys = append(keys, string(k))
+		}))
+		assert.ElementsMatch(t, []string{"forever", "live"}, keys)
+	}
+	check(k)
+
+	// The expiry is read back from the data file.
+	k.Close()
+	k = initKeg()
+	check(k)
+
+	// Compaction drops the expired key, and the hint file keeps the expiry
+	// of the live key.
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+	assert.Nil(t, k.Compact())
+	k.Close()
+
+	k = initKeg()
+	check(k)
+	_, err := k.keyDir.Get([]byte("expired"))
+	assert.NotNil(t, err)
+	h, err := k.keyDir.Get([]byte("live"))
+	assert.Nil(t, err)
+	assert.InDelta(t, expiryAfter(time.Hour), h.Expiry, 2)
+	h, err = k.keyDir.Get([]byte("forever"))
+	assert.Nil(t, err)
+	assert.Zero(t, h.Expiry)
+	k.Close()
+}
+
+func TestMergeRecovery(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	for i := 0; i < 100; i++ {
+		if i%25 == 0 {
+			k.mu.Lock()
+			assert.Nil(t, k.rotate(1))
+			k.mu.Unlock()
+		}
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("new")))
+	}
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+
+	check := func(k *Keg) {
+		for i := 0; i < 100; i++ {
+			expectV := fmt.Sprintf("val_%d", i)
+			if i%2 == 0 {
+				expectV = "new"
+			}
+			v, err := k.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, expectV, string(v))
+		}
+	}
+
+	// A merge which crashed before its marker was written is discarded.
+	mergeDir := filepath.Join(TEST_DIR, MERGE_DIR)
+	assert.Nil(t, os.MkdirAll(mergeDir, 0755))
+	assert.Nil(t, os.WriteFile(kegFile(mergeDir, 0), []byte("partial"), 0644))
+	k2, err := New(TEST_DIR)
+	assert.Nil(t, err)
+	check(k2)
+	k2.Close()
+	_, err = os.Stat(mergeDir)
+	assert.True(t, os.IsNotExist(err))
+
+	// A merge which crashed after its marker was written is finished.
+	k.mergeMu.Lock()
+	k.mu.Lock()
+	inputs := make([]uint32, 0)
+	for id := range k.stale {
+		inputs = append(inputs, id)
+	}
+	base := k.active.FileID
+	assert.Nil(t, k.rotate(uint32(len(inputs)+1)))
+	k.mu.Unlock()
+	marker := mergeMarker{Base: base, Inputs: inputs}
+	_, _, err = k.writeMerge(mergeDir, &marker, base)
+	assert.Nil(t, err)
+	k.mergeMu.Unlock()
+	k.Close()
+
+	k = initKeg()
+	check(k)
+	for _, id := range inputs {
+		_, err := os.Stat(kegFile(TEST_DIR, id))
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = os.Stat(mergeDir)
+	assert.True(t, os.IsNotExist(err))
+	k.Close()
+}
+
+func TestBackgroundMerge(t *testing.T) {
+	k, err := New(TEST_DIR, WithMergeInterval(10*time.Millisecond), WithMergeRatio(0.5))
+	assert.Nil(t, err)
+	t.Cleanup(cleanupKeg)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+
+	// Overwriting most of the keys leaves file 0 fragmented, and the rest
+	// are merged into a new file.
+	for i := 0; i < 60; i++ {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("new")))
+	}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(kegFile(TEST_DIR, 0))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	// Puts and Deletes continue during merges.
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			_, err = k.Delete([]byte(fmt.Sprintf("key_%d", i)))
+		} else {
+			err = k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("newer"))
+		}
+		assert.Nil(t, err)
+		if i%10 == 0 {
+			k.mu.Lock()
+			assert.Nil(t, k.rotate(1))
+			k.mu.Unlock()
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	k.Close()
+
+	// Background merges only run if enabled.
+	k = initKeg()
+	assert.Nil(t, k.done)
+	for i := 0; i < 100; i++ {
+		expectV := "newer"
+		if i%2 == 0 {
+			expectV = ""
+		}
+		v, err := k.Get([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, expectV, string(v))
+	}
+	k.Close()
+}
+
+func TestFileStats(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	record := HEADER_SIZE + uint32(len("key_0")+len("val_0"))
+	tombstone := HEADER_SIZE + uint32(len("key_0"))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+
+	// Overwrite 3 keys within file 1, and 3 from file 0, and delete 2 from
+	// file 0.
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("val_x")))
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("val_y")))
+	}
+	for i := 3; i < 5; i++ {
+		_, err := k.Delete([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+	}
+
+	expected := []FileStats{
+		{
+			FileID:    0,
+			Size:      10 * record,
+			LiveKeys:  5,
+			LiveBytes: 5 * record,
+			DeadKeys:  5,
+			DeadBytes: 5 * record,
+		},
+		{
+			FileID:         1,
+			Active:         true,
+			Size:           6*record + 2*tombstone,
+			LiveKeys:       3,
+			LiveBytes:      3 * record,
+			Tombstones:     2,
+			TombstoneBytes: 2 * tombstone,
+			DeadKeys:       3,
+			DeadBytes:      3 * record,
+		},
+	}
+	assert.Equal(t, expected, k.FileStats())
+	assert.Equal(t, 0.5, k.FileStats()[0].DeadRatio())
+
+	// The stats are read back from the hint file of the rotated file, and
+	// from the data file of the active file.
+	k.Close()
+	k = initKeg()
+	assert.Equal(t, expected, k.FileStats())
+	k.Close()
+
+	// Without the hint file, every record is read from the data file.
+	assert.Nil(t, os.Remove(hintFile(TEST_DIR, 0)))
+	k = initKeg()
+	assert.Equal(t, expected, k.FileStats())
+
+	// Compaction replaces file 0 with file 2, without its dead records,
+	// and leaves the rotated file 1 alone.
+	assert.Nil(t, k.Compact())
+	expected[1].Active = false
+	expected = []FileStats{
+		expected[1],
+		{
+			FileID:    2,
+			Size:      5 * record,
+			LiveKeys:  5,
+			LiveBytes: 5 * record,
+		},
+		{FileID: 3, Active: true},
+	}
+	assert.Equal(t, expected, k.FileStats())
+	k.Close()
+}
+
+func TestMergeTombstones(t *testing.T) {
+	k := initKeg()
+	t.Cleanup(cleanupKeg)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, k.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		_, err := k.Delete([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+	}
+	k.mu.Lock()
+	assert.Nil(t, k.rotate(1))
+	k.mu.Unlock()
+
+	// File 1 only holds deletes, which are all dead once file 0 is merged.
+	stats := k.FileStats()
+	assert.Equal(t, 0.2, stats[0].DeadRatio())
+	assert.Equal(t, uint32(2), stats[1].Tombstones)
+	assert.Equal(t, 1.0, stats[1].DeadRatio())
+
+	// Both files are merged, so the tombstones are dropped rather than
+	// rewritten by every merge.
+	assert.Nil(t, k.mergeFragmented())
+	stats = k.FileStats()
+	for _, fs := range stats {
+		assert.NotContains(t, []uint32{0, 1}, fs.FileID)
+		assert.Zero(t, fs.DeadRatio())
+	}
+	assert.Nil(t, k.mergeFragmented())
+	assert.Equal(t, stats, k.FileStats())
+
+	for i := 0; i < 10; i++ {
+		v, err := k.Get([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+		if i < 2 {
+			assert.Empty(t, v)
+		} else {
+			assert.Equal(t, fmt.Sprintf("val_%d", i), string(v))
+		}
+	}
+	k.Close()
+}
@@ -2,45 +2,66 @@ package keg
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// KeyDir maps every key to the hint of its latest record, which is either
+// a value or a tombstone. Each key is in exactly one FileKeyDir, that of the
+// file its latest record is in.
 type KeyDir struct {
-	mu     sync.RWMutex
+	mu sync.RWMutex
+	// FKDirs is in order of FileID.
 	FKDirs []FileKeyDir
+	// files maps each key to the FileID of its FileKeyDir.
+	files map[string]uint32
 }
 
+// FileKeyDir holds the hints of the keys whose latest record is in a file,
+// and counts the records of the file. A record is live if it is the latest
+// value of its key, a tombstone if it is the latest record of a deleted key,
+// and dead once a later record of its key is written.
 type FileKeyDir struct {
 	FileID uint32
 	Hints  map[string]Hint
+
+	LiveKeys       uint32
+	LiveBytes      uint32
+	Tombstones     uint32
+	TombstoneBytes uint32
+	DeadKeys       uint32
+	DeadBytes      uint32
 }
 
 func NewKeyDir() KeyDir {
 	return KeyDir{
 		FKDirs: make([]FileKeyDir, 0),
+		files:  make(map[string]uint32),
 	}
 }
 
+// recordSize returns the size of the record of a key and its hint.
+func recordSize(key string, hint Hint) uint32 {
+	return HEADER_SIZE + uint32(len(key)) + hint.ValueSize
+}
+
+// Add sets the hint of the key, and removes it from the FileKeyDir of its
+// previous hint, whose record is then dead.
 func (kd *KeyDir) Add(key []byte, hint Hint) error {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
-
-	n := len(kd.FKDirs)
-	if n == 0 {
-		return fmt.Errorf("no file key dirs")
-	}
-	kd.FKDirs[n-1].Hints[string(key)] = hint
+	kd.add(string(key), hint)
 	return nil
 }
 
+// Get returns the hint of the key, which is a tombstone if its ValueSize
+// is 0.
 func (kd *KeyDir) Get(key []byte) (Hint, error) {
 	kd.mu.RLock()
 	defer kd.mu.RUnlock()
 
-	for _, fkd := range kd.FKDirs {
-		if h, ok := fkd.Hints[string(key)]; ok {
-			return h, nil
-		}
+	if h, ok := kd.get(string(key)); ok {
+		return h, nil
 	}
 	return Hint{}, fmt.Errorf("key not found")
 }
@@ -58,24 +79,95 @@ func (kd *KeyDir) Fold(f func(key []byte, hint Hint) error) {
 	}
 }
 
+// Delete removes the key, whose record is then dead.
 func (kd *KeyDir) Delete(key []byte) error {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
+	kd.remove(string(key))
+	return nil
+}
 
-	for _, fkd := range kd.FKDirs {
-		if h, ok := fkd.Hints[string(key)]; ok {
-			h.ValueSize = 0
-			fkd.Hints[string(key)] = h
-			return nil
-		}
+// CompareAndSwap sets the hint of the key to new if it is still old, and
+// returns whether it was set.
+func (kd *KeyDir) CompareAndSwap(key []byte, old, new Hint) bool {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	if h, ok := kd.get(string(key)); !ok || h != old {
+		return false
 	}
-	return nil
+	kd.add(string(key), new)
+	return true
 }
 
+// CompareAndDelete removes the key if its hint is still old, and returns
+// whether it was removed.
+func (kd *KeyDir) CompareAndDelete(key []byte, old Hint) bool {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	if h, ok := kd.get(string(key)); !ok || h != old {
+		return false
+	}
+	kd.remove(string(key))
+	return true
+}
+
+// AddFileKeyDir adds the hints and dead records of a file, creating its
+// FileKeyDir if needed. The other counts are those of the hints.
 func (kd *KeyDir) AddFileKeyDir(fkd FileKeyDir) {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
-	kd.FKDirs = append(kd.FKDirs, fkd)
+
+	f := kd.fileKeyDir(fkd.FileID)
+	f.DeadKeys += fkd.DeadKeys
+	f.DeadBytes += fkd.DeadBytes
+	for key, hint := range fkd.Hints {
+		hint.FileID = fkd.FileID
+		kd.add(key, hint)
+	}
+}
+
+// AddDead counts a record the keyDir never pointed to as dead.
+func (kd *KeyDir) AddDead(key []byte, hint Hint) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	f := kd.fileKeyDir(hint.FileID)
+	f.DeadKeys++
+	f.DeadBytes += recordSize(string(key), hint)
+}
+
+// FileKeyDir returns a copy of the FileKeyDir of a file.
+func (kd *KeyDir) FileKeyDir(fileID uint32) FileKeyDir {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	i, ok := kd.index(fileID)
+	if !ok {
+		return FileKeyDir{FileID: fileID, Hints: make(map[string]Hint)}
+	}
+	fkd := kd.FKDirs[i]
+	fkd.Hints = make(map[string]Hint, len(kd.FKDirs[i].Hints))
+	for key, hint := range kd.FKDirs[i].Hints {
+		fkd.Hints[key] = hint
+	}
+	return fkd
+}
+
+// FileCounts returns the counts of the FileKeyDir of a file, without its
+// hints.
+func (kd *KeyDir) FileCounts(fileID uint32) FileKeyDir {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	i, ok := kd.index(fileID)
+	if !ok {
+		return FileKeyDir{FileID: fileID}
+	}
+	fkd := kd.FKDirs[i]
+	fkd.Hints = nil
+	return fkd
 }
 
 func (kd *KeyDir) DeleteFileKeyDirs(fileIDs []uint32) {
@@ -87,11 +179,79 @@ func (kd *KeyDir) DeleteFileKeyDirs(fileIDs []uint32) {
 	kd.mu.Lock()
 	defer kd.mu.Unlock()
 
-	newFKDirs := make([]FileKeyDir, len(kd.FKDirs))
+	newFKDirs := make([]FileKeyDir, 0, len(kd.FKDirs))
 	for _, fkd := range kd.FKDirs {
 		if _, ok := toDelete[fkd.FileID]; !ok {
 			newFKDirs = append(newFKDirs, fkd)
+			continue
+		}
+		for key := range fkd.Hints {
+			delete(kd.files, key)
 		}
 	}
 	kd.FKDirs = newFKDirs
 }
+
+func (kd *KeyDir) get(key string) (Hint, bool) {
+	fileID, ok := kd.files[key]
+	if !ok {
+		return Hint{}, false
+	}
+	i, _ := kd.index(fileID)
+	return kd.FKDirs[i].Hints[key], true
+}
+
+func (kd *KeyDir) add(key string, hint Hint) {
+	kd.remove(key)
+	fkd := kd.fileKeyDir(hint.FileID)
+	fkd.Hints[key] = hint
+	if hint.ValueSize > 0 {
+		fkd.LiveKeys++
+		fkd.LiveBytes += recordSize(key, hint)
+	} else {
+		fkd.Tombstones++
+		fkd.TombstoneBytes += recordSize(key, hint)
+	}
+	kd.files[key] = hint.FileID
+}
+
+func (kd *KeyDir) remove(key string) {
+	fileID, ok := kd.files[key]
+	if !ok {
+		return
+	}
+	i, _ := kd.index(fileID)
+	fkd := &kd.FKDirs[i]
+	hint := fkd.Hints[key]
+	size := recordSize(key, hint)
+	if hint.ValueSize > 0 {
+		fkd.LiveKeys--
+		fkd.LiveBytes -= size
+	} else {
+		fkd.Tombstones--
+		fkd.TombstoneBytes -= size
+	}
+	fkd.DeadKeys++
+	fkd.DeadBytes += size
+	delete(fkd.Hints, key)
+	delete(kd.files, key)
+}
+
+// index returns the index of the FileKeyDir of a file.
+func (kd *KeyDir) index(fileID uint32) (int, bool) {
+	i := sort.Search(len(kd.FKDirs), func(i int) bool {
+		return kd.FKDirs[i].FileID >= fileID
+	})
+	return i, i < len(kd.FKDirs) && kd.FKDirs[i].FileID == fileID
+}
+
+// fileKeyDir returns the FileKeyDir of a file, creating it if needed.
+func (kd *KeyDir) fileKeyDir(fileID uint32) *FileKeyDir {
+	i, ok := kd.index(fileID)
+	if !ok {
+		kd.FKDirs = append(kd.FKDirs, FileKeyDir{})
+		copy(kd.FKDirs[i+1:], kd.FKDirs[i:])
+		kd.FKDirs[i] = FileKeyDir{FileID: fileID, Hints: make(map[string]Hint)}
+	}
+	return &kd.FKDirs[i]
+}
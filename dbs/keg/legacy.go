@@ -0,0 +1,156 @@
+package keg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const LEGACY_HEADER_SIZE = uint32(unsafe.Sizeof(legacyHeader{}))
+
+// legacyHeader precedes the value and key of every record of files
+// written before records had a checksum and version.
+type legacyHeader struct {
+	Timestamp uint32
+	Expiry    uint32
+	KeySize   uint32
+	ValueSize uint32
+}
+
+// readLegacyRecord reads a record with a legacyHeader from the given
+// reader at the given offset.
+func readLegacyRecord(reader io.ReaderAt, offset uint32) (Record, error) {
+	hb := make([]byte, LEGACY_HEADER_SIZE)
+	if err := readFull(reader, hb, offset); err != nil {
+		return Record{}, fmt.Errorf("unable to read header from file at %d: %w", offset, err)
+	}
+
+	h := legacyHeader{}
+	if err := binary.Read(bytes.NewBuffer(hb), binary.LittleEndian, &h); err != nil {
+		return Record{}, fmt.Errorf("unable to decode header: %w", err)
+	}
+	if uint64(h.KeySize)+uint64(h.ValueSize) > MAX_FILE_SIZE {
+		return Record{}, fmt.Errorf("%w: record at %d is too large", ErrCorruptRecord, offset)
+	}
+
+	b := make([]byte, h.ValueSize+h.KeySize)
+	if err := readFull(reader, b, offset+LEGACY_HEADER_SIZE); err != nil {
+		return Record{}, fmt.Errorf("unable to read value and key from file at %d: %w", offset, err)
+	}
+
+	return Record{
+		Header: Header{
+			Timestamp: h.Timestamp,
+			Expiry:    h.Expiry,
+			KeySize:   h.KeySize,
+			ValueSize: h.ValueSize,
+		},
+		Value: b[:h.ValueSize],
+		Key:   b[h.ValueSize:],
+	}, nil
+}
+
+// isLegacyFile returns true if the data file was written with legacy
+// headers, which is the case if its first record only reads as a legacy
+// record. Legacy records never had an expiry, where the version of current
+// records is. A file whose first record is torn reads as neither, and is
+// left to be truncated as the torn tail of a current file.
+func isLegacyFile(reader io.ReaderAt) bool {
+	if _, err := readRecord(reader, 0); err == nil {
+		return false
+	}
+	r, err := readLegacyRecord(reader, 0)
+	return err == nil && r.Header.Expiry == 0
+}
+
+// migrateLegacyFiles rewrites every data file written with legacy headers
+// in the current format before the keg is loaded, so that it is never
+// mistaken for a torn file.
+func migrateLegacyFiles(dir string) error {
+	dataFiles, err := getDataFiles(dir)
+	if err != nil {
+		return fmt.Errorf("unable to get data files: %w", err)
+	}
+	for _, df := range dataFiles {
+		id, err := getIDFromFile(df)
+		if err != nil {
+			return fmt.Errorf("unable to get file id: %w", err)
+		}
+		if err := migrateLegacyFile(dir, id); err != nil {
+			return fmt.Errorf("unable to migrate file %s: %w", df, err)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyFile rewrites a data file written with legacy headers, if
+// it is one. Every record is kept in order, so the keys of the file are
+// unchanged. A legacy file which can't be read in full is an error, and
+// is left as is.
+//
+// The new file is written next to the old one and renamed over it. Its
+// hint file points to the old offsets, and is removed first, so that a
+// crash leaves either the legacy file or the new one without a hint file.
+func migrateLegacyFile(dir string, id uint32) error {
+	path := kegFile(dir, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
+	}
+	defer file.Close()
+
+	if !isLegacyFile(file) {
+		return nil
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat file: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %w", err)
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	buf := new(bytes.Buffer)
+	for offset := uint32(0); offset < uint32(fi.Size()); {
+		r, err := readLegacyRecord(file, offset)
+		if err != nil {
+			return fmt.Errorf("unable to read legacy record: %w", err)
+		}
+		buf.Reset()
+		if err := encodeRecord(buf, r.Header, r.Key, r.Value); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to write record: %w", err)
+		}
+		offset += LEGACY_HEADER_SIZE + r.Header.KeySize + r.Header.ValueSize
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("unable to flush file: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("unable to sync file: %w", err)
+	}
+
+	err = os.Remove(hintFile(dir, id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove hint file: %w", err)
+	}
+	if err := syncFile(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to rename migrated file: %w", err)
+	}
+	return syncFile(dir)
+}
@@ -0,0 +1,397 @@
+package keg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	MERGE_DIR    = "merge"
+	MERGE_MARKER = "MERGE"
+
+	DEFAULT_MERGE_RATIO = 0.5
+)
+
+// mergeMarker is written to the merge directory once every output of a
+// merge is complete, and commits the merge. Output i of the merge is moved
+// to file Base+1+i.
+type mergeMarker struct {
+	Base    uint32
+	Outputs uint32
+	Inputs  []uint32
+}
+
+// Compact merges every stale file.
+func (k *Keg) Compact() error {
+	k.mergeMu.Lock()
+	defer k.mergeMu.Unlock()
+
+	k.mu.RLock()
+	inputs := make([]uint32, 0, len(k.stale))
+	for id := range k.stale {
+		inputs = append(inputs, id)
+	}
+	k.mu.RUnlock()
+
+	if len(inputs) == 0 {
+		return nil
+	}
+	return k.merge(inputs)
+}
+
+// mergeLoop merges fragmented files every merge interval until the keg is
+// closed.
+func (k *Keg) mergeLoop() {
+	defer k.wg.Done()
+
+	ticker := time.NewTicker(k.mergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			if err := k.mergeFragmented(); err != nil {
+				k.logger.Error("unable to merge files", "dir", k.dir, "err", err)
+			}
+		}
+	}
+}
+
+// mergeFragmented merges every stale file whose DeadRatio is at least the
+// merge ratio. Empty files are only merged along with others, since every
+// merge leaves the active file it rotated stale, which may be empty.
+//
+// A tombstone is only dropped if every older file is merged too, so a file
+// which is picked for its tombstones is merged along with every older file.
+// Otherwise it would be rewritten with the same tombstones every time.
+func (k *Keg) mergeFragmented() error {
+	k.mergeMu.Lock()
+	defer k.mergeMu.Unlock()
+
+	stats := k.FileStats()
+	through := -1
+	for _, fs := range stats {
+		dead := float64(fs.DeadBytes) / float64(fs.Size)
+		if !fs.Active && fs.DeadRatio() >= k.mergeRatio && dead < k.mergeRatio {
+			through = int(fs.FileID)
+		}
+	}
+
+	inputs, empty := make([]uint32, 0), make([]uint32, 0)
+	for _, fs := range stats {
+		switch {
+		case fs.Active:
+		case fs.Size == 0:
+			empty = append(empty, fs.FileID)
+		case int(fs.FileID) <= through || fs.DeadRatio() >= k.mergeRatio:
+			inputs = append(inputs, fs.FileID)
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil
+	}
+	return k.merge(append(inputs, empty...))
+}
+
+// merge rewrites the latest records of the keys in the input files to new
+// files, and removes the inputs. Assumes that the caller holds mergeMu.
+//
+// The active file is rotated past a file ID for every input, which the
+// outputs are moved to, so they are newer than every stale file and older
+// than every write made during the merge. The outputs are written to the
+// merge directory, and the merge is committed by writing the merge marker
+// once they are complete. A merge without a marker is discarded when the
+// keg is opened, and one with a marker is finished.
+//
+// Puts and Deletes continue during the merge. Keys they write are left
+// alone when the keyDir is updated.
+func (k *Keg) merge(inputs []uint32) error {
+	mergeDir := filepath.Join(k.dir, MERGE_DIR)
+	if err := os.RemoveAll(mergeDir); err != nil {
+		return fmt.Errorf("unable to remove merge directory: %w", err)
+	}
+
+	k.mu.Lock()
+	base := k.active.FileID
+	if err := k.rotate(uint32(len(inputs) + 1)); err != nil {
+		k.mu.Unlock()
+		return fmt.Errorf("unable to rotate file: %w", err)
+	}
+	// A tombstone can only be dropped if every file older than it is
+	// merged too, or an older value of its key would return.
+	isInput := make(map[uint32]bool, len(inputs))
+	for _, id := range inputs {
+		isInput[id] = true
+	}
+	floor := uint32(math.MaxUint32)
+	for id := range k.stale {
+		if !isInput[id] {
+			floor = min(floor, id)
+		}
+	}
+	k.mu.Unlock()
+
+	marker := mergeMarker{Base: base, Inputs: inputs}
+	written, dropped, err := k.writeMerge(mergeDir, &marker, floor)
+	if err != nil {
+		os.RemoveAll(mergeDir)
+		return err
+	}
+
+	// The merge is committed, and is finished by New if it fails from here.
+	if err := moveMergeOutputs(k.dir, marker); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	for i := uint32(0); i < marker.Outputs; i++ {
+		id := base + 1 + i
+		f, err := os.Open(kegFile(k.dir, id))
+		if err != nil {
+			k.mu.Unlock()
+			return fmt.Errorf("unable to open file: %w", err)
+		}
+		fs, err := f.Stat()
+		if err != nil {
+			k.mu.Unlock()
+			return fmt.Errorf("unable to stat file: %w", err)
+		}
+		k.stale[id] = StaleFile{Reader: f, FileID: id, Size: uint32(fs.Size())}
+	}
+	// Keys written during the merge leave their merged record dead.
+	for key, h := range written {
+		if !k.keyDir.CompareAndSwap([]byte(key), h[0], h[1]) {
+			k.keyDir.AddDead([]byte(key), h[1])
+		}
+	}
+	for key, h := range dropped {
+		k.keyDir.CompareAndDelete([]byte(key), h)
+	}
+	k.keyDir.DeleteFileKeyDirs(inputs)
+	for _, id := range inputs {
+		if c, ok := k.stale[id].Reader.(io.Closer); ok {
+			c.Close()
+		}
+		delete(k.stale, id)
+	}
+	k.mu.Unlock()
+
+	if err := removeMergeInputs(k.dir, marker); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(mergeDir); err != nil {
+		return fmt.Errorf("unable to remove merge directory: %w", err)
+	}
+	return nil
+}
+
+// writeMerge writes the outputs of a merge and their hint files to the
+// merge directory, followed by the merge marker. It returns the old and new
+// hint of every key written, and the hint of every tombstone dropped.
+func (k *Keg) writeMerge(mergeDir string, marker *mergeMarker, floor uint32) (map[string][2]Hint, map[string]Hint, error) {
+	out, err := New(mergeDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create merge keg: %w", err)
+	}
+	defer out.Close()
+
+	written := make(map[string][2]Hint)
+	dropped := make(map[string]Hint)
+	now := time.Now()
+	for _, id := range marker.Inputs {
+		for key, hint := range k.keyDir.FileKeyDir(id).Hints {
+			value := []byte{}
+			expiry := uint32(0)
+			if hint.ValueSize == 0 || hint.expired(now) {
+				if hint.FileID < floor {
+					dropped[key] = hint
+					continue
+				}
+			} else {
+				value, err = k.read(hint)
+				if err != nil {
+					return nil, nil, fmt.Errorf("unable to read value for merge: %w", err)
+				}
+				expiry = hint.Expiry
+			}
+			if err := out.put([]byte(key), value, expiry); err != nil {
+				return nil, nil, fmt.Errorf("unable to put in merge keg: %w", err)
+			}
+			written[key] = [2]Hint{hint}
+		}
+	}
+
+	out.mu.RLock()
+	marker.Outputs = out.active.FileID + 1
+	if out.active.Offset == 0 {
+		marker.Outputs--
+	}
+	out.mu.RUnlock()
+	if marker.Outputs > uint32(len(marker.Inputs)) {
+		return nil, nil, fmt.Errorf("merge needs %d files, more than its %d inputs", marker.Outputs, len(marker.Inputs))
+	}
+
+	for key, h := range written {
+		hint, err := out.keyDir.Get([]byte(key))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get hint of merged key: %w", err)
+		}
+		hint.FileID += marker.Base + 1
+		written[key] = [2]Hint{h[0], hint}
+	}
+
+	for i := uint32(0); i < marker.Outputs; i++ {
+		fkd := out.keyDir.FileKeyDir(i)
+		for key, hint := range fkd.Hints {
+			hint.FileID += marker.Base + 1
+			fkd.Hints[key] = hint
+		}
+		if err := writeHintFile(hintFile(mergeDir, i), fkd); err != nil {
+			return nil, nil, err
+		}
+		if err := syncFile(kegFile(mergeDir, i)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(marker); err != nil {
+		return nil, nil, fmt.Errorf("unable to encode merge marker: %w", err)
+	}
+	markerFile := filepath.Join(mergeDir, MERGE_MARKER)
+	if err := writeFileSync(markerFile+".tmp", buf.Bytes()); err != nil {
+		return nil, nil, fmt.Errorf("unable to write merge marker: %w", err)
+	}
+	if err := os.Rename(markerFile+".tmp", markerFile); err != nil {
+		return nil, nil, fmt.Errorf("unable to rename merge marker: %w", err)
+	}
+	if err := syncFile(mergeDir); err != nil {
+		return nil, nil, err
+	}
+	return written, dropped, nil
+}
+
+// recoverMerge finishes a merge which was committed, or discards one which
+// wasn't, before the keg is loaded.
+func recoverMerge(dir string) error {
+	mergeDir := filepath.Join(dir, MERGE_DIR)
+	b, err := os.ReadFile(filepath.Join(mergeDir, MERGE_MARKER))
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.RemoveAll(mergeDir); err != nil {
+			return fmt.Errorf("unable to remove merge directory: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read merge marker: %w", err)
+	}
+
+	var marker mergeMarker
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&marker); err != nil {
+		return fmt.Errorf("unable to decode merge marker: %w", err)
+	}
+	if err := moveMergeOutputs(dir, marker); err != nil {
+		return err
+	}
+	if err := removeMergeInputs(dir, marker); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(mergeDir); err != nil {
+		return fmt.Errorf("unable to remove merge directory: %w", err)
+	}
+	return nil
+}
+
+// moveMergeOutputs moves the outputs of a merge and their hint files out
+// of the merge directory, skipping any already moved.
+func moveMergeOutputs(dir string, marker mergeMarker) error {
+	mergeDir := filepath.Join(dir, MERGE_DIR)
+	for i := uint32(0); i < marker.Outputs; i++ {
+		id := marker.Base + 1 + i
+		moves := [][2]string{
+			{hintFile(mergeDir, i), hintFile(dir, id)},
+			{kegFile(mergeDir, i), kegFile(dir, id)},
+		}
+		for _, m := range moves {
+			err := os.Rename(m[0], m[1])
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("unable to move merge output: %w", err)
+			}
+		}
+	}
+	return syncFile(dir)
+}
+
+// removeMergeInputs removes the inputs of a merge and their hint files,
+// skipping any already removed.
+func removeMergeInputs(dir string, marker mergeMarker) error {
+	for _, id := range marker.Inputs {
+		for _, f := range []string{kegFile(dir, id), hintFile(dir, id)} {
+			if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("unable to remove merge input: %w", err)
+			}
+		}
+	}
+	return syncFile(dir)
+}
+
+// hintStats follows the hints in a hint file. The other counts of the
+// file are those of its hints.
+type hintStats struct {
+	DeadKeys  uint32
+	DeadBytes uint32
+}
+
+// writeHintFile writes the hints and dead records of a file.
+func writeHintFile(path string, fkd FileKeyDir) error {
+	buf := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buf)
+	if err := encoder.Encode(fkd.Hints); err != nil {
+		return fmt.Errorf("unable to encode keyDir: %w", err)
+	}
+	stats := hintStats{DeadKeys: fkd.DeadKeys, DeadBytes: fkd.DeadBytes}
+	if err := encoder.Encode(stats); err != nil {
+		return fmt.Errorf("unable to encode hint stats: %w", err)
+	}
+	if err := writeFileSync(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write hint file: %w", err)
+	}
+	return nil
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncFile fsyncs a file or directory.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %w", path, err)
+	}
+	return nil
+}
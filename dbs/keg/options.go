@@ -0,0 +1,37 @@
+package keg
+
+import (
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type KegOption func(*Keg) *Keg
+
+// WithMergeRatio sets the fraction of a stale file which must be dead, that
+// is overwritten or deleted, for the file to be merged in the background,
+// which is DEFAULT_MERGE_RATIO by default. A ratio of 0 disables
+// background merges.
+func WithMergeRatio(ratio float64) KegOption {
+	return func(k *Keg) *Keg {
+		k.mergeRatio = ratio
+		return k
+	}
+}
+
+// WithMergeInterval enables background merges, which check the stale files
+// for merging every interval. Without it, files are only merged by Compact.
+func WithMergeInterval(interval time.Duration) KegOption {
+	return func(k *Keg) *Keg {
+		k.mergeInterval = interval
+		return k
+	}
+}
+
+// WithLogger sets the logger background merges report errors to.
+func WithLogger(logger *slog.Logger) KegOption {
+	return func(k *Keg) *Keg {
+		k.logger = logger
+		return k
+	}
+}
@@ -3,20 +3,36 @@ package keg
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"unsafe"
 )
 
 const HEADER_SIZE = uint32(unsafe.Sizeof(Header{}))
 
+// RECORD_VERSION is the format version written in the header of every
+// record, which is checked when the record is read.
+const RECORD_VERSION = 1
+
+// ErrCorruptRecord is returned when a record fails its checksum, or has an
+// unexpected format version.
+var ErrCorruptRecord = errors.New("corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Record struct {
 	Header Header
 	Value  []byte
 	Key    []byte
 }
 
+// Header precedes the value and key of every record. The CRC is a CRC32C
+// of the rest of the header, the value and the key.
 type Header struct {
+	CRC       uint32
+	Version   uint32
 	Timestamp uint32
 	Expiry    uint32
 	KeySize   uint32
@@ -31,49 +47,69 @@ func (h *Header) decode(buf *bytes.Buffer) error {
 	return binary.Read(buf, binary.LittleEndian, h)
 }
 
+// encodeRecord appends a record to the buffer, and sets its checksum.
+func encodeRecord(buf *bytes.Buffer, h Header, key, value []byte) error {
+	start := buf.Len()
+	h.Version = RECORD_VERSION
+	if err := h.encode(buf); err != nil {
+		return fmt.Errorf("unable to encode header: %w", err)
+	}
+	buf.Write(value)
+	buf.Write(key)
+
+	b := buf.Bytes()[start:]
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+	return nil
+}
+
 // readRecord reads and returns a record from the given reader at the given offset.
+// A record which was only partly written returns an error wrapping
+// io.ErrUnexpectedEOF, and one which fails its checksum returns an error
+// wrapping ErrCorruptRecord.
 func readRecord(reader io.ReaderAt, offset uint32) (Record, error) {
 	hb := make([]byte, HEADER_SIZE)
-	n, err := reader.ReadAt(hb, int64(offset))
-	if err != nil {
+	if err := readFull(reader, hb, offset); err != nil {
 		return Record{}, fmt.Errorf("unable to read header from file at %d: %w", offset, err)
 	}
-	if n != int(HEADER_SIZE) {
-		return Record{}, fmt.Errorf("incorrect number of bytes read: %d", n)
-	}
 
 	h := Header{}
 	if err := h.decode(bytes.NewBuffer(hb)); err != nil {
 		return Record{}, fmt.Errorf("unable to decode header: %w", err)
 	}
-
-	start := offset + HEADER_SIZE
-	value := make([]byte, h.ValueSize)
-
-	if h.ValueSize > 0 {
-		n, err = reader.ReadAt(value, int64(start))
-		if err != nil {
-			return Record{}, fmt.Errorf("unable to read value from file: %w", err)
-		}
-		if n != int(h.ValueSize) {
-			return Record{}, fmt.Errorf("incorrect number of bytes read: %d", n)
-		}
+	if h.Version != RECORD_VERSION {
+		return Record{}, fmt.Errorf("%w: unexpected version %d at %d", ErrCorruptRecord, h.Version, offset)
+	}
+	if uint64(h.KeySize)+uint64(h.ValueSize) > MAX_FILE_SIZE {
+		return Record{}, fmt.Errorf("%w: record at %d is too large", ErrCorruptRecord, offset)
 	}
 
-	start += h.ValueSize
-	key := make([]byte, h.KeySize)
-
-	n, err = reader.ReadAt(key, int64(start))
-	if err != nil {
-		return Record{}, fmt.Errorf("unable to read key from file: %w", err)
+	// The value and key are read together, and directly follow the header.
+	b := make([]byte, h.ValueSize+h.KeySize)
+	if err := readFull(reader, b, offset+HEADER_SIZE); err != nil {
+		return Record{}, fmt.Errorf("unable to read value and key from file at %d: %w", offset, err)
 	}
-	if n != int(h.KeySize) {
-		return Record{}, fmt.Errorf("incorrect number of bytes read: %d", n)
+
+	crc := crc32.Update(crc32.Checksum(hb[4:], crcTable), crcTable, b)
+	if crc != h.CRC {
+		return Record{}, fmt.Errorf("%w: checksum mismatch at %d", ErrCorruptRecord, offset)
 	}
 
 	return Record{
 		Header: h,
-		Value:  value,
-		Key:    key,
+		Value:  b[:h.ValueSize],
+		Key:    b[h.ValueSize:],
 	}, nil
 }
+
+// readFull reads len(b) bytes at the offset, and returns io.ErrUnexpectedEOF
+// if the reader ends first.
+func readFull(reader io.ReaderAt, b []byte, offset uint32) error {
+	n, err := reader.ReadAt(b, int64(offset))
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package keg
+
+import "sort"
+
+// FileStats counts the records of a data file. Live records are the latest
+// value of their key, tombstones the latest record of a deleted key, and
+// dead records were overwritten or deleted, and are dropped by a merge.
+type FileStats struct {
+	FileID uint32
+	Active bool
+	Size   uint32
+
+	LiveKeys       uint32
+	LiveBytes      uint32
+	Tombstones     uint32
+	TombstoneBytes uint32
+	DeadKeys       uint32
+	DeadBytes      uint32
+}
+
+// DeadRatio returns the fraction of the file which is dead records or
+// tombstones, neither of which is needed once every older file is merged.
+func (fs FileStats) DeadRatio() float64 {
+	if fs.Size == 0 {
+		return 0
+	}
+	return float64(fs.DeadBytes+fs.TombstoneBytes) / float64(fs.Size)
+}
+
+// FileStats returns the stats of every data file in order of ID, with the
+// active file last.
+func (k *Keg) FileStats() []FileStats {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	stats := make([]FileStats, 0, len(k.stale)+1)
+	for id, sf := range k.stale {
+		stats = append(stats, k.fileStats(id, sf.Size))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FileID < stats[j].FileID
+	})
+	active := k.fileStats(k.active.FileID, k.active.Offset)
+	active.Active = true
+	return append(stats, active)
+}
+
+// fileStats returns the stats of a file.
+// Assumes that the caller has acquired the lock.
+func (k *Keg) fileStats(fileID, size uint32) FileStats {
+	fkd := k.keyDir.FileCounts(fileID)
+	return FileStats{
+		FileID:         fileID,
+		Size:           size,
+		LiveKeys:       fkd.LiveKeys,
+		LiveBytes:      fkd.LiveBytes,
+		Tombstones:     fkd.Tombstones,
+		TombstoneBytes: fkd.TombstoneBytes,
+		DeadKeys:       fkd.DeadKeys,
+		DeadBytes:      fkd.DeadBytes,
+	}
+}
@@ -43,47 +43,68 @@ func (aa *AATree) Nodes() int {
 	return aa.nodes
 }
 
-func (aa *AATree) Find(key string) ([]byte, bool) {
-	return aa.find(key, aa.root)
+// Find returns the newest version of the key with a sequence number at
+// or below seq.
+func (aa *AATree) Find(key string, seq uint64) (Entry, bool) {
+	an, found := aa.find(key, aa.root)
+	if !found {
+		return Entry{}, false
+	}
+	for i := len(an.Versions) - 1; i >= 0; i-- {
+		if an.Versions[i].Seq <= seq {
+			return an.Versions[i], true
+		}
+	}
+	return Entry{}, false
 }
 
-func (aa *AATree) Insert(key string, val []byte) {
-	aa.root = aa.insert(aa.root, key, val)
+// Insert adds a new version of the key, which must be newer than every
+// existing version.
+func (aa *AATree) Insert(key string, e Entry) {
+	aa.root = aa.insert(aa.root, key, e)
 }
 
 func (aa *AATree) Remove(key string) {
 	aa.root = aa.remove(aa.root, key)
 }
 
-func (aa *AATree) Traverse(f func(k string, v []byte)) {
+// Traverse calls f for every version of every key in order, and for the
+// versions of a key from newest to oldest.
+func (aa *AATree) Traverse(f func(k string, e Entry)) {
 	aa.traverse(f, aa.root)
 }
 
-const AANODE_SIZE = uint32(unsafe.Sizeof(AANode{}))
+const (
+	AANODE_SIZE = uint32(unsafe.Sizeof(AANode{}))
+	ENTRY_SIZE  = uint32(unsafe.Sizeof(Entry{}))
+)
 
 type AANode struct {
-	Key   string
-	Val   []byte
-	Left  *AANode
-	Right *AANode
-	Level int
+	Key string
+	// Versions are ordered from oldest to newest.
+	Versions []Entry
+	Left     *AANode
+	Right    *AANode
+	Level    int
 }
 
-func (aa *AATree) traverse(f func(k string, v []byte), an *AANode) {
+func (aa *AATree) traverse(f func(k string, e Entry), an *AANode) {
 	if an == aa.nullNode {
 		return
 	}
 	aa.traverse(f, an.Left)
-	f(an.Key, an.Val)
+	for i := len(an.Versions) - 1; i >= 0; i-- {
+		f(an.Key, an.Versions[i])
+	}
 	aa.traverse(f, an.Right)
 }
 
-func (aa *AATree) find(k string, an *AANode) ([]byte, bool) {
+func (aa *AATree) find(k string, an *AANode) (*AANode, bool) {
 	if an == aa.nullNode {
 		return nil, false
 	}
 	if an.Key == k {
-		return an.Val, true
+		return an, true
 	} else if an.Key > k {
 		return aa.find(k, an.Left)
 	} else {
@@ -91,26 +112,26 @@ func (aa *AATree) find(k string, an *AANode) ([]byte, bool) {
 	}
 }
 
-func (aa *AATree) insert(k *AANode, key string, val []byte) *AANode {
+func (aa *AATree) insert(k *AANode, key string, e Entry) *AANode {
 	if k == aa.nullNode {
-		aa.size += len(key) + len(val) + int(AANODE_SIZE)
+		aa.size += len(key) + len(e.Value) + int(AANODE_SIZE+ENTRY_SIZE)
 		aa.nodes++
 		return &AANode{
-			Key:   key,
-			Val:   val,
-			Left:  aa.nullNode,
-			Right: aa.nullNode,
-			Level: 1,
+			Key:      key,
+			Versions: []Entry{e},
+			Left:     aa.nullNode,
+			Right:    aa.nullNode,
+			Level:    1,
 		}
 	}
 
 	if k.Key == key {
-		aa.size += (len(val) - len(k.Val))
-		k.Val = val
+		aa.size += len(e.Value) + int(ENTRY_SIZE)
+		k.Versions = append(k.Versions, e)
 	} else if k.Key > key {
-		k.Left = aa.insert(k.Left, key, val)
+		k.Left = aa.insert(k.Left, key, e)
 	} else {
-		k.Right = aa.insert(k.Right, key, val)
+		k.Right = aa.insert(k.Right, key, e)
 	}
 	k = skew(k)
 	k = split(k)
@@ -135,10 +156,13 @@ func (aa *AATree) remove(k *AANode, key string) *AANode {
 			// At the bottom of the tree we remove the element
 			// if it is present.
 			if aa.deleted != aa.nullNode && key == aa.deleted.Key {
-				aa.size -= len(k.Key) + len(k.Val) + int(AANODE_SIZE)
+				aa.size -= len(k.Key) + int(AANODE_SIZE)
+				for _, e := range k.Versions {
+					aa.size -= len(e.Value) + int(ENTRY_SIZE)
+				}
 				aa.nodes--
 				aa.deleted.Key = k.Key
-				aa.deleted.Val = k.Val
+				aa.deleted.Versions = k.Versions
 				aa.deleted = aa.nullNode
 				_ = aa.deleted // ignore static check warnings
 				k = k.Right
@@ -17,7 +17,7 @@ func TestInsertDelete(t *testing.T) {
 		op := rand.Intn(100)
 
 		if op < 50 {
-			set1.Insert(k, nil)
+			set1.Insert(k, Entry{})
 			set2[k] = nil
 		} else {
 			set1.Remove(k)
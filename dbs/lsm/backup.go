@@ -0,0 +1,315 @@
+package lsm
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BACKUP_SHARED_DIR = "shared"
+	BACKUP_FILES      = "FILES"
+)
+
+// BackupEngine keeps incremental backups of an LSMTree in a directory.
+// Tables are immutable, so every table is only copied once, and is shared
+// by every backup that includes it. The directory has the following
+// layout
+//
+//	shared/lsm-7.sst.1a2b3c4d.4096
+//	1/CURRENT
+//	1/MANIFEST-0
+//	1/FILES
+//
+// where the name of a shared table also holds the CRC32C and size of its
+// file, so that tables from different trees, or that reused an ID, are
+// never mistaken for each other. Every backup holds the manifest of its
+// tables, and FILES maps the name of each of its tables to the shared
+// file.
+//
+// A backup is written to a temporary directory, which is renamed to its ID
+// once complete, so a crash never leaves a partial backup.
+type BackupEngine struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// BackupInfo describes a backup.
+type BackupInfo struct {
+	ID        int
+	Timestamp time.Time
+	// Size is the total size of the tables in the backup, including those
+	// shared with other backups.
+	Size   int64
+	Tables int
+}
+
+// OpenBackupEngine opens a directory of backups, creating it if needed.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	if err := os.MkdirAll(filepath.Join(dir, BACKUP_SHARED_DIR), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create backup directory: %w", err)
+	}
+	return &BackupEngine{dir: dir}, nil
+}
+
+// CreateBackup backs up every write made to the LSMTree before it was
+// called, and returns the ID of the backup. Only tables which aren't in a
+// previous backup are copied.
+func (be *BackupEngine) CreateBackup(lt *LSMTree) (int, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	ids, err := be.backupIDs()
+	if err != nil {
+		return 0, err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+
+	// The checkpoint links to the tables of the LSMTree, so it is removed
+	// once its tables have been copied.
+	checkpoint := filepath.Join(be.dir, fmt.Sprintf("%d.checkpoint", id))
+	tmp := filepath.Join(be.dir, fmt.Sprintf("%d.tmp", id))
+	for _, d := range []string{checkpoint, tmp} {
+		if err := os.RemoveAll(d); err != nil {
+			return 0, fmt.Errorf("unable to remove incomplete backup: %w", err)
+		}
+	}
+	defer os.RemoveAll(checkpoint)
+	defer os.RemoveAll(tmp)
+
+	if err := lt.Checkpoint(checkpoint); err != nil {
+		return 0, fmt.Errorf("unable to create checkpoint: %w", err)
+	}
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return 0, fmt.Errorf("unable to create backup directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(checkpoint)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+	var files strings.Builder
+	for _, e := range entries {
+		src := filepath.Join(checkpoint, e.Name())
+		if !strings.HasPrefix(e.Name(), "lsm-") {
+			if err := copyFile(src, filepath.Join(tmp, e.Name())); err != nil {
+				return 0, fmt.Errorf("unable to copy %s: %w", e.Name(), err)
+			}
+			continue
+		}
+
+		shared, err := sharedName(src)
+		if err != nil {
+			return 0, fmt.Errorf("unable to checksum %s: %w", e.Name(), err)
+		}
+		dst := filepath.Join(be.dir, BACKUP_SHARED_DIR, shared)
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			// Copied tables are only visible once complete.
+			if err := copyFile(src, dst+".tmp"); err != nil {
+				os.Remove(dst + ".tmp")
+				return 0, fmt.Errorf("unable to copy %s: %w", e.Name(), err)
+			}
+			if err := os.Rename(dst+".tmp", dst); err != nil {
+				return 0, fmt.Errorf("unable to rename %s: %w", e.Name(), err)
+			}
+		} else if err != nil {
+			return 0, fmt.Errorf("unable to stat %s: %w", shared, err)
+		}
+		fmt.Fprintf(&files, "%s %s\n", e.Name(), shared)
+	}
+
+	if err := writeFileSync(filepath.Join(tmp, BACKUP_FILES), []byte(files.String())); err != nil {
+		return 0, fmt.Errorf("unable to write backup files: %w", err)
+	}
+	for _, d := range []string{filepath.Join(be.dir, BACKUP_SHARED_DIR), tmp} {
+		if err := syncDir(d); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(be.dir, strconv.Itoa(id))); err != nil {
+		return 0, fmt.Errorf("unable to rename backup: %w", err)
+	}
+	if err := syncDir(be.dir); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Backups returns every backup, from oldest to newest.
+func (be *BackupEngine) Backups() ([]BackupInfo, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	ids, err := be.backupIDs()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		path := filepath.Join(be.dir, strconv.Itoa(id), BACKUP_FILES)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat backup %d: %w", id, err)
+		}
+		files, err := readBackupFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read backup %d: %w", id, err)
+		}
+
+		info := BackupInfo{ID: id, Timestamp: fi.ModTime(), Tables: len(files)}
+		for _, shared := range files {
+			fi, err := os.Stat(filepath.Join(be.dir, BACKUP_SHARED_DIR, shared))
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat backup %d: %w", id, err)
+			}
+			info.Size += fi.Size()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Restore writes the backup to a new directory, which can then be opened
+// with NewLSMTree.
+func (be *BackupEngine) Restore(id int, dir string) (err error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	backup := filepath.Join(be.dir, strconv.Itoa(id))
+	files, err := readBackupFiles(filepath.Join(backup, BACKUP_FILES))
+	if err != nil {
+		return fmt.Errorf("unable to read backup %d: %w", id, err)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	for name, shared := range files {
+		if err := copyFile(filepath.Join(be.dir, BACKUP_SHARED_DIR, shared), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("unable to restore %s: %w", name, err)
+		}
+	}
+	entries, err := os.ReadDir(backup)
+	if err != nil {
+		return fmt.Errorf("unable to read backup %d: %w", id, err)
+	}
+	for _, e := range entries {
+		if e.Name() == BACKUP_FILES {
+			continue
+		}
+		if err := copyFile(filepath.Join(backup, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("unable to restore %s: %w", e.Name(), err)
+		}
+	}
+	return syncDir(dir)
+}
+
+// DeleteBackup removes a backup, along with any tables no other backup
+// shares.
+func (be *BackupEngine) DeleteBackup(id int) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(be.dir, strconv.Itoa(id))); err != nil {
+		return fmt.Errorf("unable to remove backup %d: %w", id, err)
+	}
+
+	ids, err := be.backupIDs()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, id := range ids {
+		files, err := readBackupFiles(filepath.Join(be.dir, strconv.Itoa(id), BACKUP_FILES))
+		if err != nil {
+			return fmt.Errorf("unable to read backup %d: %w", id, err)
+		}
+		for _, shared := range files {
+			live[shared] = true
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(be.dir, BACKUP_SHARED_DIR))
+	if err != nil {
+		return fmt.Errorf("unable to read shared tables: %w", err)
+	}
+	for _, e := range entries {
+		if live[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(be.dir, BACKUP_SHARED_DIR, e.Name())); err != nil {
+			return fmt.Errorf("unable to remove shared table: %w", err)
+		}
+	}
+	return nil
+}
+
+// backupIDs returns the ID of every complete backup in order.
+func (be *BackupEngine) backupIDs() ([]int, error) {
+	entries, err := os.ReadDir(be.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup directory: %w", err)
+	}
+	ids := make([]int, 0)
+	for _, e := range entries {
+		if id, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// readBackupFiles maps the name of every table in a backup to its shared
+// file.
+func readBackupFiles(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	files := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, shared, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected line: %q", scanner.Text())
+		}
+		files[name] = shared
+	}
+	return files, scanner.Err()
+}
+
+// sharedName returns the name of a table file in the shared directory.
+func sharedName(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := crc32.New(crcTable)
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%08x.%d", filepath.Base(path), h.Sum32(), n), nil
+}
@@ -0,0 +1,177 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// WriteBatch holds a list of writes that are applied atomically by
+// LSMTree.Write, so readers either see every write or none of them.
+// Writes may be to any column family.
+type WriteBatch struct {
+	keys     []string
+	entries  []Entry
+	families []int
+	size     int
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		keys:     make([]string, 0),
+		entries:  make([]Entry, 0),
+		families: make([]int, 0),
+	}
+}
+
+// Put adds a write of a value, which may be empty, to the batch.
+func (wb *WriteBatch) Put(key string, val []byte) {
+	wb.put(DEFAULT_COLUMN_FAMILY_ID, key, val, 0)
+}
+
+// PutWithTTL adds a write of a value which expires after the TTL, once
+// it is treated as deleted.
+func (wb *WriteBatch) PutWithTTL(key string, val []byte, ttl time.Duration) {
+	wb.put(DEFAULT_COLUMN_FAMILY_ID, key, val, ttl)
+}
+
+// Delete adds a deletion of the key to the batch.
+func (wb *WriteBatch) Delete(key string) {
+	wb.add(DEFAULT_COLUMN_FAMILY_ID, key, Entry{Kind: KindDelete})
+}
+
+// PutCF adds a write of a value to a column family to the batch.
+func (wb *WriteBatch) PutCF(cf *ColumnFamily, key string, val []byte) {
+	wb.put(cf.id, key, val, 0)
+}
+
+// PutCFWithTTL adds a write of a value to a column family which expires
+// after the TTL to the batch.
+func (wb *WriteBatch) PutCFWithTTL(cf *ColumnFamily, key string, val []byte, ttl time.Duration) {
+	wb.put(cf.id, key, val, ttl)
+}
+
+// DeleteCF adds a deletion of the key in a column family to the batch.
+func (wb *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	wb.add(cf.id, key, Entry{Kind: KindDelete})
+}
+
+// put adds a write of a value, which expires after the TTL unless it is 0.
+func (wb *WriteBatch) put(cf int, key string, val []byte, ttl time.Duration) {
+	// Empty values are returned as non-nil, the same as when read from disk.
+	if val == nil {
+		val = []byte{}
+	}
+	e := Entry{Value: val, Kind: KindValue}
+	if ttl != 0 {
+		e.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	wb.add(cf, key, e)
+}
+
+func (wb *WriteBatch) Len() int {
+	return len(wb.keys)
+}
+
+// Reset removes every write, so the batch can be reused.
+func (wb *WriteBatch) Reset() {
+	wb.keys = wb.keys[:0]
+	wb.entries = wb.entries[:0]
+	wb.families = wb.families[:0]
+	wb.size = 0
+}
+
+func (wb *WriteBatch) add(cf int, key string, e Entry) {
+	wb.keys = append(wb.keys, key)
+	wb.entries = append(wb.entries, e)
+	wb.families = append(wb.families, cf)
+	wb.size += len(key) + len(e.Value)
+}
+
+// encode returns the WAL record of the batch, given the sequence number
+// of its first write. Writes are numbered in the order they were added.
+//
+// The record has the following format, where every length is a uvarint
+//
+//	+-----------+-------------+-----------+--------------+------------+-----+------------+-------+-----+
+//	| Seq (var) | Count (var) | Kind (u8) | Expiry (var) | Key length | Key | Val length | Value | ... |
+//	+-----------+-------------+-----------+--------------+------------+-----+------------+-------+-----+
+//
+// where the expiry is only present if the kind has KIND_EXPIRES set. A
+// write to a column family other than the default is preceded by a
+// KIND_COLUMN_FAMILY byte and the ID of the column family as a uvarint.
+func (wb *WriteBatch) encode(seq uint64) []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen64+wb.size+len(wb.keys)*(2+4*binary.MaxVarintLen64))
+	b = binary.AppendUvarint(b, seq)
+	b = binary.AppendUvarint(b, uint64(len(wb.keys)))
+
+	for i, key := range wb.keys {
+		e := wb.entries[i]
+		if cf := wb.families[i]; cf != DEFAULT_COLUMN_FAMILY_ID {
+			b = append(b, KIND_COLUMN_FAMILY)
+			b = binary.AppendUvarint(b, uint64(cf))
+		}
+		b = appendKind(b, e)
+		b = binary.AppendUvarint(b, uint64(len(key)))
+		b = append(b, key...)
+		b = binary.AppendUvarint(b, uint64(len(e.Value)))
+		b = append(b, e.Value...)
+	}
+	return b
+}
+
+// decodeWriteBatch returns the batch encoded in a WAL record, with the
+// sequence number of every write set.
+func decodeWriteBatch(b []byte) (*WriteBatch, error) {
+	seq, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("unable to decode sequence number")
+	}
+	b = b[n:]
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("unable to decode count")
+	}
+	b = b[n:]
+
+	wb := NewWriteBatch()
+	for i := uint64(0); i < count; i++ {
+		cf := DEFAULT_COLUMN_FAMILY_ID
+		if len(b) > 0 && b[0] == KIND_COLUMN_FAMILY {
+			id, n := binary.Uvarint(b[1:])
+			if n <= 0 {
+				return nil, fmt.Errorf("unable to decode column family of write %d", i)
+			}
+			cf, b = int(id), b[1+n:]
+		}
+
+		kind, expiresAt, rest, err := readKind(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode write %d: %w", i, err)
+		}
+
+		key, rest, err := readUvarintBytes(rest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key of write %d: %w", i, err)
+		}
+		val, rest, err := readUvarintBytes(rest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode value of write %d: %w", i, err)
+		}
+		b = rest
+
+		wb.add(cf, string(key), Entry{Value: val, Kind: kind, Seq: seq + i, ExpiresAt: expiresAt})
+	}
+	return wb, nil
+}
+
+// readUvarintBytes reads a slice prefixed by its length as a uvarint,
+// and returns it along with the remaining bytes.
+func readUvarintBytes(b []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return nil, nil, fmt.Errorf("unable to decode length")
+	}
+	return b[n : n+int(l)], b[n+int(l):], nil
+}
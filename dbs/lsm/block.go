@@ -0,0 +1,203 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blockBuilder builds a block of entries added in sorted order. Each key
+// only stores the suffix it doesn't share with the previous key, except
+// at every restart point, where the whole key is stored so that a block
+// can be binary searched.
+//
+// Every entry has the following format, where every length is a uvarint
+//
+//	+--------+----------+------------+-----------+--------------+-----------+----------+-------+
+//	| Shared | Unshared | Val length | Kind (u8) | Expiry (var) | Seq (var) | Key diff | Value |
+//	+--------+----------+------------+-----------+--------------+-----------+----------+-------+
+//
+// where the expiry is only present if the kind has KIND_EXPIRES set, and
+// the block ends with the offset of every restart point and their
+// count, all as u32.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	lastKey  string
+	entries  int
+
+	restartInterval int
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{
+		buf:             make([]byte, 0),
+		restarts:        make([]uint32, 0),
+		restartInterval: restartInterval,
+	}
+}
+
+func (bb *blockBuilder) add(key string, e Entry) {
+	shared := 0
+	if bb.entries%bb.restartInterval == 0 {
+		bb.restarts = append(bb.restarts, uint32(len(bb.buf)))
+	} else {
+		for shared < min(len(key), len(bb.lastKey)) && key[shared] == bb.lastKey[shared] {
+			shared++
+		}
+	}
+
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(shared))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(key)-shared))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(e.Value)))
+	bb.buf = appendKind(bb.buf, e)
+	bb.buf = binary.AppendUvarint(bb.buf, e.Seq)
+	bb.buf = append(bb.buf, key[shared:]...)
+	bb.buf = append(bb.buf, e.Value...)
+
+	bb.lastKey = key
+	bb.entries++
+}
+
+// size returns the size of the block if it were finished now.
+func (bb *blockBuilder) size() int {
+	return len(bb.buf) + 4*(len(bb.restarts)+1)
+}
+
+func (bb *blockBuilder) empty() bool {
+	return bb.entries == 0
+}
+
+// finish returns the block, and resets the builder.
+func (bb *blockBuilder) finish() []byte {
+	b := bb.buf
+	for _, r := range bb.restarts {
+		b = binary.LittleEndian.AppendUint32(b, r)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(bb.restarts)))
+
+	bb.buf = make([]byte, 0, cap(b))
+	bb.restarts = bb.restarts[:0]
+	bb.lastKey = ""
+	bb.entries = 0
+	return b
+}
+
+// block reads a block written by blockBuilder. Keys and values returned
+// are copies, so the underlying bytes may be reused.
+type block struct {
+	data        []byte
+	numRestarts int
+	// restartsOffset is the end of the entries.
+	restartsOffset int
+}
+
+func newBlock(b []byte) (*block, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("block is too short: %d bytes", len(b))
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	restartsOffset := len(b) - 4*(numRestarts+1)
+	if numRestarts == 0 || restartsOffset < 0 {
+		return nil, fmt.Errorf("unexpected number of restarts: %d", numRestarts)
+	}
+	return &block{
+		data:           b,
+		numRestarts:    numRestarts,
+		restartsOffset: restartsOffset,
+	}, nil
+}
+
+func (b *block) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(b.data[b.restartsOffset+4*i:]))
+}
+
+// entryAt decodes the entry at the offset given the previous key, and
+// returns the offset of the next entry.
+func (b *block) entryAt(offset int, prevKey []byte) (keyValue, int, error) {
+	buf := b.data[offset:b.restartsOffset]
+	var header [3]uint64
+	for i := range header {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return keyValue{}, 0, fmt.Errorf("unable to decode entry header at %d", offset)
+		}
+		header[i] = v
+		buf = buf[n:]
+	}
+	shared, unshared, valLen := header[0], header[1], header[2]
+	if len(buf) == 0 || shared > uint64(len(prevKey)) {
+		return keyValue{}, 0, fmt.Errorf("unable to decode entry at %d", offset)
+	}
+
+	kind, expiresAt, buf, err := readKind(buf)
+	if err != nil {
+		return keyValue{}, 0, fmt.Errorf("unable to decode entry at %d: %w", offset, err)
+	}
+	seq, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return keyValue{}, 0, fmt.Errorf("unable to decode sequence number at %d", offset)
+	}
+	buf = buf[n:]
+	if uint64(len(buf)) < unshared+valLen {
+		return keyValue{}, 0, fmt.Errorf("entry at %d is truncated", offset)
+	}
+
+	key := make([]byte, 0, shared+unshared)
+	key = append(key, prevKey[:shared]...)
+	key = append(key, buf[:unshared]...)
+	val := append([]byte{}, buf[unshared:unshared+valLen]...)
+
+	next := b.restartsOffset - len(buf) + int(unshared+valLen)
+	return keyValue{key: key, Entry: Entry{Value: val, Kind: kind, Seq: seq, ExpiresAt: expiresAt}}, next, nil
+}
+
+// all returns every entry in the block.
+func (b *block) all() ([]keyValue, error) {
+	kvps := make([]keyValue, 0)
+	var prevKey []byte
+	for offset := 0; offset < b.restartsOffset; {
+		kvp, next, err := b.entryAt(offset, prevKey)
+		if err != nil {
+			return nil, err
+		}
+		kvps = append(kvps, kvp)
+		prevKey, offset = kvp.key, next
+	}
+	return kvps, nil
+}
+
+// find returns the newest version of the key with a sequence number at
+// or below seq, by binary searching the restart points.
+func (b *block) find(key string, seq uint64) (keyValue, bool, error) {
+	var err error
+	// Find the last restart point with a key before the one we want, since
+	// the versions of the key could start before the next restart point.
+	i := sort.Search(b.numRestarts, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var kvp keyValue
+		kvp, _, err = b.entryAt(b.restart(i), nil)
+		return string(kvp.key) >= key
+	})
+	if err != nil {
+		return keyValue{}, false, err
+	}
+
+	var prevKey []byte
+	for offset := b.restart(max(i-1, 0)); offset < b.restartsOffset; {
+		kvp, next, err := b.entryAt(offset, prevKey)
+		if err != nil {
+			return keyValue{}, false, err
+		}
+		if string(kvp.key) > key {
+			break
+		}
+		if string(kvp.key) == key && kvp.Seq <= seq {
+			return kvp, true, nil
+		}
+		prevKey, offset = kvp.key, next
+	}
+	return keyValue{}, false, nil
+}
@@ -0,0 +1,65 @@
+package lsm
+
+import (
+	"crumbs/cache/lru"
+)
+
+const BLOCK_CACHE_SHARDS = 16
+
+// blockCache holds decompressed chunks read from every table, keyed by the
+// table ID and the offset of the chunk. Table IDs are never reused, so
+// chunks of removed tables are left to be evicted.
+//
+// The cache is split into shards, each with their own lock and an even
+// share of the size.
+type blockCache struct {
+	shards []*lru.Cache
+}
+
+type blockKey struct {
+	table  int
+	offset int
+}
+
+func newBlockCache(size int) *blockCache {
+	sizeOf := func(_, v any) int {
+		return len(v.([]byte))
+	}
+
+	shards := make([]*lru.Cache, BLOCK_CACHE_SHARDS)
+	for i := range shards {
+		shards[i] = lru.NewSizedCache(max(size/BLOCK_CACHE_SHARDS, 1), sizeOf, 0, nil)
+	}
+	return &blockCache{shards: shards}
+}
+
+func (bc *blockCache) shard(k blockKey) *lru.Cache {
+	h := uint64(k.table)*0x9e3779b97f4a7c15 ^ uint64(k.offset)
+	return bc.shards[h%BLOCK_CACHE_SHARDS]
+}
+
+// get returns the chunk, which must not be modified.
+func (bc *blockCache) get(table, offset int) ([]byte, bool) {
+	k := blockKey{table: table, offset: offset}
+	v, ok := bc.shard(k).Get(k)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+func (bc *blockCache) add(table, offset int, chunk []byte) {
+	k := blockKey{table: table, offset: offset}
+	bc.shard(k).Add(k, chunk)
+}
+
+func (bc *blockCache) stats() lru.Stats {
+	stats := lru.Stats{}
+	for _, shard := range bc.shards {
+		s := shard.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evicted += s.Evicted
+	}
+	return stats
+}
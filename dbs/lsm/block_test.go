@@ -0,0 +1,50 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlock(t *testing.T) {
+	bb := newBlockBuilder(4)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		// Every key has an older version, except for the last.
+		bb.add(key, Entry{Value: []byte(fmt.Sprintf("new_val_%d", i)), Seq: uint64(1000 + i)})
+		if i < 99 {
+			bb.add(key, Entry{Kind: KindDelete, Seq: uint64(i)})
+		}
+	}
+
+	blk, err := newBlock(bb.finish())
+	assert.Nil(t, err)
+	assert.Equal(t, 50, blk.numRestarts)
+
+	kvps, err := blk.all()
+	assert.Nil(t, err)
+	assert.Equal(t, 199, len(kvps))
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		kvp, found, err := blk.find(key, 10_000)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(kvp.Value))
+
+		kvp, found, err = blk.find(key, 999)
+		assert.Nil(t, err)
+		assert.Equal(t, i < 99, found, key)
+		if found {
+			assert.Equal(t, KindDelete, kvp.Kind)
+		}
+	}
+
+	_, found, err := blk.find("key_", 10_000)
+	assert.Nil(t, err)
+	assert.False(t, found)
+	_, found, err = blk.find("key_999", 10_000)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
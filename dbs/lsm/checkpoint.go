@@ -0,0 +1,113 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint writes a copy of the LSMTree to a new directory while it is
+// running, which can be opened with NewLSMTree independently of it. It
+// holds every write made before Checkpoint was called.
+//
+// The memtables are flushed first, so that every write is in a table.
+// Tables are immutable, so they are hard linked into the directory rather
+// than copied where possible, and a new manifest listing them is written
+// alongside. The WAL isn't needed, and isn't copied.
+func (lt *LSMTree) Checkpoint(dir string) (err error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create checkpoint directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if err := lt.FlushMemory(); err != nil {
+		return fmt.Errorf("unable to flush memtables: %w", err)
+	}
+	if err := lt.stm.checkpoint(dir); err != nil {
+		return fmt.Errorf("unable to checkpoint tables: %w", err)
+	}
+	return nil
+}
+
+// checkpoint links every live table into the directory, and writes a
+// manifest of them. The read lock is held throughout, since the files of
+// live tables are only removed after the tables are replaced.
+func (sm *SSTManager) checkpoint(dir string) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	state := newManifestState()
+	state.nextFamily = sm.nextFamily
+	for cf, ts := range sm.families {
+		if cf != DEFAULT_COLUMN_FAMILY_ID {
+			state.families[cf] = ts.name
+		}
+		for level, tables := range ts.ssTables {
+			for _, t := range tables {
+				if err := linkTableFiles(sm.dir, dir, t.ID); err != nil {
+					return err
+				}
+				state.tables[t.ID] = tableLevel{id: t.ID, level: level, cf: cf}
+			}
+		}
+	}
+
+	m, err := createManifest(dir, 0, state)
+	if err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+// linkTableFiles links every file of a table into another directory.
+func linkTableFiles(src, dst string, id int) error {
+	files, err := filepath.Glob(filepath.Join(src, fmt.Sprintf("lsm-%d.*", id)))
+	if err != nil {
+		return fmt.Errorf("unable to glob table files: %w", err)
+	}
+	for _, f := range files {
+		if err := linkOrCopy(f, filepath.Join(dst, filepath.Base(f))); err != nil {
+			return fmt.Errorf("unable to link table file: %w", err)
+		}
+	}
+	return nil
+}
+
+// linkOrCopy hard links a file, or copies it if they are on different
+// file systems.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile durably copies a file, which must not already exist.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,246 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_COLUMN_FAMILY    = "default"
+	DEFAULT_COLUMN_FAMILY_ID = 0
+)
+
+// ErrColumnFamilyDropped is returned by reads and writes to a column
+// family after it has been dropped.
+var ErrColumnFamilyDropped = errors.New("column family has been dropped")
+
+// ColumnFamily is a named keyspace, with its own memtables and SSTables.
+// Every column family shares the WAL, compactions and block cache of the
+// LSMTree, and a WriteBatch can write to several atomically.
+//
+// The LSMTree itself reads and writes the default column family, which
+// can't be dropped.
+type ColumnFamily struct {
+	lt   *LSMTree
+	id   int
+	name string
+
+	// tables has a memtable for every WAL segment, so every column family
+	// has the same number, and is guarded by the lock of the LSMTree.
+	tables  []Memtable
+	dropped bool
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put stores a value, which may be empty, for the key.
+func (cf *ColumnFamily) Put(key string, val []byte) error {
+	wb := NewWriteBatch()
+	wb.PutCF(cf, key, val)
+	return cf.lt.Write(wb)
+}
+
+// PutWithTTL stores a value for the key which expires after the TTL, see
+// LSMTree.PutWithTTL.
+func (cf *ColumnFamily) PutWithTTL(key string, val []byte, ttl time.Duration) error {
+	wb := NewWriteBatch()
+	wb.PutCFWithTTL(cf, key, val, ttl)
+	return cf.lt.Write(wb)
+}
+
+// Get returns the value of the key, or ErrNotFound if the key doesn't
+// exist or has been deleted.
+func (cf *ColumnFamily) Get(key string) ([]byte, error) {
+	return cf.lt.get(cf, key, cf.lt.visible.Load())
+}
+
+// Delete writes a tombstone for the key.
+func (cf *ColumnFamily) Delete(key string) error {
+	wb := NewWriteBatch()
+	wb.DeleteCF(cf, key)
+	return cf.lt.Write(wb)
+}
+
+// NewIterator returns an iterator over every key in the column family
+// matching the options.
+func (cf *ColumnFamily) NewIterator(opts IteratorOptions) *Iterator {
+	return cf.lt.newIterator(cf, opts)
+}
+
+// Scan returns every key-value pair in the column family with a key in
+// [start, end) in ascending order, see LSMTree.Scan.
+func (cf *ColumnFamily) Scan(start, end string) iter.Seq2[string, []byte] {
+	return cf.NewIterator(IteratorOptions{Start: start, End: end}).All()
+}
+
+// CreateColumnFamily creates an empty column family, which is recorded in
+// the manifest so that it exists until dropped.
+func (lt *LSMTree) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if _, ok := lt.familyByName(name); ok {
+		return nil, fmt.Errorf("column family %q already exists", name)
+	}
+	id, err := lt.stm.CreateFamily(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create column family: %w", err)
+	}
+	return lt.addFamily(id, name), nil
+}
+
+// GetColumnFamily returns the column family with the name, including the
+// default column family.
+func (lt *LSMTree) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	return lt.familyByName(name)
+}
+
+// ColumnFamilies returns the names of every column family in order.
+func (lt *LSMTree) ColumnFamilies() []string {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+
+	names := make([]string, 0, len(lt.families))
+	for _, cf := range lt.families {
+		names = append(names, cf.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropColumnFamily removes a column family along with every key in it.
+// Its memtables are discarded, and its tables are removed once any
+// compactions of them finish.
+func (lt *LSMTree) DropColumnFamily(name string) error {
+	if name == DEFAULT_COLUMN_FAMILY {
+		return fmt.Errorf("unable to drop the default column family")
+	}
+
+	lt.mu.Lock()
+	cf, ok := lt.familyByName(name)
+	if ok {
+		cf.dropped = true
+		cf.tables = nil
+		delete(lt.families, cf.id)
+	}
+	lt.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("column family %q doesn't exist", name)
+	}
+
+	if err := lt.stm.DropFamily(cf.id); err != nil {
+		return fmt.Errorf("unable to drop column family: %w", err)
+	}
+	return nil
+}
+
+// addFamily expects the caller to hold the write lock. It gives the
+// column family an empty memtable for every WAL segment.
+func (lt *LSMTree) addFamily(id int, name string) *ColumnFamily {
+	cf := &ColumnFamily{lt: lt, id: id, name: name}
+	if def, ok := lt.families[DEFAULT_COLUMN_FAMILY_ID]; ok {
+		for range def.tables {
+			cf.tables = append(cf.tables, lt.newMemtable())
+		}
+	}
+	lt.families[id] = cf
+	return cf
+}
+
+// familyByName expects the caller to hold the lock.
+func (lt *LSMTree) familyByName(name string) (*ColumnFamily, bool) {
+	for _, cf := range lt.families {
+		if cf.name == name {
+			return cf, true
+		}
+	}
+	return nil, false
+}
+
+// CreateFamily records a new column family in the manifest, and returns
+// its ID. IDs are never reused, so writes to a dropped column family left
+// in the WAL are never replayed into a new one.
+func (sm *SSTManager) CreateFamily(name string) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	id := sm.nextFamily
+	ve := versionEdit{created: []family{{id: id, name: name}}, nextFamily: id + 1}
+	if err := sm.manifest.log(ve); err != nil {
+		return 0, err
+	}
+	sm.families[id] = newTableSet(name)
+	sm.nextFamily++
+	return id, nil
+}
+
+// DropFamily waits for any running compactions of the column family, and
+// then removes it and its tables.
+func (sm *SSTManager) DropFamily(cf int) error {
+	sm.mu.Lock()
+	ts, ok := sm.families[cf]
+	if ok {
+		ts.dropped = true
+	}
+	sm.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	sm.compactMu.Lock()
+	for sm.compactingFamilyLocked(cf) {
+		sm.compactCond.Wait()
+	}
+	sm.compactMu.Unlock()
+
+	if err := sm.manifest.log(versionEdit{dropped: []int{cf}}); err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	delete(sm.families, cf)
+	sm.mu.Unlock()
+	sm.wakeStalledWrites()
+
+	// Files can still be read by open iterators after being removed.
+	for _, level := range ts.ssTables {
+		for _, t := range level {
+			t.unref()
+			if err := removeTableFiles(sm.dir, t.ID); err != nil {
+				sm.logger.Error("unable to remove dropped files", "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Families returns the name of every column family other than the
+// default.
+func (sm *SSTManager) Families() map[int]string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	names := make(map[int]string)
+	for cf, ts := range sm.families {
+		if cf != DEFAULT_COLUMN_FAMILY_ID {
+			names[cf] = ts.name
+		}
+	}
+	return names
+}
+
+// compactingFamilyLocked expects the caller to hold compactMu.
+func (sm *SSTManager) compactingFamilyLocked(cf int) bool {
+	for fl := range sm.outputLevels {
+		if fl.cf == cf {
+			return true
+		}
+	}
+	return false
+}
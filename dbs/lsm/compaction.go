@@ -0,0 +1,346 @@
+package lsm
+
+import (
+	"sort"
+	"time"
+)
+
+// COMPACTION_PROGRESS_INTERVAL is the number of bytes a compaction reads
+// between progress reports.
+const COMPACTION_PROGRESS_INTERVAL = 1024 * 1024 // 1 MB
+
+// CompactionStrategy decides which tables are compacted together, and
+// which level the result is written to. Trading off write amplification
+// against read amplification is done by choosing a different strategy.
+//
+// A single strategy is shared by every column family, and is given the
+// levels of each in turn.
+//
+// Strategies are only ever called by one goroutine at a time, so they
+// don't need to be safe for concurrent use.
+type CompactionStrategy interface {
+	// Pick returns the next compaction to run given the tables in each
+	// level, or nil if no compaction is needed. Tables in level 0 are in
+	// the order they were flushed, and tables in every other level are
+	// sorted by their smallest key. The levels must not be modified.
+	Pick(levels [][]SSTable) *Compaction
+}
+
+// Compaction describes a single compaction picked by a CompactionStrategy.
+type Compaction struct {
+	// Inputs are merged together, and removed from their levels. If two
+	// inputs contain the same key, the one from the deeper level (or the
+	// one flushed later, if in the same level) is considered older.
+	Inputs []SSTable
+	// OutputLevel is the level the merged tables are written to.
+	OutputLevel int
+	// MaxTableSize splits the output into tables of roughly this size,
+	// which must then not overlap with other tables in the output level.
+	// If it is 0, a single table is written.
+	MaxTableSize int
+
+	// bottommost is set when no other table in or below the compacted
+	// levels can contain any of the keys, so deletions can be dropped.
+	bottommost bool
+	// cf is the column family the tables belong to.
+	cf int
+}
+
+// CompactionProgress reports how far a running compaction has got, see
+// WithCompactionProgress.
+type CompactionProgress struct {
+	OutputLevel int
+	InputTables int
+	// InputBytes is the total size of the data blocks of the inputs, of
+	// which BytesRead have been read so far.
+	InputBytes int64
+	BytesRead  int64
+	// BytesWritten is the size of the output written so far, of which
+	// TablesWritten tables are finished.
+	BytesWritten  int64
+	TablesWritten int
+	Elapsed       time.Duration
+	// Done is only set on the last report of a compaction that finished,
+	// and not one that failed or was cancelled.
+	Done bool
+}
+
+// compactionProgress counts the progress of a compaction, and reports it
+// every COMPACTION_PROGRESS_INTERVAL bytes read, every time an output
+// table is finished, and once the compaction is done.
+type compactionProgress struct {
+	fn         func(CompactionProgress)
+	p          CompactionProgress
+	start      time.Time
+	nextReport int64
+	// written is the size of the finished output tables.
+	written int64
+}
+
+func newCompactionProgress(c *Compaction, fn func(CompactionProgress)) *compactionProgress {
+	cp := &compactionProgress{
+		fn:         fn,
+		start:      time.Now(),
+		nextReport: COMPACTION_PROGRESS_INTERVAL,
+		p: CompactionProgress{
+			OutputLevel: c.OutputLevel,
+			InputTables: len(c.Inputs),
+		},
+	}
+	for _, t := range c.Inputs {
+		cp.p.InputBytes += int64(t.DataSize)
+	}
+	return cp
+}
+
+func (cp *compactionProgress) read(n int) {
+	cp.p.BytesRead += int64(n)
+}
+
+// maybeReport reports progress if enough has been read since the last
+// report, given the output table being built, if any.
+func (cp *compactionProgress) maybeReport(tb *tableBuilder) {
+	if cp.p.BytesRead >= cp.nextReport {
+		cp.nextReport = cp.p.BytesRead + COMPACTION_PROGRESS_INTERVAL
+		cp.report(tb)
+	}
+}
+
+func (cp *compactionProgress) finishTable(t SSTable) {
+	cp.written += int64(t.FileSize)
+	cp.p.TablesWritten++
+	cp.report(nil)
+}
+
+func (cp *compactionProgress) done() {
+	cp.p.Done = true
+	cp.report(nil)
+}
+
+func (cp *compactionProgress) report(tb *tableBuilder) {
+	if cp.fn == nil {
+		return
+	}
+	cp.p.BytesWritten = cp.written
+	if tb != nil {
+		cp.p.BytesWritten += int64(tb.estimatedSize())
+	}
+	cp.p.Elapsed = time.Since(cp.start)
+	cp.fn(cp.p)
+}
+
+func (c *Compaction) tableIDs() map[int]bool {
+	ids := make(map[int]bool)
+	for _, t := range c.Inputs {
+		ids[t.ID] = true
+	}
+	return ids
+}
+
+// LeveledCompaction is similar to the compaction used by LevelDB. Tables
+// in every level except level 0 cover disjoint key ranges, so reads only
+// check one table per level, at the cost of rewriting tables in the next
+// level every time a table is compacted into it.
+//
+// Level 0 is compacted once it reaches L0CompactionTrigger tables, level 1
+// once it exceeds LevelBaseSize bytes, and every level after that is
+// LevelSizeRatio times larger than the last.
+type LeveledCompaction struct {
+	L0CompactionTrigger int
+	LevelBaseSize       int
+	LevelSizeRatio      int
+	MaxTableSize        int
+	MaxLevels           int
+
+	// compactPointers hold the largest key of the last compaction of each
+	// level, so that compactions rotate through the key space.
+	compactPointers map[int]string
+}
+
+func NewLeveledCompaction() *LeveledCompaction {
+	return &LeveledCompaction{
+		L0CompactionTrigger: DEFAULT_L0_COMPACTION_TRIGGER,
+		LevelBaseSize:       DEFAULT_LEVEL_BASE_SIZE,
+		LevelSizeRatio:      DEFAULT_LEVEL_SIZE_RATIO,
+		MaxTableSize:        DEFAULT_MAX_TABLE_SIZE,
+		MaxLevels:           DEFAULT_MAX_LEVELS,
+		compactPointers:     make(map[int]string),
+	}
+}
+
+// Pick gives each level a score, which is the number of tables for level 0
+// and the total size for the other levels, relative to its target. The
+// level with the highest score at or above 1 is compacted.
+func (lc *LeveledCompaction) Pick(levels [][]SSTable) *Compaction {
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < min(len(levels), lc.MaxLevels-1); level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(levels[0])) / float64(lc.L0CompactionTrigger)
+		} else {
+			score = float64(levelSize(levels[level])) / float64(lc.TargetSize(level))
+		}
+
+		if score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+
+	var inputs []SSTable
+	switch bestLevel {
+	case -1:
+		return nil
+	case 0:
+		// All of level 0 is compacted at once, since its tables may overlap.
+		inputs = append([]SSTable{}, levels[0]...)
+	default:
+		// Pick the first table after where the last compaction of this
+		// level ended.
+		tables := levels[bestLevel]
+		input := tables[0]
+		for _, t := range tables {
+			if t.Meta.MinKey > lc.compactPointers[bestLevel] {
+				input = t
+				break
+			}
+		}
+		lc.compactPointers[bestLevel] = input.Meta.MaxKey
+		inputs = []SSTable{input}
+	}
+
+	if bestLevel+1 < len(levels) {
+		minKey, maxKey := keyRange(inputs)
+		inputs = append(inputs, overlappingTables(levels[bestLevel+1], minKey, maxKey)...)
+	}
+	return &Compaction{
+		Inputs:       inputs,
+		OutputLevel:  bestLevel + 1,
+		MaxTableSize: lc.MaxTableSize,
+	}
+}
+
+// TargetSize returns the size in bytes that a level (other than level 0)
+// is compacted at.
+func (lc *LeveledCompaction) TargetSize(level int) int {
+	size := lc.LevelBaseSize
+	for i := 1; i < level; i++ {
+		size *= lc.LevelSizeRatio
+	}
+	return size
+}
+
+// SizeTieredCompaction treats every level as a tier of overlapping tables.
+// Once a tier has MinThreshold tables, they are all merged into a single
+// table in the next tier, so tables in the same tier have similar sizes.
+// Every value is rewritten once per tier, which keeps write amplification
+// low, but reads may have to check every table in a tier.
+//
+// The last tier is merged into itself.
+type SizeTieredCompaction struct {
+	MinThreshold int
+	MaxTiers     int
+}
+
+func NewSizeTieredCompaction() *SizeTieredCompaction {
+	return &SizeTieredCompaction{
+		MinThreshold: DEFAULT_MIN_MERGE_THRESHOLD,
+		MaxTiers:     DEFAULT_MAX_LEVELS,
+	}
+}
+
+func (sc *SizeTieredCompaction) Pick(levels [][]SSTable) *Compaction {
+	for tier := 0; tier < min(len(levels), sc.MaxTiers); tier++ {
+		if len(levels[tier]) < sc.MinThreshold {
+			continue
+		}
+
+		return &Compaction{
+			Inputs:      append([]SSTable{}, levels[tier]...),
+			OutputLevel: min(tier+1, sc.MaxTiers-1),
+		}
+	}
+	return nil
+}
+
+// oldestFirst returns the inputs ordered from oldest to newest.
+func oldestFirst(levels [][]SSTable, c *Compaction) []SSTable {
+	levelOf := make(map[int]int)
+	for level, tables := range levels {
+		for _, t := range tables {
+			levelOf[t.ID] = level
+		}
+	}
+
+	tables := append([]SSTable{}, c.Inputs...)
+	sort.Slice(tables, func(i, j int) bool {
+		li, lj := levelOf[tables[i].ID], levelOf[tables[j].ID]
+		if li != lj {
+			return li > lj
+		}
+		return tables[i].ID < tables[j].ID
+	})
+	return tables
+}
+
+// isBottommost reports whether no table outside the compaction, in or
+// below its shallowest input level, overlaps with its inputs.
+func isBottommost(levels [][]SSTable, c *Compaction) bool {
+	ids := c.tableIDs()
+	minKey, maxKey := keyRange(c.Inputs)
+
+	shallowest := len(levels)
+	for level, tables := range levels {
+		for _, t := range tables {
+			if ids[t.ID] {
+				shallowest = min(shallowest, level)
+			}
+		}
+	}
+
+	for _, tables := range levels[min(shallowest, len(levels)):] {
+		for _, t := range overlappingTables(tables, minKey, maxKey) {
+			if !ids[t.ID] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isDisjoint reports whether the tables, sorted by their smallest key,
+// cover disjoint key ranges.
+func isDisjoint(tables []SSTable) bool {
+	for i := 1; i < len(tables); i++ {
+		if tables[i-1].Meta.MaxKey >= tables[i].Meta.MinKey {
+			return false
+		}
+	}
+	return true
+}
+
+func levelSize(tables []SSTable) int {
+	size := 0
+	for _, t := range tables {
+		size += t.FileSize
+	}
+	return size
+}
+
+func keyRange(tables []SSTable) (string, string) {
+	minKey, maxKey := tables[0].Meta.MinKey, tables[0].Meta.MaxKey
+	for _, t := range tables[1:] {
+		minKey = min(minKey, t.Meta.MinKey)
+		maxKey = max(maxKey, t.Meta.MaxKey)
+	}
+	return minKey, maxKey
+}
+
+func overlappingTables(tables []SSTable, minKey, maxKey string) []SSTable {
+	overlaps := make([]SSTable, 0)
+	for _, t := range tables {
+		if t.Meta.MaxKey >= minKey && t.Meta.MinKey <= maxKey {
+			overlaps = append(overlaps, t)
+		}
+	}
+	return overlaps
+}
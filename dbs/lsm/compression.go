@@ -0,0 +1,258 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compression is the codec used to compress the data blocks of a table.
+// It is recorded in the meta block of every table, so tables written with
+// different codecs can be read together.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	// CompressionSnappy is a fast LZ77 codec using the snappy block format,
+	// see snappyEncode.
+	CompressionSnappy
+	// CompressionFlate is slower than CompressionSnappy, but entropy codes
+	// its output for a better ratio, similar to zstd.
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("Compression(%d)", c)
+	}
+}
+
+func (c Compression) compress(b []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return b, nil
+	case CompressionSnappy:
+		return snappyEncode(b), nil
+	case CompressionFlate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create flate writer: %w", err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return nil, fmt.Errorf("unable to compress block: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("unable to compress block: %w", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+}
+
+func (c Compression) decompress(b []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return b, nil
+	case CompressionSnappy:
+		return snappyDecode(b)
+	case CompressionFlate:
+		r := flate.NewReader(bytes.NewReader(b))
+		defer r.Close()
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress block: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+}
+
+const (
+	SNAPPY_TABLE_BITS = 14
+	SNAPPY_MIN_MATCH  = 4
+	SNAPPY_MAX_OFFSET = 1<<16 - 1
+
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+)
+
+// snappyEncode compresses b in the snappy block format, which is the
+// uncompressed length as a uvarint followed by a series of elements. Each
+// element starts with a tag byte, whose lowest two bits are its type
+//
+//	+------+---------------------------------------------------------------+
+//	| 0b00 | Literal, with its length in the tag or the next 1-4 bytes     |
+//	| 0b01 | Copy of 4-11 bytes, with an 11 bit offset                     |
+//	| 0b10 | Copy of 1-64 bytes, with a 16 bit offset                      |
+//	| 0b11 | Copy of 1-64 bytes, with a 32 bit offset (only decoded)       |
+//	+------+---------------------------------------------------------------+
+//
+// Matches are found with a hash table of the last position of every four
+// bytes, which is fast but doesn't find the longest match.
+func snappyEncode(b []byte) []byte {
+	dst := make([]byte, 0, binary.MaxVarintLen64+len(b)+len(b)/6)
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+
+	// Positions are stored plus one, so that zero means empty.
+	var table [1 << SNAPPY_TABLE_BITS]int32
+	lit := 0
+	for i := 0; i+SNAPPY_MIN_MATCH <= len(b); {
+		cur := binary.LittleEndian.Uint32(b[i:])
+		h := (cur * 0x1e35a7bd) >> (32 - SNAPPY_TABLE_BITS)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand > SNAPPY_MAX_OFFSET || binary.LittleEndian.Uint32(b[cand:]) != cur {
+			i++
+			continue
+		}
+
+		n := SNAPPY_MIN_MATCH
+		for i+n < len(b) && b[cand+n] == b[i+n] {
+			n++
+		}
+		dst = snappyLiteral(dst, b[lit:i])
+		dst = snappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return snappyLiteral(dst, b[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral)
+		dst = binary.LittleEndian.AppendUint32(dst, n)
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends copies of the length at the offset, which is at most
+// SNAPPY_MAX_OFFSET, and a length of at least SNAPPY_MIN_MATCH.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	// Long copies are split so the last one is never below the minimum.
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+
+	if length >= 12 || offset >= 1<<11 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+// snappyDecode decompresses b written in the snappy block format.
+func snappyDecode(b []byte) ([]byte, error) {
+	dLen, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("unable to decode snappy length")
+	}
+	b = b[n:]
+	// No element expands to more than 64 bytes per byte of input, which
+	// bounds the allocation of a corrupted length.
+	if dLen > uint64(len(b))*64 {
+		return nil, fmt.Errorf("unexpected snappy length: %d", dLen)
+	}
+
+	dst := make([]byte, 0, dLen)
+	for len(b) > 0 {
+		tag := b[0]
+		var offset, length int
+
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			length = int(tag >> 2)
+			b = b[1:]
+			if length >= 60 {
+				size := length - 59
+				if len(b) < size {
+					return nil, fmt.Errorf("snappy literal length is truncated")
+				}
+				length = 0
+				for i := size - 1; i >= 0; i-- {
+					length = length<<8 | int(b[i])
+				}
+				b = b[size:]
+			}
+			length++
+			if len(b) < length || uint64(len(dst)+length) > dLen {
+				return nil, fmt.Errorf("unexpected snappy literal length: %d", length)
+			}
+			dst = append(dst, b[:length]...)
+			b = b[length:]
+			continue
+
+		case snappyTagCopy1:
+			if len(b) < 2 {
+				return nil, fmt.Errorf("snappy copy is truncated")
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(b[1])
+			b = b[2:]
+
+		case snappyTagCopy2:
+			if len(b) < 3 {
+				return nil, fmt.Errorf("snappy copy is truncated")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(b[1:]))
+			b = b[3:]
+
+		case snappyTagCopy4:
+			if len(b) < 5 {
+				return nil, fmt.Errorf("snappy copy is truncated")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(b[1:]))
+			b = b[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > dLen {
+			return nil, fmt.Errorf("unexpected snappy copy at offset %d of length %d", offset, length)
+		}
+		// Copies may overlap with the bytes they write, so they are done one
+		// byte at a time.
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != dLen {
+		return nil, fmt.Errorf("unexpected snappy length: got %d, want %d", len(dst), dLen)
+	}
+	return dst, nil
+}
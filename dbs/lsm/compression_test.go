@@ -0,0 +1,52 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 1024*8)
+	r.Read(random)
+
+	var json bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"user_%d","active":true},`, i, i%7)
+	}
+
+	inputs := map[string][]byte{
+		"empty":  {},
+		"short":  []byte("abc"),
+		"random": random,
+		"json":   json.Bytes(),
+		// Runs overlap the bytes they copy, and are longer than a single copy.
+		"run": bytes.Repeat([]byte{'a'}, 1024*100),
+	}
+
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionFlate} {
+		for name, in := range inputs {
+			compressed, err := c.compress(in)
+			assert.Nil(t, err)
+			out, err := c.decompress(compressed)
+			assert.Nil(t, err, "%s: %s", c, name)
+			assert.Equal(t, len(in), len(out), "%s: %s", c, name)
+			assert.True(t, bytes.Equal(in, out), "%s: %s", c, name)
+
+			if c != CompressionNone && name == "json" {
+				assert.Less(t, len(compressed), len(in)/4, "%s: %s", c, name)
+			}
+		}
+	}
+
+	// Corrupted input is rejected rather than decoded.
+	compressed := snappyEncode(json.Bytes())
+	_, err := snappyDecode(compressed[:len(compressed)/2])
+	assert.NotNil(t, err)
+	_, err = snappyDecode([]byte{0x10, 0x0d, 0x20})
+	assert.NotNil(t, err)
+}
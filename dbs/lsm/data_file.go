@@ -2,26 +2,140 @@ package lsm
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
+// RecordKind distinguishes values from deletions (tombstones), which
+// must be kept until no older value of their key can exist, and from
+// merge operands, which are applied to the older value, see Merge.
+type RecordKind uint8
+
+const (
+	KindValue RecordKind = iota
+	KindDelete
+	KindMerge
+)
+
+// Records of legacy tables were written in one of the following formats,
+// none of which was recorded in the table. It is found by
+// detectRecordFormat when the table is opened, and kept as the
+// RecordFormat of its Meta.
+const (
+	// RECORD_FORMAT_BASE has no kind or sequence number, and an empty
+	// value is a deletion.
+	RECORD_FORMAT_BASE = 1
+	// RECORD_FORMAT_KIND adds the kind.
+	RECORD_FORMAT_KIND = 2
+	// RECORD_FORMAT_SEQ adds the sequence number after the kind.
+	RECORD_FORMAT_SEQ = 3
+)
+
+// recordHeaderSize returns the size of the header of a record, which
+// precedes its key and value.
+func recordHeaderSize(format int) int {
+	switch format {
+	case RECORD_FORMAT_BASE:
+		return 16
+	case RECORD_FORMAT_KIND:
+		return 17
+	default:
+		return 25
+	}
+}
+
+// KIND_EXPIRES is set in the kind byte of an encoded entry which is
+// followed by its expiry time, see appendKind.
+const KIND_EXPIRES = 0x80
+
+// KIND_COLUMN_FAMILY precedes the kind byte of a write in a WriteBatch
+// to a column family other than the default, see WriteBatch.encode.
+const KIND_COLUMN_FAMILY = 0x40
+
+// Entry is a single version of a key. Every write is given a sequence
+// number one higher than the last, so newer versions have higher ones.
+type Entry struct {
+	Value []byte
+	Kind  RecordKind
+	Seq   uint64
+	// ExpiresAt is the time in Unix nanoseconds a value expires at, or 0
+	// if it never does. An expired value hides older versions of its key
+	// the same as a tombstone.
+	ExpiresAt int64
+}
+
+// expired reports whether the entry is a value which has expired by now.
+func (e Entry) expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now.UnixNano()
+}
+
+// absent reports whether the entry hides its key, because it is either a
+// tombstone or has expired.
+func (e Entry) absent(now time.Time) bool {
+	return e.Kind == KindDelete || e.expired(now)
+}
+
+// appendKind appends the kind of the entry, and if it expires, sets
+// KIND_EXPIRES and appends the expiry time as a uvarint.
+func appendKind(b []byte, e Entry) []byte {
+	if e.ExpiresAt == 0 {
+		return append(b, byte(e.Kind))
+	}
+	b = append(b, byte(e.Kind)|KIND_EXPIRES)
+	return binary.AppendUvarint(b, uint64(e.ExpiresAt))
+}
+
+// readKind reads the kind and expiry time written by appendKind, and
+// returns the remaining bytes.
+func readKind(b []byte) (RecordKind, int64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, nil, fmt.Errorf("unable to decode kind")
+	}
+	kind := RecordKind(b[0] &^ KIND_EXPIRES)
+	if kind > KindMerge {
+		return 0, 0, nil, fmt.Errorf("unexpected record kind: %d", kind)
+	}
+	if b[0]&KIND_EXPIRES == 0 {
+		return kind, 0, b[1:], nil
+	}
+
+	expiresAt, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("unable to decode expiry time")
+	}
+	return kind, int64(expiresAt), b[1+n:], nil
+}
+
 type keyValue struct {
-	key   []byte
-	value []byte
+	key []byte
+	Entry
 }
 
 type bufferedWriter struct {
 	*bufio.Writer
 }
 
-func (bw *bufferedWriter) writeKeyVal(key string, val []byte) (int, error) {
-	lb := make([]byte, 16)
+// writeKeyVal writes a record of a legacy table in RECORD_FORMAT_SEQ, which
+// has the following binary format
+//
+//	+-----------+-----------+------------------+------------------+-----+-------+
+//	| Kind (u8) | Seq (u64) | Key length (8 B) | Val length (8 B) | Key | Value |
+//	+-----------+-----------+------------------+------------------+-----+-------+
+//
+// where both lengths are varints padded to 8 bytes. RECORD_FORMAT_KIND
+// has no Seq, and RECORD_FORMAT_BASE has neither Kind nor Seq.
+func (bw *bufferedWriter) writeKeyVal(key string, e Entry) (int, error) {
+	lb := make([]byte, recordHeaderSize(RECORD_FORMAT_SEQ))
 	keyb := []byte(key)
+	val := e.Value
 
-	binary.PutVarint(lb[:8], int64(len(keyb)))
-	binary.PutVarint(lb[8:], int64(len(val)))
+	lb[0] = byte(e.Kind)
+	binary.LittleEndian.PutUint64(lb[1:9], e.Seq)
+	binary.PutVarint(lb[9:17], int64(len(keyb)))
+	binary.PutVarint(lb[17:], int64(len(val)))
 
 	bytesWritten := 0
 	n, err := bw.Write(lb)
@@ -58,14 +172,29 @@ func readChunkWithBuffer(file io.ReaderAt, offset int, b []byte) ([]byte, error)
 	return b, nil
 }
 
-func readKeyVal(reader io.Reader) (keyValue, int, error) {
-	lb := make([]byte, 16)
-	_, err := reader.Read(lb)
+// readKeyVal reads a record written in the given format. Records without
+// a sequence number have a Seq of 0.
+func readKeyVal(reader io.Reader, format int) (keyValue, int, error) {
+	lb := make([]byte, recordHeaderSize(format))
+	_, err := io.ReadFull(reader, lb)
 	if err != nil {
 		return keyValue{}, 0, fmt.Errorf("unable to read length: %w", err)
 	}
 
-	l1, n1 := binary.Varint(lb[:8])
+	kind := KindValue
+	var seq uint64
+	lengths := lb
+	switch format {
+	case RECORD_FORMAT_KIND:
+		kind, lengths = RecordKind(lb[0]), lb[1:]
+	case RECORD_FORMAT_SEQ:
+		kind, seq, lengths = RecordKind(lb[0]), binary.LittleEndian.Uint64(lb[1:9]), lb[9:]
+	}
+	if kind != KindValue && kind != KindDelete {
+		return keyValue{}, 0, fmt.Errorf("unexpected record kind: %d", kind)
+	}
+
+	l1, n1 := binary.Varint(lengths[:8])
 	if n1 <= 0 {
 		return keyValue{}, 0, fmt.Errorf("unable to decode length of binary")
 	}
@@ -73,7 +202,7 @@ func readKeyVal(reader io.Reader) (keyValue, int, error) {
 		return keyValue{}, 0, fmt.Errorf("unexpectedly got negative length: %d", l1)
 	}
 
-	l2, n2 := binary.Varint(lb[8:])
+	l2, n2 := binary.Varint(lengths[8:])
 	if n2 <= 0 {
 		return keyValue{}, 0, fmt.Errorf("unable to decode length of binary")
 	}
@@ -82,13 +211,39 @@ func readKeyVal(reader io.Reader) (keyValue, int, error) {
 	}
 
 	b := make([]byte, l1+l2)
-	_, err = reader.Read(b)
+	_, err = io.ReadFull(reader, b)
 	if err != nil {
 		return keyValue{}, 0, fmt.Errorf("unable to read value: %w", err)
 	}
 
+	if format == RECORD_FORMAT_BASE && l2 == 0 {
+		kind = KindDelete
+	}
 	return keyValue{
-		key:   b[:l1],
-		value: b[l1:],
+		key: b[:l1],
+		Entry: Entry{
+			Value: b[l1:],
+			Kind:  kind,
+			Seq:   seq,
+		},
 	}, int(l1 + l2), nil
 }
+
+// detectRecordFormat returns the format of the records of a legacy table
+// which didn't record it, by decoding its first chunk in every format.
+// Only the right format decodes the whole chunk, starting with the first
+// key of the index.
+func detectRecordFormat(chunk []byte, firstKey string) (int, error) {
+	for _, format := range []int{RECORD_FORMAT_SEQ, RECORD_FORMAT_KIND, RECORD_FORMAT_BASE} {
+		buf := bytes.NewBuffer(chunk)
+		ok := true
+		for i := 0; ok && buf.Len() > 0; i++ {
+			kvp, _, err := readKeyVal(buf, format)
+			ok = err == nil && (i > 0 || string(kvp.key) == firstKey)
+		}
+		if ok {
+			return format, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to detect record format")
+}
@@ -0,0 +1,395 @@
+package lsm
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"time"
+)
+
+// IteratorOptions restricts the keys returned by an Iterator.
+type IteratorOptions struct {
+	// Start is the first key (inclusive), and End is the last key
+	// (exclusive). An empty End means there is no upper bound.
+	Start string
+	End   string
+	// Prefix only returns keys with the given prefix.
+	Prefix string
+	// Reverse returns keys in descending order.
+	Reverse bool
+}
+
+// Iterator iterates over a consistent view of the keys in the LSMTree,
+// which is taken every time iteration starts, unless the iterator was
+// created from a Snapshot.
+type Iterator struct {
+	lt       *LSMTree
+	cf       *ColumnFamily
+	opts     IteratorOptions
+	snapshot *Snapshot
+	err      error
+
+	// filterPrefix is the prefix of every key the iterator can return, if
+	// it has one, which is checked against the prefix filter of tables.
+	filterPrefix string
+	filtered     bool
+}
+
+// NewIterator returns an iterator over every key matching the options.
+func (lt *LSMTree) NewIterator(opts IteratorOptions) *Iterator {
+	return lt.newIterator(lt.defaultFamily, opts)
+}
+
+func (lt *LSMTree) newIterator(cf *ColumnFamily, opts IteratorOptions) *Iterator {
+	if opts.Prefix != "" {
+		opts.Start = max(opts.Start, opts.Prefix)
+		if end, ok := prefixEnd(opts.Prefix); ok && (opts.End == "" || end < opts.End) {
+			opts.End = end
+		}
+	}
+	it := &Iterator{lt: lt, cf: cf, opts: opts}
+	if pe := lt.stm.prefixExtractor; pe != nil && opts.Prefix != "" {
+		it.filterPrefix, it.filtered = pe.Prefix(opts.Prefix)
+	}
+	return it
+}
+
+// Scan returns every key-value pair with a key in [start, end) in
+// ascending order. Iteration stops early on any error, use NewIterator
+// to check for one.
+func (lt *LSMTree) Scan(start, end string) iter.Seq2[string, []byte] {
+	return lt.NewIterator(IteratorOptions{Start: start, End: end}).All()
+}
+
+// Err returns the error that stopped the last iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// All merges every memtable and SSTable, and yields the newest visible
+// value of each key, skipping deleted keys.
+func (it *Iterator) All() iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		it.err = nil
+
+		// Sources are ordered from newest to oldest, and each yields the
+		// versions of a key from newest to oldest.
+		sources, seq, err := it.memtableSources()
+		if err != nil {
+			it.err = err
+			return
+		}
+		now := time.Now()
+		levels, disjoint := it.lt.stm.refTables(it.cf.id)
+		defer unrefTables(levels)
+
+		for i, level := range levels {
+			if i > 0 && disjoint[i] {
+				sources = append(sources, it.levelSource(level))
+				continue
+			}
+
+			// Overlapping tables are searched from newest to oldest, which
+			// for level 0 is the reverse of the order they were flushed in.
+			tables := append([]SSTable{}, level...)
+			slices.SortFunc(tables, func(a, b SSTable) int {
+				return b.ID - a.ID
+			})
+			for _, t := range tables {
+				if it.overlaps(t) {
+					sources = append(sources, it.tableSource(t))
+				}
+			}
+		}
+
+		h := &iterHeap{reverse: it.opts.Reverse}
+		for i, src := range sources {
+			next, stop := iter.Pull2(src)
+			defer stop()
+
+			if k, v, ok := next(); ok {
+				h.cursors = append(h.cursors, iterCursor{key: k, kvp: v, source: i, next: next})
+			}
+			if it.err != nil {
+				return
+			}
+		}
+		heap.Init(h)
+
+		// yieldMerged resolves the merge operands of a key, and skips the
+		// key if it has no value.
+		yieldMerged := func(key string, base Entry, found bool, operands [][]byte) bool {
+			val, err := it.lt.stm.resolve(key, base, found, operands, now)
+			if errors.Is(err, ErrNotFound) {
+				return true
+			}
+			if err != nil {
+				it.err = err
+				return false
+			}
+			return yield(key, val)
+		}
+
+		var prevKey string
+		first := true
+		// operands holds the versions of the current key from newest to
+		// oldest while every one so far is a merge operand.
+		var operands [][]byte
+		merging := false
+
+		for h.Len() > 0 {
+			cur := h.cursors[0]
+			if k, v, ok := cur.next(); ok {
+				h.cursors[0].key, h.cursors[0].kvp = k, v
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+			// A source that failed may hide versions in older sources,
+			// which must not be yielded in their place.
+			if it.err != nil {
+				return
+			}
+			if cur.kvp.Seq > seq {
+				continue
+			}
+
+			// Only the first (newest) visible version of each key is
+			// considered, along with older versions it is a merge operand of.
+			if !first && cur.key == prevKey {
+				if !merging {
+					continue
+				}
+				if cur.kvp.Kind == KindMerge {
+					operands = append(operands, cur.kvp.Value)
+					continue
+				}
+				merging = false
+				if !yieldMerged(cur.key, cur.kvp.Entry, true, operands) {
+					return
+				}
+				continue
+			}
+			if merging {
+				merging = false
+				if !yieldMerged(prevKey, Entry{}, false, operands) {
+					return
+				}
+			}
+			prevKey = cur.key
+			first = false
+
+			if cur.kvp.Kind == KindMerge {
+				merging = true
+				operands = [][]byte{cur.kvp.Value}
+				continue
+			}
+			if cur.kvp.absent(now) {
+				continue
+			}
+			if !yield(cur.key, cur.kvp.Value) {
+				return
+			}
+		}
+		if merging && it.err == nil {
+			yieldMerged(prevKey, Entry{}, false, operands)
+		}
+	}
+}
+
+// memtableSources copies the visible entries of every memtable of the
+// column family, since the active memtable can be modified while
+// iterating. It also returns the sequence number of the view.
+func (it *Iterator) memtableSources() ([]iter.Seq2[string, keyValue], uint64, error) {
+	it.lt.mu.RLock()
+	defer it.lt.mu.RUnlock()
+
+	if it.cf.dropped {
+		return nil, 0, ErrColumnFamilyDropped
+	}
+
+	seq := it.lt.visible.Load()
+	if it.snapshot != nil {
+		seq = it.snapshot.seq
+	}
+
+	sources := make([]iter.Seq2[string, keyValue], 0, len(it.cf.tables))
+	for i := len(it.cf.tables) - 1; i >= 0; i-- {
+		kvps := make([]keyValue, 0)
+		it.cf.tables[i].Traverse(func(k string, e Entry) {
+			if it.inRange(k) && e.Seq <= seq {
+				kvps = append(kvps, keyValue{key: []byte(k), Entry: e})
+			}
+		})
+		if it.opts.Reverse {
+			reverseKeys(kvps)
+		}
+
+		sources = append(sources, func(yield func(string, keyValue) bool) {
+			for _, kvp := range kvps {
+				if !yield(string(kvp.key), kvp) {
+					return
+				}
+			}
+		})
+	}
+	return sources, seq, nil
+}
+
+// levelSource chains together tables which cover disjoint key ranges.
+func (it *Iterator) levelSource(level []SSTable) iter.Seq2[string, keyValue] {
+	tables := append([]SSTable{}, level...)
+	if it.opts.Reverse {
+		slices.Reverse(tables)
+	}
+
+	return func(yield func(string, keyValue) bool) {
+		for _, t := range tables {
+			if !it.overlaps(t) {
+				continue
+			}
+			for k, v := range it.tableSource(t) {
+				if !yield(k, v) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// tableSource reads a table one chunk at a time, where each chunk is the
+// range of records between two entries of its sparse index.
+func (it *Iterator) tableSource(ss SSTable) iter.Seq2[string, keyValue] {
+	return func(yield func(string, keyValue) bool) {
+		// Skip chunks that start after the range, or end before it.
+		idx := ss.Index.Index
+		first := sort.Search(len(idx), func(i int) bool {
+			return idx[i].Key > it.opts.Start
+		}) - 1
+		last := len(idx) - 1
+		if it.opts.End != "" {
+			last = sort.Search(len(idx), func(i int) bool {
+				return idx[i].Key >= it.opts.End
+			}) - 1
+		}
+		first = max(first, 0)
+
+		for i := range last - first + 1 {
+			chunkIdx := first + i
+			if it.opts.Reverse {
+				chunkIdx = last - i
+			}
+
+			kvps, err := it.lt.stm.loadChunk(ss, chunkIdx)
+			if err != nil {
+				it.err = fmt.Errorf("unable to read table %d: %w", ss.ID, err)
+				return
+			}
+			if it.opts.Reverse {
+				reverseKeys(kvps)
+			}
+
+			for _, kvp := range kvps {
+				k := string(kvp.key)
+				if it.inRange(k) && !yield(k, kvp) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (it *Iterator) inRange(key string) bool {
+	return key >= it.opts.Start && (it.opts.End == "" || key < it.opts.End)
+}
+
+// overlaps reports whether the table may have keys matching the options,
+// using its key range and prefix filter.
+func (it *Iterator) overlaps(ss SSTable) bool {
+	if ss.Meta.MaxKey < it.opts.Start || it.opts.End != "" && ss.Meta.MinKey >= it.opts.End {
+		return false
+	}
+	if !it.filtered || ss.PrefixFilter == nil || ss.Meta.PrefixExtractor != it.lt.stm.prefixExtractor.Name() {
+		return true
+	}
+	return ss.PrefixFilter.In([]byte(it.filterPrefix))
+}
+
+// reverseKeys reverses the order of keys, while keeping the versions of
+// each key ordered from newest to oldest.
+func reverseKeys(kvps []keyValue) {
+	slices.Reverse(kvps)
+	for i := 0; i < len(kvps); {
+		j := i + 1
+		for j < len(kvps) && bytes.Equal(kvps[i].key, kvps[j].key) {
+			j++
+		}
+		slices.Reverse(kvps[i:j])
+		i = j
+	}
+}
+
+// prefixEnd returns the smallest key greater than every key with the
+// prefix, or false if there is none.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+type iterCursor struct {
+	key    string
+	kvp    keyValue
+	source int
+	next   func() (string, keyValue, bool)
+}
+
+// iterHeap orders cursors by key, then from newest to oldest by sequence
+// number, and then by source so that the newest source is popped first.
+type iterHeap struct {
+	cursors []iterCursor
+	reverse bool
+}
+
+func (h *iterHeap) Len() int {
+	return len(h.cursors)
+}
+
+func (h *iterHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	if a.key == b.key {
+		if a.kvp.Seq != b.kvp.Seq {
+			return a.kvp.Seq > b.kvp.Seq
+		}
+		return a.source < b.source
+	}
+	if h.reverse {
+		return a.key > b.key
+	}
+	return a.key < b.key
+}
+
+func (h *iterHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+}
+
+func (h *iterHeap) Push(x any) {
+	h.cursors = append(h.cursors, x.(iterCursor))
+}
+
+func (h *iterHeap) Pop() any {
+	old := h.cursors
+	n := len(old)
+	x := old[n-1]
+	h.cursors = old[0 : n-1]
+	return x
+}
@@ -1,17 +1,79 @@
 package lsm
 
-import "io"
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
 
-type ReaderLengther interface {
-	io.Reader
-	Len() int
-}
+// COMPACTION_READAHEAD is the size of the buffer each input table of a
+// compaction is read through.
+const COMPACTION_READAHEAD = 1024 * 256 // 256 KB
 
 type KeyFile struct {
 	Key     string
-	Value   []byte
+	Entry   Entry
 	FileIdx int
-	Reader  ReaderLengther
+	Cursor  *tableCursor
+}
+
+// tableCursor reads every record of a table in order, one chunk at a time.
+// The table is read sequentially through a buffer of COMPACTION_READAHEAD
+// bytes, so only the buffer and the current chunk are held in memory.
+type tableCursor struct {
+	table    SSTable
+	chunk    int
+	kvps     []keyValue
+	reader   *bufio.Reader
+	offset   int
+	progress *compactionProgress
+}
+
+func newTableCursor(table SSTable, progress *compactionProgress) *tableCursor {
+	section := io.NewSectionReader(table.DataFile, 0, int64(table.DataSize))
+	return &tableCursor{
+		table:    table,
+		reader:   bufio.NewReaderSize(section, COMPACTION_READAHEAD),
+		progress: progress,
+	}
+}
+
+func (tc *tableCursor) next() (keyValue, bool, error) {
+	for len(tc.kvps) == 0 {
+		if tc.chunk >= len(tc.table.Index.Index) {
+			return keyValue{}, false, nil
+		}
+		kvps, err := tc.readChunk(tc.chunk)
+		if err != nil {
+			return keyValue{}, false, err
+		}
+		tc.kvps = kvps
+		tc.chunk++
+	}
+
+	kvp := tc.kvps[0]
+	tc.kvps = tc.kvps[1:]
+	return kvp, true, nil
+}
+
+// readChunk reads and decodes the next chunk, skipping any gap before it.
+func (tc *tableCursor) readChunk(i int) ([]keyValue, error) {
+	start, end := tc.table.chunkBounds(i)
+	if _, err := tc.reader.Discard(start - tc.offset); err != nil {
+		return nil, fmt.Errorf("unable to read chunk: %w", err)
+	}
+	b := make([]byte, end-start)
+	if _, err := io.ReadFull(tc.reader, b); err != nil {
+		return nil, fmt.Errorf("unable to read chunk: %w", err)
+	}
+	tc.offset = end
+	tc.progress.read(end - start)
+
+	chunk, err := tc.table.checkChunk(i, b)
+	if err != nil {
+		return nil, err
+	}
+	return tc.table.decodeChunk(i, chunk)
 }
 
 type KeyFileHeap []KeyFile
@@ -20,11 +82,16 @@ func (h KeyFileHeap) Len() int {
 	return len(h)
 }
 
+// Less orders by key, and then from newest to oldest by sequence number.
+// If both are tied, the newest file is popped first.
 func (h KeyFileHeap) Less(i, j int) bool {
-	if h[i].Key == h[j].Key {
-		return h[i].FileIdx < h[j].FileIdx
+	if h[i].Key != h[j].Key {
+		return h[i].Key < h[j].Key
+	}
+	if h[i].Entry.Seq != h[j].Entry.Seq {
+		return h[i].Entry.Seq > h[j].Entry.Seq
 	}
-	return h[i].Key < h[j].Key
+	return h[i].FileIdx > h[j].FileIdx
 }
 
 func (h KeyFileHeap) Swap(i, j int) {
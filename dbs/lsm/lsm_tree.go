@@ -1,9 +1,12 @@
 package lsm
 
 import (
+	"crumbs/cache/lru"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/slog"
@@ -14,58 +17,129 @@ const (
 	DEFAULT_MAX_MEM_TABLES     = 4
 	DEFAULT_MAX_FLUSHED_TABLES = 16
 	DEFAULT_SPARSENESS         = 16
+	DEFAULT_BLOCK_SIZE         = 1024 * 4 // 4 KB
+	DEFAULT_COMPRESSION        = CompressionSnappy
+	DEFAULT_BLOCK_CACHE_SIZE   = 1024 * 1024 * 8 // 8 MB
+	DEFAULT_MAX_COMPACTIONS    = 1
+	DEFAULT_L0_SLOWDOWN        = 20
+	DEFAULT_L0_STOP            = 36
 	DEFAULT_ERROR_PCT          = 0.01
 	DEFAULT_FLUSH_PERIOD       = 15 * time.Second
+	DEFAULT_WAL_SYNC_PERIOD    = 1 * time.Second
+
+	DEFAULT_MAX_LEVELS            = 7
+	DEFAULT_MAX_TABLE_SIZE        = 1024 * 1024 * 8   // 8 MB
+	DEFAULT_LEVEL_BASE_SIZE       = 1024 * 1024 * 256 // 256 MB
+	DEFAULT_LEVEL_SIZE_RATIO      = 10
+	DEFAULT_L0_COMPACTION_TRIGGER = 4
+	DEFAULT_MIN_MERGE_THRESHOLD   = 4
 )
 
 // TODO:
-// - better compaction schemes
-// - add a WAL
 // - update README.md
 
+// ErrNotFound is returned by Get when a key has never been written, or
+// has been deleted.
+var ErrNotFound = errors.New("key not found")
+
+// ErrClosed is returned by writes that were stalled when the LSMTree was
+// closed.
+var ErrClosed = errors.New("lsm tree is closed")
+
 type LSMTree struct {
 	mu     sync.RWMutex
 	logger *slog.Logger
 
-	tables []Memtable
-	stm    *SSTManager
+	// Every column family has a memtable for each WAL segment, see WAL,
+	// and segs holds the ID of the segment of each, oldest first.
+	families      map[int]*ColumnFamily
+	segs          []int
+	defaultFamily *ColumnFamily
+	stm           *SSTManager
+	wal           *WAL
+
+	// writeMu orders writes, and guards seq, the sequence number of the
+	// last write appended to the WAL.
+	writeMu sync.Mutex
+	seq     uint64
+	// visible is the sequence number of the last write readers can see.
+	// Every write at or below it has been inserted into a memtable.
+	visible     atomic.Uint64
+	publishMu   sync.Mutex
+	publishCond *sync.Cond
+
+	newMemtable       func() Memtable
+	concurrentInserts bool
+
+	// flushMu is held by a flush from picking its memtables until they
+	// are released, so flushes never pick the same memtables.
+	flushMu sync.Mutex
 
 	memTableSize  int
 	maxMemTables  int
 	flushPeriod   time.Duration
 	flusherCloser chan struct{}
+	walSyncMode   SyncMode
+	walSyncPeriod time.Duration
+	// leveledOptions modify the LeveledCompaction once every other option
+	// has been applied.
+	leveledOptions []func(*LeveledCompaction)
 }
 
+// Memtable holds every version of the keys written to it, see AATree and
+// SkipList.
 type Memtable interface {
-	Find(key string) ([]byte, bool)
-	Insert(key string, val []byte)
-	Traverse(f func(k string, v []byte))
+	Find(key string, seq uint64) (Entry, bool)
+	Insert(key string, e Entry)
+	Traverse(f func(k string, e Entry))
 	Size() int
 	Nodes() int
 }
 
+// ConcurrentMemtable is a Memtable whose Insert can be called concurrently
+// with other inserts and reads. Writes to it only hold the read lock of
+// the LSMTree, rather than the write lock.
+type ConcurrentMemtable interface {
+	Memtable
+	ConcurrentInserts() bool
+}
+
 func NewLSMTree(dir string, options ...LSMOption) (*LSMTree, error) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 
 	lt := &LSMTree{
-		tables: []Memtable{NewAATree()},
+		families: make(map[int]*ColumnFamily),
 		stm: NewSSTManager(
 			dir,
 			logger,
 			SSTMOptions{
-				sparseness: DEFAULT_SPARSENESS,
-				errorPct:   DEFAULT_ERROR_PCT,
+				sparseness:        DEFAULT_SPARSENESS,
+				blockSize:         DEFAULT_BLOCK_SIZE,
+				compression:       DEFAULT_COMPRESSION,
+				blockCacheSize:    DEFAULT_BLOCK_CACHE_SIZE,
+				errorPct:          DEFAULT_ERROR_PCT,
+				strategy:          NewLeveledCompaction(),
+				maxCompactions:    DEFAULT_MAX_COMPACTIONS,
+				l0SlowdownTrigger: DEFAULT_L0_SLOWDOWN,
+				l0StopTrigger:     DEFAULT_L0_STOP,
 			},
 		),
 		memTableSize:  DEFAULT_MEM_TABLE_SIZE,
 		maxMemTables:  DEFAULT_MAX_MEM_TABLES,
 		flushPeriod:   DEFAULT_FLUSH_PERIOD,
 		flusherCloser: make(chan struct{}),
+		walSyncMode:   SyncPeriodic,
+		walSyncPeriod: DEFAULT_WAL_SYNC_PERIOD,
 		logger:        logger,
+		newMemtable:   func() Memtable { return NewAATree() },
 	}
+	lt.publishCond = sync.NewCond(&lt.publishMu)
 	for _, opt := range options {
 		lt = opt(lt)
 	}
+	if err := lt.applyLeveledOptions(); err != nil {
+		return nil, err
+	}
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("unable to initialize directory: %w", err)
@@ -73,63 +147,344 @@ func NewLSMTree(dir string, options ...LSMOption) (*LSMTree, error) {
 	if err := lt.stm.Load(); err != nil {
 		return nil, fmt.Errorf("unable to load SSTables from disk: %w", err)
 	}
+	lt.seq = lt.stm.MaxSeq()
+
+	lt.defaultFamily = lt.addFamily(DEFAULT_COLUMN_FAMILY_ID, DEFAULT_COLUMN_FAMILY)
+	for id, name := range lt.stm.Families() {
+		lt.addFamily(id, name)
+	}
+
+	lt.wal = NewWAL(dir, logger, WALOptions{
+		syncMode:   lt.walSyncMode,
+		syncPeriod: lt.walSyncPeriod,
+	})
+	if err := lt.replayWAL(); err != nil {
+		return nil, fmt.Errorf("unable to replay WAL: %w", err)
+	}
+	if err := lt.wal.Open(); err != nil {
+		return nil, fmt.Errorf("unable to open WAL: %w", err)
+	}
+	lt.visible.Store(lt.seq)
+
+	if cm, ok := lt.newMemtable().(ConcurrentMemtable); ok {
+		lt.concurrentInserts = cm.ConcurrentInserts()
+	}
+	lt.addMemtables(lt.wal.Segment())
 
 	go lt.flushPeriodically()
+	go lt.stm.compactInBackground()
 	return lt, nil
 }
 
-func (lt *LSMTree) Put(key string, val []byte) {
-	lt.mu.Lock()
-	defer lt.mu.Unlock()
+// applyLeveledOptions applies the options of the LeveledCompaction, which
+// are an error with any other strategy.
+func (lt *LSMTree) applyLeveledOptions() error {
+	if len(lt.leveledOptions) == 0 {
+		return nil
+	}
+	lc, ok := lt.stm.strategy.(*LeveledCompaction)
+	if !ok {
+		return fmt.Errorf("leveled compaction options can't be used with %T", lt.stm.strategy)
+	}
+	for _, f := range lt.leveledOptions {
+		f(lc)
+	}
+	return nil
+}
 
-	curTable := lt.tables[len(lt.tables)-1]
-	curTable.Insert(key, val)
+// Put stores a value, which may be empty, for the key.
+func (lt *LSMTree) Put(key string, val []byte) error {
+	wb := NewWriteBatch()
+	wb.Put(key, val)
+	return lt.Write(wb)
+}
 
-	if curTable.Size() > lt.memTableSize {
-		curTable = NewAATree()
-		lt.tables = append(lt.tables, curTable)
-	}
+// PutWithTTL stores a value for the key which expires after the TTL.
+// Once it has expired, the key is treated as deleted by Get and
+// iterators, and the value is dropped by compaction.
+func (lt *LSMTree) PutWithTTL(key string, val []byte, ttl time.Duration) error {
+	wb := NewWriteBatch()
+	wb.PutWithTTL(key, val, ttl)
+	return lt.Write(wb)
 }
 
+// Get returns the value of the key, or ErrNotFound if the key doesn't
+// exist or has been deleted.
 func (lt *LSMTree) Get(key string) ([]byte, error) {
+	return lt.get(lt.defaultFamily, key, lt.visible.Load())
+}
+
+// Delete writes a tombstone for the key, which hides any older values
+// until it is dropped by compaction.
+func (lt *LSMTree) Delete(key string) error {
+	wb := NewWriteBatch()
+	wb.Delete(key)
+	return lt.Write(wb)
+}
+
+// get returns the newest value of the key in the column family with a
+// sequence number at or below seq. Merge operands are collected until
+// the version they apply to is found, and then resolved.
+func (lt *LSMTree) get(cf *ColumnFamily, key string, seq uint64) ([]byte, error) {
+	now := time.Now()
+	var operands [][]byte
+	for {
+		e, found, err := lt.find(cf, key, seq)
+		if err != nil {
+			return nil, err
+		}
+		if !found || e.Kind != KindMerge {
+			return lt.stm.resolve(key, e, found, operands, now)
+		}
+		operands = append(operands, e.Value)
+		if e.Seq == 0 {
+			return lt.stm.resolve(key, Entry{}, false, operands, now)
+		}
+		seq = e.Seq - 1
+	}
+}
+
+// find returns the newest version of the key in the column family with a
+// sequence number at or below seq, if there is one.
+func (lt *LSMTree) find(cf *ColumnFamily, key string, seq uint64) (Entry, bool, error) {
 	// Search tables in reverse chronological order.
 	lt.mu.RLock()
-	for i := len(lt.tables) - 1; i >= 0; i-- {
-		v, found := lt.tables[i].Find(key)
+	if cf.dropped {
+		lt.mu.RUnlock()
+		return Entry{}, false, ErrColumnFamilyDropped
+	}
+	for i := len(cf.tables) - 1; i >= 0; i-- {
+		e, found := cf.tables[i].Find(key, seq)
 		if found {
 			lt.mu.RUnlock()
-			return v, nil
+			return e, true, nil
 		}
 	}
 	lt.mu.RUnlock()
 
-	return lt.stm.Find(key)
+	return lt.stm.Find(cf.id, key, seq)
+}
+
+// Write applies every write in the batch atomically. The batch is written
+// as a single WAL record and to a single memtable, so it is either fully
+// recovered after a crash or not at all.
+//
+// Writes are appended to the WAL in order, but if the memtable allows
+// concurrent inserts they are inserted concurrently. Readers only see a
+// write once it and every write before it has been inserted, see publish.
+//
+// Writes are slowed down or stopped while level 0 has too many tables,
+// see WithWriteStallTriggers.
+func (lt *LSMTree) Write(wb *WriteBatch) error {
+	if wb.Len() == 0 {
+		return nil
+	}
+	if err := lt.stm.throttleWrites(); err != nil {
+		return err
+	}
+
+	// The memtables can't be rotated while they are held, so every write
+	// appended to a WAL segment is inserted into its memtable.
+	lock, unlock := lt.mu.Lock, lt.mu.Unlock
+	if lt.concurrentInserts {
+		lock, unlock = lt.mu.RLock, lt.mu.RUnlock
+	}
+	lock()
+
+	tables := make([]Memtable, wb.Len())
+	for i, id := range wb.families {
+		cf, ok := lt.families[id]
+		if !ok {
+			unlock()
+			return ErrColumnFamilyDropped
+		}
+		if wb.entries[i].Kind == KindMerge && lt.stm.mergeOperator == nil {
+			unlock()
+			return ErrNoMergeOperator
+		}
+		tables[i] = cf.tables[len(cf.tables)-1]
+	}
+
+	lt.writeMu.Lock()
+	first := lt.seq + 1
+	record := wb.encode(first)
+	lsn, err := lt.wal.Append(record)
+	if err != nil {
+		lt.writeMu.Unlock()
+		unlock()
+		return fmt.Errorf("unable to append to WAL: %w", err)
+	}
+	lt.seq += uint64(wb.Len())
+	last := lt.seq
+	lt.writeMu.Unlock()
+
+	var full Memtable
+	ingested := 0
+	for i, key := range wb.keys {
+		e := wb.entries[i]
+		e.Seq = first + uint64(i)
+		tables[i].Insert(key, e)
+		if tables[i].Size() > lt.memTableSize {
+			full = tables[i]
+		}
+		ingested += len(key) + len(e.Value)
+	}
+	unlock()
+	lt.stm.stats.walBytes.Add(int64(len(record)))
+	lt.stm.stats.bytesIngested.Add(int64(ingested))
+
+	lt.publish(first, last)
+	if full != nil {
+		if err := lt.rotate(full); err != nil {
+			return err
+		}
+	}
+	return lt.wal.WaitDurable(lsn)
+}
+
+// publish makes the writes from first to last visible, once every write
+// before them is, so that readers never see a gap.
+func (lt *LSMTree) publish(first, last uint64) {
+	lt.publishMu.Lock()
+	defer lt.publishMu.Unlock()
+
+	for lt.visible.Load() != first-1 {
+		lt.publishCond.Wait()
+	}
+	lt.visible.Store(last)
+	lt.publishCond.Broadcast()
+}
+
+// waitForWrites blocks until every write appended to the WAL is visible.
+// It is called with the write lock held before a flush, so a flush never
+// drops a version a reader can see in favour of one it can't yet.
+func (lt *LSMTree) waitForWrites() {
+	lt.writeMu.Lock()
+	seq := lt.seq
+	lt.writeMu.Unlock()
+
+	lt.publishMu.Lock()
+	defer lt.publishMu.Unlock()
+	for lt.visible.Load() < seq {
+		lt.publishCond.Wait()
+	}
+}
+
+// rotate replaces the active memtables and WAL segment if mt is still an
+// active memtable, since a concurrent write may have already rotated it.
+func (lt *LSMTree) rotate(mt Memtable) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	active := false
+	for _, cf := range lt.families {
+		active = active || cf.tables[len(cf.tables)-1] == mt
+	}
+	if !active {
+		return nil
+	}
+	if err := lt.wal.Rotate(); err != nil {
+		return fmt.Errorf("unable to rotate WAL: %w", err)
+	}
+	lt.addMemtables(lt.wal.Segment())
+	return nil
+}
+
+// addMemtables expects the caller to hold the write lock. It adds an
+// active memtable to every column family, for the WAL segment seg.
+func (lt *LSMTree) addMemtables(seg int) {
+	for _, cf := range lt.families {
+		cf.tables = append(cf.tables, lt.newMemtable())
+	}
+	lt.segs = append(lt.segs, seg)
+}
+
+// familyTables holds memtables of a column family.
+type familyTables struct {
+	cf     int
+	tables []Memtable
 }
 
-func (lt *LSMTree) Delete(key string) {
-	lt.Put(key, nil)
+// oldestMemtables expects the caller to hold the lock. It returns the n
+// oldest memtables of every column family, and the IDs of the n oldest
+// WAL segments they belong to.
+func (lt *LSMTree) oldestMemtables(n int) ([]familyTables, []int) {
+	fts := make([]familyTables, 0, len(lt.families))
+	for id, cf := range lt.families {
+		fts = append(fts, familyTables{cf: id, tables: cf.tables[:n]})
+	}
+	return fts, append([]int{}, lt.segs[:n]...)
 }
 
-// Close flushes all memtables to disk.
+// flush writes memtables to disk one WAL segment at a time, and returns
+// the number of segments whose memtables were all written.
+func (lt *LSMTree) flush(fts []familyTables, n int) (int, error) {
+	for i := 0; i < n; i++ {
+		for _, ft := range fts {
+			if err := lt.stm.Add(ft.cf, ft.tables[i]); err != nil {
+				return i, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// releaseMemtables expects the caller to hold the write lock. It removes
+// the memtables of every WAL segment up to and including seg, and the
+// segments. Memtables which were already released are skipped, so a
+// caller can't release memtables newer than the ones it flushed.
+func (lt *LSMTree) releaseMemtables(seg int) error {
+	n := 0
+	for n < len(lt.segs)-1 && lt.segs[n] <= seg {
+		n++
+	}
+	for _, cf := range lt.families {
+		cf.tables = cf.tables[n:]
+	}
+	lt.segs = lt.segs[n:]
+	return lt.wal.Release(seg)
+}
+
+// Close flushes all memtables to disk, and stops background compaction.
 func (lt *LSMTree) Close() error {
-	// TODO: also stop compaction here.
 	lt.flusherCloser <- struct{}{}
-	return lt.FlushMemory()
+	if err := lt.FlushMemory(); err != nil {
+		return err
+	}
+	if err := lt.stm.Close(); err != nil {
+		return err
+	}
+	return lt.wal.Close()
 }
 
 func (lt *LSMTree) FlushMemory() error {
+	lt.flushMu.Lock()
+	defer lt.flushMu.Unlock()
 	lt.mu.Lock()
 	defer lt.mu.Unlock()
+	lt.waitForWrites()
 
-	toFlush := lt.tables
-	lt.logger.Info("flushing memtables", slog.Int("tables to flush", len(toFlush)))
+	toFlush := len(lt.defaultFamily.tables)
+	lt.logger.Info("flushing memtables", slog.Int("tables to flush", toFlush))
 
-	for _, t := range toFlush {
-		if err := lt.stm.Add(t); err != nil {
-			return fmt.Errorf("unable to flush and close db: %w", err)
+	fts, segs := lt.oldestMemtables(toFlush)
+	if flushed, err := lt.flush(fts, toFlush); err != nil {
+		err = fmt.Errorf("unable to flush and close db: %w", err)
+		if flushed > 0 {
+			if rerr := lt.releaseMemtables(segs[flushed-1]); rerr != nil {
+				err = errors.Join(err, fmt.Errorf("unable to release WAL segments: %w", rerr))
+			}
 		}
+		return err
+	}
+
+	if err := lt.wal.Rotate(); err != nil {
+		return fmt.Errorf("unable to rotate WAL: %w", err)
+	}
+	lt.addMemtables(lt.wal.Segment())
+	if err := lt.releaseMemtables(segs[toFlush-1]); err != nil {
+		return fmt.Errorf("unable to release WAL segments: %w", err)
 	}
-	lt.tables = []Memtable{NewAATree()}
 	return nil
 }
 
@@ -137,6 +492,15 @@ func (lt *LSMTree) Compact() {
 	lt.stm.Compact()
 }
 
+// BlockCacheStats returns the hits, misses and evictions of the block
+// cache, which are all zero if it is disabled.
+func (lt *LSMTree) BlockCacheStats() lru.Stats {
+	if lt.stm.blockCache == nil {
+		return lru.Stats{}
+	}
+	return lt.stm.blockCache.stats()
+}
+
 func (lt *LSMTree) flushPeriodically() {
 	t := time.NewTicker(lt.flushPeriod)
 	for {
@@ -145,40 +509,75 @@ func (lt *LSMTree) flushPeriodically() {
 			lt.logger.Info("periodic flush goroutine closed")
 			return
 		case <-t.C:
-			lt.mu.Lock()
-
-			var mts []Memtable
-			numToFlush := min(
-				max(len(lt.tables)-lt.maxMemTables, 0),
-				DEFAULT_MAX_FLUSHED_TABLES,
-			)
-			numInMemory := len(lt.tables) - numToFlush
-
-			if numToFlush > 0 {
-				mts = lt.tables[:numToFlush]
-			} else {
-				lt.logger.Info("nothing to flush, skipping")
-				lt.mu.Unlock()
-				continue
-			}
-			lt.logger.Info("flushing memtables", slog.Int("tables to flush", numToFlush))
-			lt.mu.Unlock()
-
-			for _, mt := range mts {
-				err := lt.stm.Add(mt)
-				if err != nil {
-					lt.logger.Warn("failed to flush periodically", "error", err)
-					break
-				}
-			}
-			lt.logger.Info("finished flushing memtables",
-				slog.Int("tables flushed", numToFlush),
-				slog.Int("tables in memory", numInMemory),
-			)
-
-			lt.mu.Lock()
-			lt.tables = lt.tables[numToFlush:]
-			lt.mu.Unlock()
+			lt.flushPeriodic()
 		}
 	}
 }
+
+// flushPeriodic flushes the oldest memtables beyond the number kept in
+// memory. The lock is released while they are written, so writes can
+// continue.
+func (lt *LSMTree) flushPeriodic() {
+	lt.flushMu.Lock()
+	defer lt.flushMu.Unlock()
+
+	lt.mu.Lock()
+	lt.waitForWrites()
+
+	numToFlush := min(
+		max(len(lt.defaultFamily.tables)-lt.maxMemTables, 0),
+		DEFAULT_MAX_FLUSHED_TABLES,
+	)
+	numInMemory := len(lt.defaultFamily.tables) - numToFlush
+	if numToFlush == 0 {
+		lt.logger.Info("nothing to flush, skipping")
+		lt.mu.Unlock()
+		return
+	}
+	fts, segs := lt.oldestMemtables(numToFlush)
+	lt.logger.Info("flushing memtables", slog.Int("tables to flush", numToFlush))
+	lt.mu.Unlock()
+
+	flushed, err := lt.flush(fts, numToFlush)
+	if err != nil {
+		lt.logger.Warn("failed to flush periodically", "error", err)
+	}
+	lt.logger.Info("finished flushing memtables",
+		slog.Int("tables flushed", flushed),
+		slog.Int("tables in memory", numInMemory),
+	)
+	if flushed == 0 {
+		return
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if err := lt.releaseMemtables(segs[flushed-1]); err != nil {
+		lt.logger.Warn("failed to release WAL segments", "error", err)
+	}
+}
+
+// replayWAL rebuilds the memtables of every WAL segment left over from
+// before a crash. Writes to column families which have since been
+// dropped are skipped.
+func (lt *LSMTree) replayWAL() error {
+	curSeg := -1
+	return lt.wal.Replay(func(seg int, payload []byte) error {
+		if seg != curSeg {
+			curSeg = seg
+			lt.addMemtables(seg)
+		}
+
+		wb, err := decodeWriteBatch(payload)
+		if err != nil {
+			return fmt.Errorf("unable to decode WAL record: %w", err)
+		}
+		for i, key := range wb.keys {
+			lt.seq = max(lt.seq, wb.entries[i].Seq)
+			if cf, ok := lt.families[wb.families[i]]; ok {
+				cf.tables[len(cf.tables)-1].Insert(key, wb.entries[i])
+			}
+		}
+		return nil
+	})
+}
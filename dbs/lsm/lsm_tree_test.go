@@ -1,9 +1,16 @@
 package lsm
 
 import (
+	"crypto/rand"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,10 +25,19 @@ func cleanUp() {
 	os.RemoveAll(TEST_DIR)
 }
 
+// crash stops the background goroutines of the tree without flushing
+// its memtables, so that they don't outlive the test.
+func crash(lt *LSMTree) {
+	lt.flusherCloser <- struct{}{}
+	lt.stm.Close()
+	lt.wal.Close()
+}
+
 func TestPutGetLarge(t *testing.T) {
 	lt, err := NewLSMTree(TEST_DIR)
 	assert.Nil(t, err)
 	defer cleanUp()
+	defer lt.Close()
 
 	for i := 0; i < 500000; i++ {
 		key := fmt.Sprintf("key_%d", i)
@@ -42,6 +58,7 @@ func TestPutGetSSTable(t *testing.T) {
 	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(32*1024))
 	assert.Nil(t, err)
 	defer cleanUp()
+	defer lt.Close()
 
 	for i := 0; i < 10000; i++ {
 		key := fmt.Sprintf("key_%d", i)
@@ -63,6 +80,7 @@ func TestPutGetDel(t *testing.T) {
 	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(32*1024))
 	assert.Nil(t, err)
 	defer cleanUp()
+	defer lt.Close()
 
 	const SKIP_RATIO = 5
 
@@ -81,11 +99,11 @@ func TestPutGetDel(t *testing.T) {
 		key := fmt.Sprintf("key_%d", i)
 		val := fmt.Sprintf("val_%d", i)
 		found, err := lt.Get(key)
-		assert.Nil(t, err)
 
 		if i%SKIP_RATIO == 0 {
-			assert.Equal(t, []byte(nil), found)
+			assert.ErrorIs(t, err, ErrNotFound)
 		} else {
+			assert.Nil(t, err)
 			assert.Equal(t, val, string(found))
 		}
 	}
@@ -95,6 +113,7 @@ func TestPutGetWhileCompactingSST(t *testing.T) {
 	lt, err := NewLSMTree(TEST_DIR)
 	assert.Nil(t, err)
 	defer cleanUp()
+	defer lt.Close()
 
 	// Ad-hoc, mock of "compacting".
 	lt.stm.mu.RLock()
@@ -113,13 +132,14 @@ func TestPutGetWhileCompactingSST(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, val, string(found))
 	}
-	assert.Empty(t, lt.stm.ssTables[0])
+	assert.Empty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0])
 }
 
 func TestProperlyCompactStale(t *testing.T) {
 	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
 	assert.Nil(t, err)
 	defer cleanUp()
+	defer lt.Close()
 
 	const SKIP_RATIO = 5
 
@@ -146,13 +166,14 @@ func TestProperlyCompactStale(t *testing.T) {
 	for i := 0; i < 50000; i++ {
 		key := fmt.Sprintf("key_%d", i)
 		found, err := lt.Get(key)
-		assert.Nil(t, err)
 
 		if i < 10000 {
+			assert.Nil(t, err)
 			assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(found), i)
 		} else if i%SKIP_RATIO == 0 {
-			assert.Equal(t, "", string(found), i)
+			assert.ErrorIs(t, err, ErrNotFound, i)
 		} else {
+			assert.Nil(t, err)
 			assert.Equal(t, fmt.Sprintf("val_%d", i), string(found), i)
 		}
 	}
@@ -168,13 +189,14 @@ func TestSaveAndLoad(t *testing.T) {
 		val := []byte(fmt.Sprintf("val_%d", i))
 		lt.Put(key, val)
 	}
-	// assert.Nil(t, lt.Close())
 	lt.FlushMemory()
 	lt.Compact()
+	assert.Nil(t, lt.Close())
 
 	lt, err = NewLSMTree(TEST_DIR)
 	assert.Nil(t, err)
-	assert.NotEmpty(t, lt.stm.ssTables)
+	defer lt.Close()
+	assert.NotEmpty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables)
 
 	for i := 0; i < 50000; i++ {
 		key := fmt.Sprintf("key_%d", i)
@@ -184,3 +206,1726 @@ func TestSaveAndLoad(t *testing.T) {
 		assert.Equal(t, val, string(found))
 	}
 }
+
+func TestRecoverFromWAL(t *testing.T) {
+	modes := []SyncMode{SyncAlways, SyncGroup, SyncPeriodic}
+
+	for _, mode := range modes {
+		lt, err := NewLSMTree(
+			TEST_DIR,
+			WithMemTableSize(1024*16),
+			WithWALSyncMode(mode),
+			WithWALSyncPeriod(10*time.Millisecond),
+		)
+		assert.Nil(t, err)
+
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			val := []byte(fmt.Sprintf("val_%d", i))
+			assert.Nil(t, lt.Put(key, val))
+		}
+		for i := 0; i < 5000; i += 5 {
+			assert.Nil(t, lt.Delete(fmt.Sprintf("key_%d", i)))
+		}
+		if mode == SyncPeriodic {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		// Simulate a crash by reopening without flushing.
+		crash(lt)
+		lt, err = NewLSMTree(TEST_DIR)
+		assert.Nil(t, err)
+		assert.Empty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0])
+
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			found, err := lt.Get(key)
+
+			if i%5 == 0 {
+				assert.ErrorIs(t, err, ErrNotFound, mode)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("val_%d", i), string(found), mode)
+			}
+		}
+		assert.Nil(t, lt.Close())
+		cleanUp()
+	}
+}
+
+func TestWALReleasedAfterFlush(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val := []byte(fmt.Sprintf("val_%d", i))
+		assert.Nil(t, lt.Put(key, val))
+	}
+	assert.Greater(t, len(lt.wal.segs), 1)
+
+	assert.Nil(t, lt.FlushMemory())
+	assert.Equal(t, 1, len(lt.wal.segs))
+
+	segs, err := filepath.Glob(filepath.Join(TEST_DIR, "wal-*.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(segs))
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	strategy := NewLeveledCompaction()
+	strategy.MaxTableSize = 1024 * 16
+	strategy.LevelBaseSize = 1024 * 64
+	strategy.LevelSizeRatio = 4
+	strategy.L0CompactionTrigger = 1
+
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMemTableSize(1024*16),
+		WithCompactionStrategy(strategy),
+	)
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	const SKIP_RATIO = 7
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("key_%05d", (i*7919)%20000)
+			val := []byte(fmt.Sprintf("val_%d_%d", round, i))
+			assert.Nil(t, lt.Put(key, val))
+		}
+		assert.Nil(t, lt.FlushMemory())
+	}
+	for i := 0; i < 20000; i += SKIP_RATIO {
+		assert.Nil(t, lt.Delete(fmt.Sprintf("key_%05d", (i*7919)%20000)))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	assert.Empty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0])
+	assert.Greater(t, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables), 2)
+	for level, tables := range lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1:] {
+		assert.LessOrEqual(t, levelSize(tables), strategy.TargetSize(level+1))
+		for i := 1; i < len(tables); i++ {
+			assert.Less(t, tables[i-1].Meta.MaxKey, tables[i].Meta.MinKey)
+		}
+	}
+	lt.stm.mu.RUnlock()
+
+	for i := 0; i < 20000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%05d", (i*7919)%20000))
+		if i%SKIP_RATIO == 0 {
+			assert.ErrorIs(t, err, ErrNotFound, i)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("val_2_%d", i), string(found), i)
+		}
+	}
+}
+
+func TestLeveledCompactionOptions(t *testing.T) {
+	defer cleanUp()
+
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMaxTableSize(1024*16),
+		WithLevelBaseSize(1024*64),
+		WithLevelSizeRatio(4),
+		WithL0CompactionTrigger(1),
+		WithMaxLevels(3),
+	)
+	assert.Nil(t, err)
+	strategy, ok := lt.stm.strategy.(*LeveledCompaction)
+	assert.True(t, ok)
+	assert.Equal(t, 1024*16, strategy.MaxTableSize)
+	assert.Equal(t, 1024*64, strategy.LevelBaseSize)
+	assert.Equal(t, 4, strategy.LevelSizeRatio)
+	assert.Equal(t, 1, strategy.L0CompactionTrigger)
+	assert.Equal(t, 3, strategy.MaxLevels)
+	assert.Nil(t, lt.Close())
+
+	// They apply to a strategy set in any order, which must be leveled.
+	leveled := NewLeveledCompaction()
+	lt, err = NewLSMTree(TEST_DIR, WithMaxLevels(3), WithCompactionStrategy(leveled))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, leveled.MaxLevels)
+	assert.Nil(t, lt.Close())
+
+	for _, opts := range [][]LSMOption{
+		{WithCompactionStrategy(NewSizeTieredCompaction()), WithMaxLevels(3)},
+		{WithMaxLevels(3), WithCompactionStrategy(NewSizeTieredCompaction())},
+	} {
+		_, err = NewLSMTree(TEST_DIR, opts...)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val := []byte(fmt.Sprintf("val_%d", i))
+		assert.Nil(t, lt.Put(key, val))
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	assert.Eventually(t, func() bool {
+		lt.stm.mu.RLock()
+		defer lt.stm.mu.RUnlock()
+		return len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0]) < DEFAULT_L0_COMPACTION_TRIGGER
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, lt.Close())
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		found, err := lt.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	strategy := NewSizeTieredCompaction()
+	strategy.MaxTiers = 3
+
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMemTableSize(1024*16),
+		WithCompactionStrategy(strategy),
+	)
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	const SKIP_RATIO = 7
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("key_%05d", (i*7919)%20000)
+			val := []byte(fmt.Sprintf("val_%d_%d", round, i))
+			assert.Nil(t, lt.Put(key, val))
+		}
+		assert.Nil(t, lt.FlushMemory())
+	}
+	for i := 0; i < 20000; i += SKIP_RATIO {
+		assert.Nil(t, lt.Delete(fmt.Sprintf("key_%05d", (i*7919)%20000)))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	for _, tables := range lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables {
+		assert.Less(t, len(tables), strategy.MinThreshold)
+	}
+	assert.Equal(t, 3, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables))
+	lt.stm.mu.RUnlock()
+
+	for i := 0; i < 20000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%05d", (i*7919)%20000))
+		if i%SKIP_RATIO == 0 {
+			assert.ErrorIs(t, err, ErrNotFound, i)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("val_2_%d", i), string(found), i)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	// Spread the keys across compacted tables, level 0 and memtables.
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key_%05d", i)
+		assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	for i := 0; i < 10000; i += 2 {
+		key := fmt.Sprintf("key_%05d", i)
+		assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("new_val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	for i := 0; i < 10000; i += 3 {
+		assert.Nil(t, lt.Delete(fmt.Sprintf("key_%05d", i)))
+	}
+
+	expected := func(i int) string {
+		if i%2 == 0 {
+			return fmt.Sprintf("new_val_%d", i)
+		}
+		return fmt.Sprintf("val_%d", i)
+	}
+
+	i := 1000
+	for k, v := range lt.Scan("key_01000", "key_05000") {
+		for i%3 == 0 {
+			i++
+		}
+		assert.Equal(t, fmt.Sprintf("key_%05d", i), k)
+		assert.Equal(t, expected(i), string(v))
+		i++
+	}
+	assert.Equal(t, 5000, i)
+
+	it := lt.NewIterator(IteratorOptions{Reverse: true})
+	i = 9999
+	for k, v := range it.All() {
+		for i%3 == 0 {
+			i--
+		}
+		assert.Equal(t, fmt.Sprintf("key_%05d", i), k)
+		assert.Equal(t, expected(i), string(v))
+		i--
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 0, i)
+
+	it = lt.NewIterator(IteratorOptions{Prefix: "key_0012"})
+	keys := make([]string, 0)
+	for k := range it.All() {
+		keys = append(keys, k)
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"key_00121", "key_00122", "key_00124", "key_00125", "key_00127", "key_00128"}, keys)
+}
+
+func TestScanWhileCompacting(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key_%05d", i)
+		assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("val_%d", i))))
+	}
+
+	// Tables removed by a compaction stay readable until the scan ends.
+	it := lt.NewIterator(IteratorOptions{})
+	i := 0
+	for k, v := range it.All() {
+		if i == 0 {
+			assert.Nil(t, lt.FlushMemory())
+			lt.Compact()
+		}
+		assert.Equal(t, fmt.Sprintf("key_%05d", i), k)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(v))
+		i++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 10000, i)
+}
+
+func TestScanStopsOnError(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	strategy := &moveStrategy{from: 0, to: 1}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	for i := 0; i < 5000; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, lt.Delete(fmt.Sprintf("key_%04d", i)))
+		} else {
+			assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("new_val_%d", i))))
+		}
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	// Flip a bit in a block in the middle of the newer table.
+	lt.stm.mu.RLock()
+	tables := lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0]
+	assert.Len(t, tables, 2)
+	newer := tables[1]
+	lt.stm.mu.RUnlock()
+	start, _ := newer.chunkBounds(len(newer.Index.Index) / 2)
+	b := make([]byte, 1)
+	_, err = newer.DataFile.ReadAt(b, int64(start+10))
+	assert.Nil(t, err)
+	b[0] ^= 0x01
+	f, err := os.OpenFile(newer.DataFile.Name(), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(b, int64(start+10))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// The values and deletes of the newer table shadow every value of the
+	// older one, none of which may be returned in their place.
+	it := lt.NewIterator(IteratorOptions{})
+	n := 0
+	for k, v := range it.All() {
+		assert.Equal(t, "new_", string(v[:4]), k)
+		n++
+	}
+	assert.Greater(t, n, 0)
+	assert.Less(t, n, 2500)
+	var corruption ErrCorruption
+	assert.ErrorAs(t, it.Err(), &corruption)
+}
+
+func TestEmptyValues(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%05d", i), []byte{}))
+	}
+	assert.Nil(t, lt.Delete("key_00000"))
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			assert.Nil(t, lt.FlushMemory())
+			lt.Compact()
+		}
+
+		_, err := lt.Get("key_00000")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = lt.Get("missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		for i := 1; i < 5000; i++ {
+			found, err := lt.Get(fmt.Sprintf("key_%05d", i))
+			assert.Nil(t, err)
+			assert.Empty(t, found)
+		}
+
+		n := 0
+		for range lt.Scan("", "") {
+			n++
+		}
+		assert.Equal(t, 4999, n)
+	}
+}
+
+// moveStrategy compacts every table in one level together with every
+// table in another, unless paused.
+type moveStrategy struct {
+	from, to     int
+	maxTableSize int
+	paused       atomic.Bool
+}
+
+func (ms *moveStrategy) Pick(levels [][]SSTable) *Compaction {
+	if ms.paused.Load() || ms.from >= len(levels) || len(levels[ms.from]) == 0 {
+		return nil
+	}
+	inputs := append([]SSTable{}, levels[ms.from]...)
+	if ms.to < len(levels) {
+		inputs = append(inputs, levels[ms.to]...)
+	}
+	return &Compaction{Inputs: inputs, OutputLevel: ms.to, MaxTableSize: ms.maxTableSize}
+}
+
+func TestTombstonesKeptUntilBottommost(t *testing.T) {
+	strategy := &moveStrategy{from: 0, to: 2}
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	assert.Nil(t, lt.Put("key", []byte("val")))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	// The older value is still in level 2, so the tombstone must be kept.
+	strategy.to = 1
+	assert.Nil(t, lt.Delete("key"))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	assert.Equal(t, 1, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1]))
+	assert.Equal(t, 1, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[2]))
+	lt.stm.mu.RUnlock()
+	_, err = lt.Get("key")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Once both are compacted together, neither has to be kept.
+	strategy.from, strategy.to = 1, 2
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	assert.Empty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1])
+	assert.Empty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[2])
+	lt.stm.mu.RUnlock()
+	_, err = lt.Get("key")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSnapshot(t *testing.T) {
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMemTableSize(1024*16),
+		WithCompactionStrategy(&moveStrategy{from: 0, to: 1}),
+	)
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key_%05d", i)
+		assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("val_%d", i))))
+	}
+	snap := lt.Snapshot()
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key_%05d", i)
+		if i%2 == 0 {
+			assert.Nil(t, lt.Delete(key))
+		} else {
+			assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("new_val_%d", i))))
+		}
+	}
+	assert.Nil(t, lt.Put("key_99999", []byte("new")))
+
+	check := func() {
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key_%05d", i)
+			found, err := snap.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+
+			found, err = lt.Get(key)
+			if i%2 == 0 {
+				assert.ErrorIs(t, err, ErrNotFound)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(found))
+			}
+		}
+		_, err := snap.Get("key_99999")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		i := 0
+		for k, v := range snap.Scan("", "") {
+			assert.Equal(t, fmt.Sprintf("key_%05d", i), k)
+			assert.Equal(t, fmt.Sprintf("val_%d", i), string(v))
+			i++
+		}
+		assert.Equal(t, 5000, i)
+	}
+
+	// Both versions must survive flushing and compaction.
+	check()
+	assert.Nil(t, lt.FlushMemory())
+	check()
+	lt.Compact()
+	check()
+
+	items := func() int {
+		lt.stm.mu.RLock()
+		defer lt.stm.mu.RUnlock()
+		n := 0
+		for _, level := range lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables {
+			for _, t := range level {
+				n += t.Meta.Items
+			}
+		}
+		return n
+	}
+	assert.GreaterOrEqual(t, items(), 10000)
+
+	// Once released, only the newest versions are kept.
+	snap.Release()
+	assert.Nil(t, lt.Put("key_99998", []byte("new")))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	assert.Equal(t, 2502, items())
+}
+
+func TestSequenceNumbersRecovered(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	assert.Nil(t, lt.Put("key", []byte("val_1")))
+	assert.Nil(t, lt.Close())
+
+	// Newer writes must win over older ones, even across restarts.
+	lt, err = NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer lt.Close()
+	assert.Nil(t, lt.Put("key", []byte("val_2")))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	found, err := lt.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "val_2", string(found))
+}
+
+func TestWriteBatch(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 5000; i++ {
+		wb.Put(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("val_%d", i)))
+	}
+	for i := 0; i < 5000; i += 5 {
+		wb.Delete(fmt.Sprintf("key_%d", i))
+	}
+	assert.Nil(t, lt.Write(wb))
+
+	// The whole batch is recovered from a single WAL record.
+	crash(lt)
+	lt, err = NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for i := 0; i < 5000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%d", i))
+		if i%5 == 0 {
+			assert.ErrorIs(t, err, ErrNotFound)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+		}
+	}
+}
+
+func TestWriteBatchAtomic(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithMemTableSize(1024*16))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wb := NewWriteBatch()
+		for i := 0; i < 2000; i++ {
+			wb.Reset()
+			for j := 0; j < 10; j++ {
+				wb.Put(fmt.Sprintf("key_%d", j), []byte(fmt.Sprintf("val_%d", i)))
+			}
+			assert.Nil(t, lt.Write(wb))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		// Every key must always have been written by the same batch.
+		snap := lt.Snapshot()
+		vals := make(map[string]bool)
+		for _, v := range snap.Scan("", "") {
+			vals[string(v)] = true
+		}
+		snap.Release()
+		assert.LessOrEqual(t, len(vals), 1)
+	}
+}
+
+func TestLoadLegacyTables(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+	copyFixture(t, "baseline")
+
+	// Compaction is paused until the tables have been checked, since it
+	// runs in the background after every flush.
+	strategy := &moveStrategy{from: 0, to: 1}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%05d", i), []byte(fmt.Sprintf("newer_val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	// The baseline tables have keys written as in TestLoadRecordFormats.
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			found, err := lt.Get(fmt.Sprintf("key_%05d", i))
+			switch {
+			case i%2 == 0:
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("newer_val_%d", i), string(found))
+			case i%5 == 0:
+				assert.NotNil(t, err)
+			case i%3 == 0:
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(found))
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+			}
+		}
+	}
+
+	// Reads work across both formats, until compaction rewrites the
+	// legacy tables in the new format.
+	lt.stm.mu.RLock()
+	level0 := lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0]
+	assert.Len(t, level0, 3)
+	assert.Equal(t, TABLE_FORMAT_LEGACY, level0[0].Format)
+	assert.Equal(t, TABLE_FORMAT_LEGACY, level0[1].Format)
+	assert.Equal(t, TABLE_FORMAT_BLOCK_CRC, level0[2].Format)
+	lt.stm.mu.RUnlock()
+	check()
+
+	strategy.paused.Store(false)
+	lt.Compact()
+	check()
+	legacy, err := filepath.Glob(filepath.Join(TEST_DIR, "lsm-*.data"))
+	assert.Nil(t, err)
+	assert.Empty(t, legacy)
+}
+
+// copyFixture copies the tables in testdata/name, written by an earlier
+// version of the tree, to TEST_DIR.
+func copyFixture(t *testing.T, name string) {
+	files, err := filepath.Glob(filepath.Join("testdata", name, "lsm-*"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(TEST_DIR, filepath.Base(f)), b, 0644))
+	}
+}
+
+// TestLoadRecordFormats opens tables written in every legacy record
+// format. Each fixture has 1000 keys written in one table, of which every
+// fifth is then deleted and every other third overwritten in another.
+func TestLoadRecordFormats(t *testing.T) {
+	for _, name := range []string{"baseline", "record-kind", "record-seq"} {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+			defer cleanUp()
+			copyFixture(t, name)
+
+			strategy := &moveStrategy{from: 0, to: 1}
+			strategy.paused.Store(true)
+			lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+			assert.Nil(t, err)
+			defer lt.Close()
+
+			check := func() {
+				for i := 0; i < 1000; i++ {
+					found, err := lt.Get(fmt.Sprintf("key_%05d", i))
+					switch {
+					case i%5 == 0:
+						assert.NotNil(t, err)
+					case i%3 == 0:
+						assert.Nil(t, err)
+						assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(found))
+					default:
+						assert.Nil(t, err)
+						assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+					}
+				}
+			}
+			check()
+
+			// Records without a sequence number all have a Seq of 0, so
+			// compaction must keep the one in the newer table.
+			strategy.paused.Store(false)
+			lt.Compact()
+			check()
+			legacy, err := filepath.Glob(filepath.Join(TEST_DIR, "lsm-*.data"))
+			assert.Nil(t, err)
+			assert.Empty(t, legacy)
+		})
+	}
+}
+
+func TestMixedCompression(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	codecs := []Compression{CompressionNone, CompressionSnappy, CompressionFlate}
+	for i, c := range codecs {
+		lt, err := NewLSMTree(TEST_DIR, WithCompression(c))
+		assert.Nil(t, err)
+		for j := 0; j < 2000; j++ {
+			val := fmt.Sprintf(`{"codec":"%s","id":%d}`, c, j)
+			assert.Nil(t, lt.Put(fmt.Sprintf("key_%d_%04d", i, j), []byte(val)))
+		}
+		assert.Nil(t, lt.FlushMemory())
+		assert.Nil(t, lt.Close())
+	}
+
+	strategy := &moveStrategy{from: 0, to: 1}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	lt.stm.mu.RLock()
+	assert.Equal(t, len(codecs), len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0]))
+	for i, c := range codecs {
+		assert.Equal(t, c, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0][i].Meta.Compression)
+	}
+	lt.stm.mu.RUnlock()
+
+	check := func() {
+		for i, c := range codecs {
+			for j := 0; j < 2000; j++ {
+				found, err := lt.Get(fmt.Sprintf("key_%d_%04d", i, j))
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf(`{"codec":"%s","id":%d}`, c, j), string(found))
+			}
+		}
+		count := 0
+		for range lt.Scan("", "") {
+			count++
+		}
+		assert.Equal(t, len(codecs)*2000, count)
+	}
+	check()
+
+	// Compaction rewrites every table with the current codec.
+	strategy.paused.Store(false)
+	lt.Compact()
+	lt.stm.mu.RLock()
+	assert.NotEmpty(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1])
+	for _, ss := range lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1] {
+		assert.Equal(t, DEFAULT_COMPRESSION, ss.Meta.Compression)
+	}
+	lt.stm.mu.RUnlock()
+	check()
+}
+
+func TestBlockCache(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	lt, err := NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	// The first read of a block misses, and every read after hits.
+	for i := 0; i < 3; i++ {
+		found, err := lt.Get("key_0042")
+		assert.Nil(t, err)
+		assert.Equal(t, "val_42", string(found))
+	}
+	stats := lt.BlockCacheStats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Hits)
+
+	// Iterators share the cache with Get.
+	count := 0
+	for k, v := range lt.Scan("key_0040", "key_0045") {
+		assert.Equal(t, "val_"+strings.TrimLeft(k[4:], "0"), string(v))
+		count++
+	}
+	assert.Equal(t, 5, count)
+	assert.Equal(t, uint64(3), lt.BlockCacheStats().Hits)
+
+	// Blocks are read again from disk after they are evicted.
+	assert.Nil(t, lt.Close())
+	lt, err = NewLSMTree(TEST_DIR, WithBlockCacheSize(1024))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for i := 0; i < 5000; i += 7 {
+		found, err := lt.Get(fmt.Sprintf("key_%04d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+	}
+	assert.NotZero(t, lt.BlockCacheStats().Evicted)
+}
+
+func TestCorruption(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	lt, err := NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.Close())
+	assert.Nil(t, Verify(TEST_DIR))
+
+	// Flip a bit in the first data block.
+	files, err := filepath.Glob(filepath.Join(TEST_DIR, "lsm-*.sst"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	b, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	b[10] ^= 0x01
+	assert.Nil(t, os.WriteFile(files[0], b, 0644))
+
+	var corruption ErrCorruption
+	assert.ErrorAs(t, Verify(TEST_DIR), &corruption)
+	assert.Equal(t, getFileID(files[0]), corruption.TableID)
+	assert.Equal(t, 0, corruption.Offset)
+
+	lt, err = NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	_, err = lt.Get("key_0000")
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 0, corruption.Offset)
+
+	// Other blocks can still be read.
+	found, err := lt.Get("key_4999")
+	assert.Nil(t, err)
+	assert.Equal(t, "val_4999", string(found))
+}
+
+func TestManifest(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(&moveStrategy{from: 0, to: 1}))
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	for i := 0; i < 5000; i += 2 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("new_val_%d", i))))
+	}
+	crash(lt)
+
+	// Leave behind what a crash in the middle of a flush or compaction would,
+	// which are tables that were never added to the manifest.
+	for _, id := range []int{2, 1000} {
+		assert.Nil(t, os.WriteFile(tableFile(TEST_DIR, id), []byte("half-written"), 0644))
+	}
+
+	lt, err = NewLSMTree(TEST_DIR, WithCompactionStrategy(&moveStrategy{from: 0, to: 1}))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for _, id := range []int{2, 1000} {
+		_, err := os.Stat(tableFile(TEST_DIR, id))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	manifests, err := filepath.Glob(filepath.Join(TEST_DIR, MANIFEST_PREFIX+"*"))
+	assert.Nil(t, err)
+	assert.Len(t, manifests, 1)
+
+	// Levels are recovered from the manifest.
+	lt.stm.mu.RLock()
+	assert.Len(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1], 1)
+	lt.stm.mu.RUnlock()
+
+	for i := 0; i < 5000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%04d", i))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Equal(t, fmt.Sprintf("new_val_%d", i), string(found))
+		} else {
+			assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+		}
+	}
+}
+
+func TestManifestMissingTable(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer cleanUp()
+	assert.Nil(t, lt.Put("key", []byte("val")))
+	assert.Nil(t, lt.Close())
+
+	files, err := filepath.Glob(filepath.Join(TEST_DIR, "lsm-*.sst"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Nil(t, os.Remove(files[0]))
+
+	_, err = NewLSMTree(TEST_DIR)
+	assert.ErrorContains(t, err, fmt.Sprintf("table %d listed in the manifest has no file", getFileID(files[0])))
+}
+
+func TestConcurrentCompactions(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	strategy := NewLeveledCompaction()
+	strategy.MaxTableSize = 1024 * 16
+	strategy.LevelBaseSize = 1024 * 64
+	strategy.LevelSizeRatio = 2
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMemTableSize(1024*16),
+		WithCompactionStrategy(strategy),
+		WithMaxCompactions(4),
+	)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("key_%05d", (i*7919)%20000)
+			assert.Nil(t, lt.Put(key, []byte(fmt.Sprintf("val_%d_%d", round, i))))
+		}
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	for level := 1; level < len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables); level++ {
+		assert.True(t, lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].disjoint[level], level)
+	}
+	lt.stm.mu.RUnlock()
+
+	for i := 0; i < 20000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%05d", (i*7919)%20000))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_2_%d", i), string(found), i)
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	strategy := &moveStrategy{from: 0, to: 1}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy), WithWriteStallTriggers(1, 2))
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%d", i), []byte("val")))
+		assert.Nil(t, lt.FlushMemory())
+	}
+
+	// Writes are stopped until compaction empties level 0.
+	done := make(chan error)
+	go func() {
+		done <- lt.Put("key_2", []byte("val"))
+	}()
+	select {
+	case <-done:
+		t.Fatal("write was not stalled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	strategy.paused.Store(false)
+	lt.Compact()
+	assert.Nil(t, <-done)
+
+	found, err := lt.Get("key_2")
+	assert.Nil(t, err)
+	assert.Equal(t, "val", string(found))
+}
+
+func TestCloseCancelsCompaction(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithCompactionStrategy(&moveStrategy{from: 0, to: 1}),
+		WithCompactionRateLimit(1024),
+	)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	// The compaction would take minutes at this rate, but is cancelled.
+	assert.Eventually(t, func() bool {
+		lt.stm.compactMu.Lock()
+		defer lt.stm.compactMu.Unlock()
+		return lt.stm.running == 1
+	}, time.Second, 10*time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, lt.Close())
+	assert.Less(t, time.Since(start), time.Second)
+
+	lt, err = NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	tables, err := filepath.Glob(filepath.Join(TEST_DIR, "lsm-*"))
+	assert.Nil(t, err)
+	assert.Len(t, tables, 1)
+	for i := 0; i < 5000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%04d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+	}
+}
+
+func TestSkipListMemtable(t *testing.T) {
+	options := []LSMOption{
+		WithMemTableSize(1024 * 16),
+		WithMemtableFactory(func() Memtable { return NewSkipList() }),
+	}
+	lt, err := NewLSMTree(TEST_DIR, options...)
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wb := NewWriteBatch()
+			for i := range 500 {
+				wb.Reset()
+				for j := range 5 {
+					wb.Put(fmt.Sprintf("key_%d_%d", w, j), []byte(fmt.Sprintf("val_%d", i)))
+				}
+				assert.Nil(t, lt.Write(wb))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Batches inserted concurrently are still only seen whole.
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		snap := lt.Snapshot()
+		for w := range 8 {
+			vals := make(map[string]bool)
+			for _, v := range snap.Scan(fmt.Sprintf("key_%d_", w), fmt.Sprintf("key_%d_~", w)) {
+				vals[string(v)] = true
+			}
+			assert.LessOrEqual(t, len(vals), 1)
+		}
+		snap.Release()
+	}
+
+	assert.Nil(t, lt.Close())
+	lt, err = NewLSMTree(TEST_DIR, options...)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	for w := range 8 {
+		for j := range 5 {
+			found, err := lt.Get(fmt.Sprintf("key_%d_%d", w, j))
+			assert.Nil(t, err)
+			assert.Equal(t, "val_499", string(found))
+		}
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	strategy := &moveStrategy{from: 0, to: 2}
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	assert.Nil(t, lt.Put("key_1", []byte("old_val")))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+
+	strategy.to = 1
+	assert.Nil(t, lt.PutWithTTL("key_1", []byte("val_1"), 500*time.Millisecond))
+	assert.Nil(t, lt.PutWithTTL("key_2", []byte("val_2"), 500*time.Millisecond))
+	assert.Nil(t, lt.Put("key_3", []byte("val_3")))
+
+	// Expiry times are recovered from the WAL, and written to tables.
+	crash(lt)
+	lt, err = NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer lt.Close()
+	assert.Nil(t, lt.FlushMemory())
+
+	for i := 1; i <= 3; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// The expired value hides the older one in level 2.
+	for i := 1; i <= 2; i++ {
+		_, err := lt.Get(fmt.Sprintf("key_%d", i))
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	keys := make([]string, 0)
+	for k := range lt.Scan("", "") {
+		keys = append(keys, k)
+	}
+	assert.Equal(t, []string{"key_3"}, keys)
+
+	// Expired values are only dropped once nothing older can be below.
+	lt.Compact()
+	_, err = lt.Get("key_1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	strategy.from, strategy.to = 1, 2
+	lt.Compact()
+
+	lt.stm.mu.RLock()
+	assert.Equal(t, 1, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[2]))
+	assert.Equal(t, "key_3", lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[2][0].Meta.MinKey)
+	lt.stm.mu.RUnlock()
+	_, err = lt.Get("key_1")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestColumnFamilies(t *testing.T) {
+	strategy := WithCompactionStrategy(&moveStrategy{from: 0, to: 1})
+	lt, err := NewLSMTree(TEST_DIR, strategy)
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	users, err := lt.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	sessions, err := lt.CreateColumnFamily("sessions")
+	assert.Nil(t, err)
+	_, err = lt.CreateColumnFamily("users")
+	assert.NotNil(t, err)
+
+	// Writes to several column families are applied atomically.
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Put(fmt.Sprintf("key_%d", i), []byte("default"))
+		wb.PutCF(users, fmt.Sprintf("key_%d", i), []byte("users"))
+	}
+	assert.Nil(t, lt.Write(wb))
+	assert.Nil(t, sessions.Put("key_0", []byte("sessions")))
+	assert.Nil(t, users.Delete("key_1"))
+
+	check := func(users *ColumnFamily) {
+		for i := 0; i < 100; i++ {
+			found, err := lt.Get(fmt.Sprintf("key_%d", i))
+			assert.Nil(t, err)
+			assert.Equal(t, "default", string(found))
+
+			found, err = users.Get(fmt.Sprintf("key_%d", i))
+			if i == 1 {
+				assert.ErrorIs(t, err, ErrNotFound)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "users", string(found))
+			}
+		}
+		n := 0
+		for range users.Scan("", "") {
+			n++
+		}
+		assert.Equal(t, 99, n)
+	}
+	check(users)
+
+	// Column families are recovered from the manifest, and their writes
+	// from the WAL, except for those to dropped column families.
+	assert.Nil(t, lt.DropColumnFamily("sessions"))
+	_, err = sessions.Get("key_0")
+	assert.ErrorIs(t, err, ErrColumnFamilyDropped)
+	assert.ErrorIs(t, sessions.Put("key_0", nil), ErrColumnFamilyDropped)
+	assert.NotNil(t, lt.DropColumnFamily(DEFAULT_COLUMN_FAMILY))
+
+	crash(lt)
+	lt, err = NewLSMTree(TEST_DIR, strategy)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{DEFAULT_COLUMN_FAMILY, "users"}, lt.ColumnFamilies())
+	users, ok := lt.GetColumnFamily("users")
+	assert.True(t, ok)
+	check(users)
+
+	sessions, err = lt.CreateColumnFamily("sessions")
+	assert.Nil(t, err)
+	_, err = sessions.Get("key_0")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Every column family has its own tables, which are compacted
+	// separately.
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	check(users)
+
+	lt.stm.mu.RLock()
+	assert.Equal(t, 1, len(lt.stm.families[users.id].ssTables[1]))
+	assert.Equal(t, 1, len(lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1]))
+	assert.Equal(t, 1, len(lt.stm.families[sessions.id].ssTables))
+	lt.stm.mu.RUnlock()
+
+	assert.Nil(t, lt.DropColumnFamily("users"))
+	assert.Nil(t, lt.Close())
+	lt, err = NewLSMTree(TEST_DIR, strategy)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	assert.Equal(t, []string{DEFAULT_COLUMN_FAMILY, "sessions"}, lt.ColumnFamilies())
+	found, err := lt.Get("key_0")
+	assert.Nil(t, err)
+	assert.Equal(t, "default", string(found))
+	files, err := getFiles(TEST_DIR)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files.ids))
+}
+
+// counter adds integer operands to the value of a key.
+type counter struct{}
+
+func (counter) Merge(key string, existing []byte, operands [][]byte) []byte {
+	n, _ := strconv.Atoi(string(existing))
+	for _, op := range operands {
+		d, _ := strconv.Atoi(string(op))
+		n += d
+	}
+	return []byte(strconv.Itoa(n))
+}
+
+func TestMerge(t *testing.T) {
+	strategy := WithCompactionStrategy(&moveStrategy{from: 0, to: 1})
+	lt, err := NewLSMTree(TEST_DIR, strategy, WithMergeOperator(counter{}))
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	get := func(key string) string {
+		found, err := lt.Get(key)
+		assert.Nil(t, err)
+		return string(found)
+	}
+
+	assert.Nil(t, lt.Put("a", []byte("10")))
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, lt.Merge("a", []byte("1")))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "60", get("a"))
+
+	// Operands without a value, or after a tombstone, apply to nothing.
+	assert.Nil(t, lt.Merge("b", []byte("5")))
+	assert.Nil(t, lt.Put("c", []byte("1")))
+	assert.Nil(t, lt.Delete("c"))
+	assert.Nil(t, lt.Merge("c", []byte("2")))
+
+	snapshot := lt.Snapshot()
+	assert.Nil(t, lt.Merge("a", []byte("1")))
+	assert.Equal(t, "61", get("a"))
+
+	check := func() {
+		assert.Equal(t, "61", get("a"))
+		assert.Equal(t, "5", get("b"))
+		assert.Equal(t, "2", get("c"))
+		found, err := snapshot.Get("a")
+		assert.Nil(t, err)
+		assert.Equal(t, "60", string(found))
+
+		kvs := make(map[string]string)
+		for k, v := range lt.Scan("", "") {
+			kvs[k] = string(v)
+		}
+		assert.Equal(t, map[string]string{"a": "61", "b": "5", "c": "2"}, kvs)
+	}
+	check()
+	assert.Nil(t, lt.FlushMemory())
+	check()
+	lt.Compact()
+	check()
+
+	// Compaction only keeps the operand that the snapshot can't see.
+	countOperands := func() int {
+		lt.stm.mu.RLock()
+		defer lt.stm.mu.RUnlock()
+
+		n := 0
+		for _, ss := range lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1] {
+			for i := range ss.Index.Index {
+				kvps, err := ss.loadChunk(i)
+				assert.Nil(t, err)
+				for _, kvp := range kvps {
+					if kvp.Kind == KindMerge {
+						n++
+					}
+				}
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 1, countOperands())
+
+	snapshot.Release()
+	assert.Nil(t, lt.Merge("a", []byte("1")))
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	assert.Equal(t, "62", get("a"))
+	assert.Equal(t, 0, countOperands())
+
+	// Operands can't be read or written without an operator.
+	assert.Nil(t, lt.Merge("d", []byte("1")))
+	crash(lt)
+	lt, err = NewLSMTree(TEST_DIR, strategy)
+	assert.Nil(t, err)
+	defer lt.Close()
+
+	assert.ErrorIs(t, lt.Merge("a", []byte("1")), ErrNoMergeOperator)
+	_, err = lt.Get("d")
+	assert.ErrorIs(t, err, ErrNoMergeOperator)
+	found, err := lt.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "62", string(found))
+}
+
+func TestPrefixFilter(t *testing.T) {
+	strategy := &moveStrategy{}
+	strategy.paused.Store(true)
+	open := func(opts ...LSMOption) *LSMTree {
+		lt, err := NewLSMTree(TEST_DIR, append(opts, WithCompactionStrategy(strategy))...)
+		assert.Nil(t, err)
+		return lt
+	}
+	lt := open(WithPrefixExtractor(NewFixedPrefixExtractor(2)))
+	defer cleanUp()
+
+	// The first table covers the range of the second, but none of its
+	// prefixes.
+	for _, p := range []string{"a:", "c:"} {
+		for i := range 100 {
+			assert.Nil(t, lt.Put(fmt.Sprintf("%s%02d", p, i), []byte("val")))
+		}
+	}
+	assert.Nil(t, lt.FlushMemory())
+	for i := range 100 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("b:%02d", i), []byte("val")))
+	}
+	assert.Nil(t, lt.FlushMemory())
+
+	check := func(prefix string, skipped bool) {
+		it := lt.NewIterator(IteratorOptions{Prefix: prefix})
+		lt.stm.mu.RLock()
+		tables := lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[0]
+		assert.Equal(t, !skipped, it.overlaps(tables[0]))
+		assert.True(t, it.overlaps(tables[1]))
+		lt.stm.mu.RUnlock()
+
+		n := 0
+		for k := range it.All() {
+			assert.True(t, strings.HasPrefix(k, "b:"))
+			n++
+		}
+		assert.Nil(t, it.Err())
+		assert.Equal(t, 100, n)
+	}
+	check("b:", true)
+	check("b", false)
+
+	// Prefix filters are read back from tables, but only used with the
+	// same extractor.
+	assert.Nil(t, lt.Close())
+	lt = open(WithPrefixExtractor(NewFixedPrefixExtractor(2)))
+	check("b:", true)
+	assert.Nil(t, lt.Close())
+	lt = open(WithPrefixExtractor(NewFixedPrefixExtractor(1)))
+	check("b:", false)
+	assert.Nil(t, lt.Close())
+	lt = open()
+	defer lt.Close()
+	check("b:", false)
+}
+
+func TestStats(t *testing.T) {
+	strategy := &moveStrategy{from: 0, to: 1}
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy), WithBlockCacheSize(0))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	for i := range 100 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%03d", i), []byte("val")))
+	}
+	s := lt.Stats()
+	assert.Equal(t, int64(100*(7+3)), s.BytesIngested)
+	assert.Greater(t, s.WALBytes, s.BytesIngested)
+	assert.Equal(t, 1, s.Memtables)
+	assert.Greater(t, s.MemtableSize, 0)
+	assert.Equal(t, int64(0), s.Flushes)
+
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	for i := range 100 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%03d", i), []byte("new_val")))
+	}
+	strategy.paused.Store(true)
+	assert.Nil(t, lt.FlushMemory())
+
+	for i := range 100 {
+		_, err := lt.Get(fmt.Sprintf("key_%03d", i))
+		assert.Nil(t, err)
+		_, err = lt.Get(fmt.Sprintf("missing_%03d", i))
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+
+	s = lt.Stats()
+	assert.Equal(t, []LevelStats{
+		{Tables: 1, Size: s.Levels[0].Size},
+		{Tables: 1, Size: s.Levels[1].Size},
+	}, s.Levels)
+	assert.Greater(t, s.Levels[0].Size, int64(0))
+	assert.Equal(t, int64(2), s.Flushes)
+	assert.Equal(t, int64(1), s.Compactions)
+	assert.Greater(t, s.CompactionTime, time.Duration(0))
+	assert.Equal(t, s.Levels[1].Size, s.CompactionBytesWritten)
+	assert.Greater(t, s.CompactionBytesRead, int64(0))
+	assert.Greater(t, s.WriteAmplification, 1.0)
+	assert.Greater(t, s.BytesRead, int64(0))
+
+	// Every key is found in the newest table, and missing keys are
+	// outside the key range of level 1.
+	assert.Equal(t, int64(200), s.BloomFilterChecks)
+	assert.Equal(t, int64(100), s.BloomFilterUseful+s.BloomFilterFalsePositives)
+
+	v, ok := lt.Property("lsm.num-files-at-level1")
+	assert.True(t, ok)
+	assert.Equal(t, "1", v)
+	v, ok = lt.Property("lsm.num-files-at-level5")
+	assert.True(t, ok)
+	assert.Equal(t, "0", v)
+	v, ok = lt.Property("lsm.estimate-num-keys")
+	assert.True(t, ok)
+	assert.Equal(t, "200", v)
+	v, ok = lt.Property("lsm.stats")
+	assert.True(t, ok)
+	assert.Contains(t, v, "compactions: 1\n")
+	_, ok = lt.Property("lsm.unknown")
+	assert.False(t, ok)
+}
+
+func TestCheckpoint(t *testing.T) {
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(&moveStrategy{from: 0, to: 1}))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	users, err := lt.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	for i := range 100 {
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%03d", i), []byte("val")))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	lt.Compact()
+	assert.Nil(t, users.Put("key_0", []byte("user")))
+	assert.Nil(t, lt.Delete("key_000"))
+
+	dir := filepath.Join(TEST_DIR, "checkpoint")
+	assert.Nil(t, lt.Checkpoint(dir))
+	assert.NotNil(t, lt.Checkpoint(dir))
+
+	// The checkpoint is unaffected by later writes and compactions.
+	assert.Nil(t, lt.Put("key_100", []byte("val")))
+	lt.Compact()
+
+	cp, err := NewLSMTree(dir)
+	assert.Nil(t, err)
+	defer cp.Close()
+
+	_, err = cp.Get("key_000")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = cp.Get("key_100")
+	assert.ErrorIs(t, err, ErrNotFound)
+	found, err := cp.Get("key_099")
+	assert.Nil(t, err)
+	assert.Equal(t, "val", string(found))
+	cpUsers, ok := cp.GetColumnFamily("users")
+	assert.True(t, ok)
+	found, err = cpUsers.Get("key_0")
+	assert.Nil(t, err)
+	assert.Equal(t, "user", string(found))
+}
+
+func TestCheckpointWhileFlushing(t *testing.T) {
+	lt, err := NewLSMTree(
+		TEST_DIR,
+		WithMemTableSize(1024*4),
+		WithMaxMemTables(1),
+		WithFlushPeriod(time.Millisecond),
+	)
+	assert.Nil(t, err)
+	defer cleanUp()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			assert.Nil(t, lt.Put(fmt.Sprintf("key_%04d", i), []byte(fmt.Sprintf("val_%d", i))))
+		}
+	}()
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+		default:
+			assert.Nil(t, lt.Checkpoint(filepath.Join(TEST_DIR, fmt.Sprintf("checkpoint_%d", i))))
+			continue
+		}
+		break
+	}
+
+	// Every write is recovered from the tables and WAL segments left
+	// behind, none of which a flush released early.
+	crash(lt)
+	lt, err = NewLSMTree(TEST_DIR)
+	assert.Nil(t, err)
+	defer lt.Close()
+	for i := 0; i < 2000; i++ {
+		found, err := lt.Get(fmt.Sprintf("key_%04d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("val_%d", i), string(found))
+	}
+}
+
+func TestBackup(t *testing.T) {
+	strategy := &moveStrategy{from: 0, to: 1}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	be, err := OpenBackupEngine(filepath.Join(TEST_DIR, "backups"))
+	assert.Nil(t, err)
+	sharedFiles := func() int {
+		entries, err := os.ReadDir(filepath.Join(TEST_DIR, "backups", BACKUP_SHARED_DIR))
+		assert.Nil(t, err)
+		return len(entries)
+	}
+
+	assert.Nil(t, lt.Put("key_1", []byte("val_1")))
+	id1, err := be.CreateBackup(lt)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sharedFiles())
+
+	// Only the new table is copied.
+	assert.Nil(t, lt.Put("key_2", []byte("val_2")))
+	id2, err := be.CreateBackup(lt)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, sharedFiles())
+
+	backups, err := be.Backups()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, id1, backups[0].ID)
+	assert.Equal(t, 1, backups[0].Tables)
+	assert.Equal(t, 2, backups[1].Tables)
+	assert.Greater(t, backups[1].Size, backups[0].Size)
+
+	restore := func(id int, keys ...string) {
+		dir := filepath.Join(TEST_DIR, fmt.Sprintf("restore-%d", id))
+		assert.Nil(t, be.Restore(id, dir))
+		restored, err := NewLSMTree(dir)
+		assert.Nil(t, err)
+		defer restored.Close()
+
+		found := make([]string, 0)
+		for k := range restored.Scan("", "") {
+			found = append(found, k)
+		}
+		assert.Equal(t, keys, found)
+	}
+	restore(id1, "key_1")
+	restore(id2, "key_1", "key_2")
+
+	// Tables are only removed once no backup shares them.
+	strategy.paused.Store(false)
+	lt.Compact()
+	id3, err := be.CreateBackup(lt)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sharedFiles())
+	assert.Nil(t, be.DeleteBackup(id1))
+	assert.Equal(t, 3, sharedFiles())
+	assert.Nil(t, be.DeleteBackup(id2))
+	assert.Equal(t, 1, sharedFiles())
+	restore(id3, "key_1", "key_2")
+}
+
+func TestCompactionProgress(t *testing.T) {
+	var mu sync.Mutex
+	reports := make([]CompactionProgress, 0)
+	progress := func(p CompactionProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, p)
+	}
+
+	strategy := &moveStrategy{from: 0, to: 1, maxTableSize: 1024 * 256}
+	strategy.paused.Store(true)
+	lt, err := NewLSMTree(TEST_DIR, WithCompactionStrategy(strategy), WithCompactionProgress(progress))
+	assert.Nil(t, err)
+	defer cleanUp()
+	defer lt.Close()
+
+	// Random values can't be compressed.
+	for i := range 20000 {
+		val := make([]byte, 100)
+		rand.Read(val)
+		assert.Nil(t, lt.Put(fmt.Sprintf("key_%05d", i), val))
+	}
+	assert.Nil(t, lt.FlushMemory())
+	strategy.paused.Store(false)
+	lt.Compact()
+
+	// The output is split into tables of roughly the maximum size.
+	lt.stm.mu.RLock()
+	tables := lt.stm.families[DEFAULT_COLUMN_FAMILY_ID].ssTables[1]
+	lt.stm.mu.RUnlock()
+	assert.Greater(t, len(tables), 1)
+	for _, table := range tables[:len(tables)-1] {
+		assert.InDelta(t, strategy.maxTableSize, table.DataSize, DEFAULT_BLOCK_SIZE*2)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, 1, last.InputTables)
+	assert.Equal(t, last.InputBytes, last.BytesRead)
+	assert.Equal(t, len(tables), last.TablesWritten)
+
+	// Progress is reported while reading, as well as for every table.
+	midway := 0
+	for i, p := range reports[:len(reports)-1] {
+		assert.False(t, p.Done)
+		if i > 0 {
+			assert.GreaterOrEqual(t, p.BytesRead, reports[i-1].BytesRead)
+		}
+		if p.BytesRead < p.InputBytes {
+			midway++
+		}
+	}
+	assert.Greater(t, midway, 1)
+}
@@ -0,0 +1,443 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CURRENT_FILE    = "CURRENT"
+	MANIFEST_PREFIX = "MANIFEST-"
+)
+
+// manifest is a log of every change to the set of live tables and column
+// families, which is the only record of which tables are live. A flush or compaction only
+// takes effect once its edit is durable in the manifest, so files left
+// behind by a crash are never mistaken for live tables.
+//
+// The CURRENT file holds the name of the manifest in use. A new manifest
+// is written on every Load, starting with every live table, and CURRENT
+// is then atomically replaced to point to it.
+//
+// Every record is a versionEdit, written with writeRecord. An edit has the
+// following format, where every number is a uvarint
+//
+//	+-------------+----+-------+-----+---------------+----+-----+
+//	| Added count | ID | Level | ... | Removed count | ID | ... |
+//	+-------------+----+-------+-----+---------------+----+-----+
+//
+// which is followed by the changes to column families, if there are any
+//
+//	+---------------+----+-------------+------+-----+---------------+----+-----+
+//	| Created count | CF | Name length | Name | ... | Dropped count | CF | ... |
+//	+---------------+----+-------------+------+-----+---------------+----+-----+
+//	+---------+--------------+----+----+-----+
+//	| Next CF | Tables count | ID | CF | ... |
+//	+---------+--------------+----+----+-----+
+//
+// where the last list holds the column family of every added table which
+// isn't in the default column family.
+type manifest struct {
+	mu     sync.Mutex
+	dir    string
+	id     int
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// versionEdit adds and removes tables and column families atomically.
+type versionEdit struct {
+	added   []tableLevel
+	removed []int
+
+	created []family
+	dropped []int
+	// nextFamily is the ID the next column family is given, so IDs of
+	// dropped column families are never reused. It is 0 if unchanged.
+	nextFamily int
+}
+
+type tableLevel struct {
+	id    int
+	level int
+	cf    int
+}
+
+type family struct {
+	id   int
+	name string
+}
+
+func (ve versionEdit) encode() []byte {
+	b := binary.AppendUvarint(nil, uint64(len(ve.added)))
+	for _, t := range ve.added {
+		b = binary.AppendUvarint(b, uint64(t.id))
+		b = binary.AppendUvarint(b, uint64(t.level))
+	}
+	b = binary.AppendUvarint(b, uint64(len(ve.removed)))
+	for _, id := range ve.removed {
+		b = binary.AppendUvarint(b, uint64(id))
+	}
+
+	tables := make([]tableLevel, 0)
+	for _, t := range ve.added {
+		if t.cf != DEFAULT_COLUMN_FAMILY_ID {
+			tables = append(tables, t)
+		}
+	}
+	if len(ve.created) == 0 && len(ve.dropped) == 0 && ve.nextFamily == 0 && len(tables) == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(ve.created)))
+	for _, f := range ve.created {
+		b = binary.AppendUvarint(b, uint64(f.id))
+		b = binary.AppendUvarint(b, uint64(len(f.name)))
+		b = append(b, f.name...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(ve.dropped)))
+	for _, id := range ve.dropped {
+		b = binary.AppendUvarint(b, uint64(id))
+	}
+	b = binary.AppendUvarint(b, uint64(ve.nextFamily))
+	b = binary.AppendUvarint(b, uint64(len(tables)))
+	for _, t := range tables {
+		b = binary.AppendUvarint(b, uint64(t.id))
+		b = binary.AppendUvarint(b, uint64(t.cf))
+	}
+	return b
+}
+
+func decodeVersionEdit(b []byte) (versionEdit, error) {
+	next := func() (int, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, fmt.Errorf("unable to decode version edit")
+		}
+		b = b[n:]
+		return int(v), nil
+	}
+
+	var ve versionEdit
+	added, err := next()
+	if err != nil {
+		return versionEdit{}, err
+	}
+	for i := 0; i < added; i++ {
+		id, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		level, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		ve.added = append(ve.added, tableLevel{id: id, level: level})
+	}
+
+	removed, err := next()
+	if err != nil {
+		return versionEdit{}, err
+	}
+	for i := 0; i < removed; i++ {
+		id, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		ve.removed = append(ve.removed, id)
+	}
+	if len(b) == 0 {
+		return ve, nil
+	}
+
+	created, err := next()
+	if err != nil {
+		return versionEdit{}, err
+	}
+	for i := 0; i < created; i++ {
+		id, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		name, rest, err := readUvarintBytes(b)
+		if err != nil {
+			return versionEdit{}, fmt.Errorf("unable to decode column family name: %w", err)
+		}
+		b = rest
+		ve.created = append(ve.created, family{id: id, name: string(name)})
+	}
+
+	dropped, err := next()
+	if err != nil {
+		return versionEdit{}, err
+	}
+	for i := 0; i < dropped; i++ {
+		id, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		ve.dropped = append(ve.dropped, id)
+	}
+
+	if ve.nextFamily, err = next(); err != nil {
+		return versionEdit{}, err
+	}
+	tables, err := next()
+	if err != nil {
+		return versionEdit{}, err
+	}
+	for i := 0; i < tables; i++ {
+		id, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		cf, err := next()
+		if err != nil {
+			return versionEdit{}, err
+		}
+		for j := range ve.added {
+			if ve.added[j].id == id {
+				ve.added[j].cf = cf
+			}
+		}
+	}
+	return ve, nil
+}
+
+// manifestState is the set of live tables and column families recorded
+// by a manifest.
+type manifestState struct {
+	// tables holds the level and column family of every live table.
+	tables map[int]tableLevel
+	// families holds the name of every column family other than the
+	// default.
+	families   map[int]string
+	nextFamily int
+}
+
+func newManifestState() *manifestState {
+	return &manifestState{
+		tables:     make(map[int]tableLevel),
+		families:   make(map[int]string),
+		nextFamily: DEFAULT_COLUMN_FAMILY_ID + 1,
+	}
+}
+
+// apply applies an edit. The tables of a dropped column family are
+// dropped with it, as are any tables added to it afterwards by a flush or
+// compaction that was already running.
+func (ms *manifestState) apply(ve versionEdit) {
+	for _, f := range ve.created {
+		ms.families[f.id] = f.name
+	}
+	ms.nextFamily = max(ms.nextFamily, ve.nextFamily)
+	for _, t := range ve.added {
+		if _, ok := ms.families[t.cf]; ok || t.cf == DEFAULT_COLUMN_FAMILY_ID {
+			ms.tables[t.id] = t
+		}
+	}
+	for _, id := range ve.removed {
+		delete(ms.tables, id)
+	}
+	for _, cf := range ve.dropped {
+		delete(ms.families, cf)
+		for id, t := range ms.tables {
+			if t.cf == cf {
+				delete(ms.tables, id)
+			}
+		}
+	}
+}
+
+// readManifest returns the live tables and column families, and the ID of
+// the manifest they were read from. It reports false if there is no
+// manifest, for directories written before it was added.
+func readManifest(dir string) (*manifestState, int, bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, CURRENT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("unable to read current file: %w", err)
+	}
+
+	name := strings.TrimSpace(string(b))
+	id, err := strconv.Atoi(strings.TrimPrefix(name, MANIFEST_PREFIX))
+	if err != nil || !strings.HasPrefix(name, MANIFEST_PREFIX) {
+		return nil, 0, false, fmt.Errorf("unexpected current file: %q", name)
+	}
+
+	state := newManifestState()
+	// A torn edit was never durable, so its flush or compaction didn't
+	// happen, and the files it added are orphans.
+	_, _, err = readRecords(manifestFile(dir, id), func(payload []byte) error {
+		ve, err := decodeVersionEdit(payload)
+		if err != nil {
+			return err
+		}
+		state.apply(ve)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("unable to read manifest %d: %w", id, err)
+	}
+	return state, id, true, nil
+}
+
+// createManifest writes a new manifest with every live table and column
+// family, and points CURRENT to it.
+func createManifest(dir string, id int, state *manifestState) (*manifest, error) {
+	file, err := os.Create(manifestFile(dir, id))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create manifest: %w", err)
+	}
+	m := &manifest{
+		dir:    dir,
+		id:     id,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+
+	ids := make([]int, 0, len(state.tables))
+	for id := range state.tables {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	cfs := make([]int, 0, len(state.families))
+	for cf := range state.families {
+		cfs = append(cfs, cf)
+	}
+	sort.Ints(cfs)
+
+	ve := versionEdit{nextFamily: state.nextFamily}
+	for _, cf := range cfs {
+		ve.created = append(ve.created, family{id: cf, name: state.families[cf]})
+	}
+	for _, id := range ids {
+		ve.added = append(ve.added, state.tables[id])
+	}
+	if err := m.log(ve); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := setCurrent(dir, id); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// log durably appends an edit to the manifest.
+func (m *manifest) log(ve versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := writeRecord(m.writer, ve.encode()); err != nil {
+		return fmt.Errorf("unable to write version edit: %w", err)
+	}
+	if err := m.writer.Flush(); err != nil {
+		return fmt.Errorf("unable to flush manifest: %w", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync manifest: %w", err)
+	}
+	return nil
+}
+
+func (m *manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
+
+// setCurrent atomically points CURRENT to the manifest, by renaming a
+// temporary file over it.
+func setCurrent(dir string, id int) error {
+	tmp := filepath.Join(dir, CURRENT_FILE+".tmp")
+	contents := fmt.Sprintf("%s%d\n", MANIFEST_PREFIX, id)
+	if err := writeFileSync(tmp, []byte(contents)); err != nil {
+		return fmt.Errorf("unable to write current file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, CURRENT_FILE)); err != nil {
+		return fmt.Errorf("unable to rename current file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+func writeFileSync(path string, b []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes the creation, removal and renaming of files in the
+// directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("unable to sync directory: %w", err)
+	}
+	return nil
+}
+
+// removeOrphans removes the files of every table that isn't live, which
+// are the outputs of flushes and compactions that never took effect and
+// the inputs of compactions that did, along with every old manifest.
+func removeOrphans(dir string, live map[int]tableLevel, manifestID int) ([]string, error) {
+	tableFiles, err := filepath.Glob(filepath.Join(dir, "lsm-*"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to glob table files: %w", err)
+	}
+	manifests, err := filepath.Glob(filepath.Join(dir, MANIFEST_PREFIX+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to glob manifests: %w", err)
+	}
+
+	removed := make([]string, 0)
+	for _, f := range tableFiles {
+		if _, ok := live[getFileID(f)]; ok {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return nil, fmt.Errorf("unable to remove orphaned file: %w", err)
+		}
+		removed = append(removed, filepath.Base(f))
+	}
+	for _, f := range manifests {
+		if f == manifestFile(dir, manifestID) {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return nil, fmt.Errorf("unable to remove old manifest: %w", err)
+		}
+		removed = append(removed, filepath.Base(f))
+	}
+	return removed, nil
+}
+
+func manifestFile(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", MANIFEST_PREFIX, id))
+}
@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrNoMergeOperator is returned by Merge, and by reads of a key with
+// merge operands, if no MergeOperator is set.
+var ErrNoMergeOperator = errors.New("no merge operator set")
+
+// MergeOperator combines the operands written by Merge with the value of
+// their key, such as adding to a counter or appending to a list. Operands
+// are stored as is, and are only applied when the key is read, or by
+// compaction once it has the value they apply to.
+type MergeOperator interface {
+	// Merge applies the operands, from oldest to newest, to the existing
+	// value of the key, which is nil if the key has no value or has been
+	// deleted. The arguments must not be modified.
+	Merge(key string, existing []byte, operands [][]byte) []byte
+}
+
+// Merge writes an operand for the key, which is applied to its value by
+// the MergeOperator when it is read, see WithMergeOperator. Unlike a Get
+// followed by a Put, concurrent merges are never lost.
+func (lt *LSMTree) Merge(key string, operand []byte) error {
+	wb := NewWriteBatch()
+	wb.Merge(key, operand)
+	return lt.Write(wb)
+}
+
+// Merge writes an operand for the key in the column family, see
+// LSMTree.Merge.
+func (cf *ColumnFamily) Merge(key string, operand []byte) error {
+	wb := NewWriteBatch()
+	wb.MergeCF(cf, key, operand)
+	return cf.lt.Write(wb)
+}
+
+// Merge adds a merge operand for the key to the batch.
+func (wb *WriteBatch) Merge(key string, operand []byte) {
+	wb.add(DEFAULT_COLUMN_FAMILY_ID, key, Entry{Value: operand, Kind: KindMerge})
+}
+
+// MergeCF adds a merge operand for the key in a column family to the
+// batch.
+func (wb *WriteBatch) MergeCF(cf *ColumnFamily, key string, operand []byte) {
+	wb.add(cf.id, key, Entry{Value: operand, Kind: KindMerge})
+}
+
+// resolve returns the value of a key given its newest version which isn't
+// a merge operand, if there is one, and the merge operands newer than it
+// from newest to oldest. The operands are reordered.
+func (sm *SSTManager) resolve(key string, base Entry, found bool, operands [][]byte, now time.Time) ([]byte, error) {
+	var existing []byte
+	if found && !base.absent(now) {
+		existing = base.Value
+	}
+	if len(operands) == 0 {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return existing, nil
+	}
+
+	if sm.mergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	slices.Reverse(operands)
+	return sm.mergeOperator.Merge(key, existing, operands), nil
+}
+
+// mergeVersions is given every version of a key in a compaction from
+// newest to oldest, and applies the merge operands to the version below
+// them, if it is a value or tombstone seen by the same snapshots. Without
+// one, they are only applied once nothing older can exist.
+//
+// Expired values must already have been replaced by tombstones, and
+// values that will expire are left alone, since the merged value would
+// expire along with them.
+func (sm *SSTManager) mergeVersions(key string, versions []Entry, snapshots []uint64, bottommost bool) []Entry {
+	if sm.mergeOperator == nil {
+		return versions
+	}
+
+	merged := make([]Entry, 0, len(versions))
+	for i := 0; i < len(versions); {
+		newest := versions[i]
+		if newest.Kind != KindMerge {
+			merged = append(merged, newest)
+			i++
+			continue
+		}
+
+		stripe := stripeOf(snapshots, newest.Seq)
+		j := i
+		operands := make([][]byte, 0)
+		for j < len(versions) && versions[j].Kind == KindMerge && stripeOf(snapshots, versions[j].Seq) == stripe {
+			operands = append(operands, versions[j].Value)
+			j++
+		}
+
+		switch {
+		case j < len(versions) && stripeOf(snapshots, versions[j].Seq) == stripe && versions[j].ExpiresAt == 0:
+			val, _ := sm.resolve(key, versions[j], true, operands, time.Time{})
+			merged = append(merged, Entry{Value: val, Kind: KindValue, Seq: newest.Seq})
+			j++
+		case j == len(versions) && bottommost:
+			val, _ := sm.resolve(key, Entry{}, false, operands, time.Time{})
+			merged = append(merged, Entry{Value: val, Kind: KindValue, Seq: newest.Seq})
+		default:
+			merged = append(merged, versions[i:j]...)
+		}
+		i = j
+	}
+	return merged
+}
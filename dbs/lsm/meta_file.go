@@ -1,16 +1,28 @@
 package lsm
 
 import (
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"os"
 )
 
-// TODO: Combine the meta file data into the data file?
-
 type Meta struct {
-	Level int
-	Items int
+	Level  int
+	Items  int
+	MinKey string
+	MaxKey string
+	// MaxSeq is the highest sequence number of any entry in the table.
+	MaxSeq uint64
+	// Compression is the codec of the data blocks.
+	Compression Compression
+	// PrefixExtractor is the name of the extractor used to build the
+	// prefix filter block, if the table has one.
+	PrefixExtractor string
+	prefixFilter    blockHandle
+	// RecordFormat is the format of the records of a legacy table, see
+	// RECORD_FORMAT_BASE. It is 0 until the table is opened.
+	RecordFormat int
 }
 
 func (m *Meta) Encode(filename string) error {
@@ -24,7 +36,7 @@ func (m *Meta) Encode(filename string) error {
 	if err != nil {
 		return fmt.Errorf("unable to encode metadata: %w", err)
 	}
-	return nil
+	return file.Sync()
 }
 
 func (m *Meta) Decode(filename string) error {
@@ -43,3 +55,79 @@ func (m *Meta) Decode(filename string) error {
 
 	return nil
 }
+
+// marshal encodes the meta block of a table, with every number encoded as
+// a uvarint and every key prefixed by its length, followed by the
+// compression as a single byte. Tables with a prefix filter end with the
+// name of the extractor, and the offset and size of the filter block.
+func (m *Meta) marshal() []byte {
+	b := binary.AppendUvarint(nil, uint64(m.Level))
+	b = binary.AppendUvarint(b, uint64(m.Items))
+	b = binary.AppendUvarint(b, m.MaxSeq)
+	b = binary.AppendUvarint(b, uint64(len(m.MinKey)))
+	b = append(b, m.MinKey...)
+	b = binary.AppendUvarint(b, uint64(len(m.MaxKey)))
+	b = append(b, m.MaxKey...)
+	b = append(b, byte(m.Compression))
+	if m.PrefixExtractor == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(len(m.PrefixExtractor)))
+	b = append(b, m.PrefixExtractor...)
+	b = binary.AppendUvarint(b, m.prefixFilter.offset)
+	return binary.AppendUvarint(b, m.prefixFilter.size)
+}
+
+func (m *Meta) unmarshal(b []byte) error {
+	var nums [3]uint64
+	for i := range nums {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("unable to decode meta block")
+		}
+		nums[i] = v
+		b = b[n:]
+	}
+
+	minKey, b, err := readUvarintBytes(b)
+	if err != nil {
+		return fmt.Errorf("unable to decode min key: %w", err)
+	}
+	maxKey, b, err := readUvarintBytes(b)
+	if err != nil {
+		return fmt.Errorf("unable to decode max key: %w", err)
+	}
+	// Tables written before compression was supported don't record it.
+	compression := CompressionNone
+	if len(b) > 0 {
+		compression = Compression(b[0])
+		b = b[1:]
+	}
+
+	var extractor []byte
+	var prefixFilter blockHandle
+	if len(b) > 0 {
+		if extractor, b, err = readUvarintBytes(b); err != nil {
+			return fmt.Errorf("unable to decode prefix extractor: %w", err)
+		}
+		for _, v := range []*uint64{&prefixFilter.offset, &prefixFilter.size} {
+			n := 0
+			if *v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("unable to decode prefix filter handle")
+			}
+			b = b[n:]
+		}
+	}
+
+	*m = Meta{
+		Level:           int(nums[0]),
+		Items:           int(nums[1]),
+		MaxSeq:          nums[2],
+		MinKey:          string(minKey),
+		MaxKey:          string(maxKey),
+		Compression:     compression,
+		PrefixExtractor: string(extractor),
+		prefixFilter:    prefixFilter,
+	}
+	return nil
+}
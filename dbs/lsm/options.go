@@ -4,6 +4,9 @@ import "time"
 
 type LSMOption func(*LSMTree) *LSMTree
 
+// WithSparseness sets the number of keys between restart points in a
+// block, where a key is stored in full rather than sharing a prefix with
+// the previous key.
 func WithSparseness(n int) LSMOption {
 	return func(l *LSMTree) *LSMTree {
 		l.stm.sparseness = n
@@ -11,6 +14,35 @@ func WithSparseness(n int) LSMOption {
 	}
 }
 
+// WithBlockSize sets the size data blocks are split at.
+func WithBlockSize(size int) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.blockSize = size
+		return l
+	}
+}
+
+// WithCompression sets the codec used to compress the data blocks of new
+// tables. Tables already written keep their codec until compacted.
+func WithCompression(c Compression) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.compression = c
+		return l
+	}
+}
+
+// WithBlockCacheSize sets the size of the cache of blocks read by Get
+// and iterators, shared by every table. A size of 0 disables the cache.
+func WithBlockCacheSize(size int) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.blockCache = nil
+		if size > 0 {
+			l.stm.blockCache = newBlockCache(size)
+		}
+		return l
+	}
+}
+
 func WithErrorPct(pct float64) LSMOption {
 	return func(l *LSMTree) *LSMTree {
 		l.stm.errorPct = pct
@@ -32,9 +64,165 @@ func WithMaxMemTables(max int) LSMOption {
 	}
 }
 
+// WithMemtableFactory sets the function used to create new memtables,
+// NewAATree by default. Writes to a ConcurrentMemtable, such as
+// NewSkipList, are inserted concurrently.
+func WithMemtableFactory(f func() Memtable) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.newMemtable = f
+		return l
+	}
+}
+
 func WithFlushPeriod(period time.Duration) LSMOption {
 	return func(l *LSMTree) *LSMTree {
 		l.flushPeriod = period
 		return l
 	}
 }
+
+// WithWALSyncMode sets when WAL records are fsynced, see SyncMode.
+func WithWALSyncMode(mode SyncMode) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.walSyncMode = mode
+		return l
+	}
+}
+
+// WithWALSyncPeriod sets the fsync interval used by SyncPeriodic.
+func WithWALSyncPeriod(period time.Duration) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.walSyncPeriod = period
+		return l
+	}
+}
+
+// WithCompactionStrategy sets the strategy used to pick compactions,
+// which is a LeveledCompaction by default.
+func WithCompactionStrategy(strategy CompactionStrategy) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.strategy = strategy
+		return l
+	}
+}
+
+// WithMaxTableSize sets the MaxTableSize of the LeveledCompaction, the
+// size at which compaction starts a new table. Like every option of
+// LeveledCompaction, it is applied after every other option, so it also
+// applies to a LeveledCompaction set by WithCompactionStrategy, and
+// NewLSMTree returns an error if another strategy is set.
+func WithMaxTableSize(size int) LSMOption {
+	return withLeveledCompaction(func(lc *LeveledCompaction) {
+		lc.MaxTableSize = size
+	})
+}
+
+// WithLevelBaseSize sets the LevelBaseSize of the LeveledCompaction, the
+// target size of level 1. Every level after that is larger by the level
+// size ratio. See WithMaxTableSize for how it is applied.
+func WithLevelBaseSize(size int) LSMOption {
+	return withLeveledCompaction(func(lc *LeveledCompaction) {
+		lc.LevelBaseSize = size
+	})
+}
+
+// WithLevelSizeRatio sets the LevelSizeRatio of the LeveledCompaction, by
+// which every level after level 1 is larger than the last. See
+// WithMaxTableSize for how it is applied.
+func WithLevelSizeRatio(ratio int) LSMOption {
+	return withLeveledCompaction(func(lc *LeveledCompaction) {
+		lc.LevelSizeRatio = ratio
+	})
+}
+
+// WithL0CompactionTrigger sets the L0CompactionTrigger of the
+// LeveledCompaction, the number of tables in level 0 that triggers a
+// compaction into level 1. See WithMaxTableSize for how it is applied.
+func WithL0CompactionTrigger(n int) LSMOption {
+	return withLeveledCompaction(func(lc *LeveledCompaction) {
+		lc.L0CompactionTrigger = n
+	})
+}
+
+// WithMaxLevels sets the MaxLevels of the LeveledCompaction, the number of
+// levels tables are compacted into. See WithMaxTableSize for how it is
+// applied.
+func WithMaxLevels(n int) LSMOption {
+	return withLeveledCompaction(func(lc *LeveledCompaction) {
+		lc.MaxLevels = n
+	})
+}
+
+// withLeveledCompaction returns an option which modifies the strategy,
+// once every other option has been applied, see applyLeveledOptions.
+func withLeveledCompaction(f func(*LeveledCompaction)) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.leveledOptions = append(l.leveledOptions, f)
+		return l
+	}
+}
+
+// WithMergeOperator sets the operator which applies the operands written
+// by Merge. It must be set whenever the tree has merge operands.
+func WithMergeOperator(op MergeOperator) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.mergeOperator = op
+		return l
+	}
+}
+
+// WithPrefixExtractor sets the extractor used to build the prefix filters
+// of new tables, which iterators with a Prefix use to skip tables. Tables
+// written by a different extractor are never skipped.
+func WithPrefixExtractor(pe PrefixExtractor) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.prefixExtractor = pe
+		return l
+	}
+}
+
+// WithMaxCompactions sets how many compactions can run in the background
+// at once. Compactions with overlapping inputs or the same output level
+// never run at the same time.
+func WithMaxCompactions(n int) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.maxCompactions = n
+		return l
+	}
+}
+
+// WithCompactionProgress sets a callback which is given the progress of
+// every running compaction, every COMPACTION_PROGRESS_INTERVAL bytes read
+// and every time an output table is finished. It is called from the
+// compaction's goroutine, so it must not block, and is called by several
+// compactions at once if WithMaxCompactions allows it.
+func WithCompactionProgress(f func(CompactionProgress)) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.compactionProgress = f
+		return l
+	}
+}
+
+// WithCompactionRateLimit limits the bytes per second written by all
+// compactions together, so they don't starve reads and flushes of I/O. A
+// limit of 0 (the default) disables it.
+func WithCompactionRateLimit(bytesPerSec int) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.limiter = nil
+		if bytesPerSec > 0 {
+			l.stm.limiter = newRateLimiter(bytesPerSec)
+		}
+		return l
+	}
+}
+
+// WithWriteStallTriggers sets the number of tables in level 0 at which
+// writes are slowed down, and at which they are stopped until compaction
+// catches up. A trigger of 0 is disabled.
+func WithWriteStallTriggers(slowdown, stop int) LSMOption {
+	return func(l *LSMTree) *LSMTree {
+		l.stm.l0SlowdownTrigger = slowdown
+		l.stm.l0StopTrigger = stop
+		return l
+	}
+}
@@ -0,0 +1,41 @@
+package lsm
+
+import "fmt"
+
+// PrefixExtractor maps keys to the prefix they are grouped by, such as a
+// user ID at the start of every key of that user. New tables get a bloom
+// filter of the prefixes of their keys, which lets iterators with a
+// Prefix skip tables without any matching keys.
+//
+// Prefix must return a prefix of the key, or false if the key has none.
+// Every key starting with a string that has a prefix must have the same
+// prefix, so that the keys an iterator with that Prefix can return all
+// share it.
+type PrefixExtractor interface {
+	// Name identifies the extractor, and is stored in every table so that
+	// filters built by a different extractor are never used.
+	Name() string
+	Prefix(key string) (string, bool)
+}
+
+// fixedPrefix extracts the first n bytes of keys of at least n bytes.
+type fixedPrefix struct {
+	n int
+}
+
+// NewFixedPrefixExtractor returns a PrefixExtractor for the first n
+// bytes of every key. Shorter keys have no prefix.
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return fixedPrefix{n: n}
+}
+
+func (fp fixedPrefix) Name() string {
+	return fmt.Sprintf("fixed:%d", fp.n)
+}
+
+func (fp fixedPrefix) Prefix(key string) (string, bool) {
+	if len(key) < fp.n {
+		return "", false
+	}
+	return key[:fp.n], true
+}
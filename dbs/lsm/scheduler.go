@@ -0,0 +1,270 @@
+package lsm
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WRITE_SLOWDOWN is how long each write is delayed once level 0 reaches
+// the slowdown trigger.
+const WRITE_SLOWDOWN = 1 * time.Millisecond
+
+var errCompactionCancelled = errors.New("compaction cancelled")
+
+// Compactions picked by the strategy run in the background, up to
+// maxCompactions at a time, whenever a table is added or a compaction
+// finishes. The inputs of running compactions are reserved, and a
+// compaction is only started if none of its inputs are reserved and no
+// running compaction writes to the same level of the same column family.
+// Otherwise it waits until the conflicting compaction finishes.
+
+// Compact runs compactions until the compaction strategy has nothing
+// left to compact, waiting for any background compactions it conflicts
+// with.
+func (sm *SSTManager) Compact() {
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
+
+	for !sm.closed {
+		c, conflict := sm.pickCompactionLocked()
+		if c == nil {
+			if !conflict {
+				return
+			}
+			sm.compactCond.Wait()
+			continue
+		}
+
+		sm.compactMu.Unlock()
+		ok := sm.runCompaction(c)
+		sm.compactMu.Lock()
+		sm.finishCompactionLocked(c)
+		if !ok {
+			return
+		}
+	}
+}
+
+func (sm *SSTManager) triggerCompaction() {
+	select {
+	case sm.compactTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// compactInBackground schedules compactions whenever it is triggered,
+// until the SSTManager is closed.
+func (sm *SSTManager) compactInBackground() {
+	defer close(sm.compactorDone)
+	for {
+		select {
+		case <-sm.closing:
+			sm.logger.Info("background compaction goroutine closed")
+			return
+		case <-sm.compactTrigger:
+			sm.scheduleCompactions()
+		}
+	}
+}
+
+// scheduleCompactions starts compactions until either maxCompactions are
+// running, or there is nothing left that can be compacted.
+func (sm *SSTManager) scheduleCompactions() {
+	sm.compactMu.Lock()
+	defer sm.compactMu.Unlock()
+
+	for !sm.closed && sm.running < sm.maxCompactions {
+		c, _ := sm.pickCompactionLocked()
+		if c == nil {
+			return
+		}
+
+		sm.running++
+		sm.runningWG.Add(1)
+		go func() {
+			defer sm.runningWG.Done()
+			ok := sm.runCompaction(c)
+
+			sm.compactMu.Lock()
+			sm.running--
+			sm.finishCompactionLocked(c)
+			sm.compactMu.Unlock()
+
+			// A failed compaction is retried once another table is added,
+			// rather than immediately.
+			if ok {
+				sm.triggerCompaction()
+			}
+		}()
+	}
+}
+
+// pickCompactionLocked expects the caller to hold compactMu. It returns
+// the first compaction picked by the strategy for any column family with
+// its inputs reserved, or nil if there is none or every one conflicts
+// with a running compaction, which is reported.
+func (sm *SSTManager) pickCompactionLocked() (*Compaction, bool) {
+	sm.mu.RLock()
+	cfs := make([]int, 0, len(sm.families))
+	for cf, ts := range sm.families {
+		if !ts.dropped {
+			cfs = append(cfs, cf)
+		}
+	}
+	sm.mu.RUnlock()
+	sort.Ints(cfs)
+
+	conflict := false
+	for _, cf := range cfs {
+		c, conflicts := sm.pickFamilyLocked(cf)
+		if c != nil {
+			return c, false
+		}
+		conflict = conflict || conflicts
+	}
+	return nil, conflict
+}
+
+func (sm *SSTManager) pickFamilyLocked(cf int) (*Compaction, bool) {
+	sm.mu.RLock()
+	ts, ok := sm.families[cf]
+	if !ok || ts.dropped {
+		sm.mu.RUnlock()
+		return nil, false
+	}
+	c := sm.strategy.Pick(ts.ssTables)
+	if c != nil && len(c.Inputs) > 0 {
+		c.bottommost = isBottommost(ts.ssTables, c)
+		c.Inputs = oldestFirst(ts.ssTables, c)
+		c.cf = cf
+	}
+	sm.mu.RUnlock()
+
+	if c == nil || len(c.Inputs) == 0 {
+		return nil, false
+	}
+	if sm.outputLevels[familyLevel{cf: cf, level: c.OutputLevel}] {
+		return nil, true
+	}
+	for _, t := range c.Inputs {
+		if sm.compacting[t.ID] {
+			return nil, true
+		}
+	}
+
+	for _, t := range c.Inputs {
+		sm.compacting[t.ID] = true
+	}
+	sm.outputLevels[familyLevel{cf: cf, level: c.OutputLevel}] = true
+	return c, false
+}
+
+// finishCompactionLocked expects the caller to hold compactMu, and
+// releases the inputs of a compaction whether or not it succeeded.
+func (sm *SSTManager) finishCompactionLocked(c *Compaction) {
+	for _, t := range c.Inputs {
+		delete(sm.compacting, t.ID)
+	}
+	delete(sm.outputLevels, familyLevel{cf: c.cf, level: c.OutputLevel})
+	sm.compactCond.Broadcast()
+}
+
+// throttleWrites delays a write while level 0 of any column family has at
+// least l0SlowdownTrigger tables, and blocks it while it has at least
+// l0StopTrigger tables, so that compaction can catch up. A trigger of 0
+// is disabled.
+func (sm *SSTManager) throttleWrites() error {
+	n := sm.l0Tables()
+	slowdown := sm.l0SlowdownTrigger > 0 && n >= sm.l0SlowdownTrigger
+	stop := sm.l0StopTrigger > 0 && n >= sm.l0StopTrigger
+	if !slowdown && !stop {
+		return nil
+	}
+	start := time.Now()
+	sm.stats.stalls.Add(1)
+	defer func() {
+		sm.stats.stallNanos.Add(int64(time.Since(start)))
+	}()
+
+	if slowdown {
+		time.Sleep(WRITE_SLOWDOWN)
+	}
+	if !stop {
+		return nil
+	}
+
+	sm.logger.Warn("writes stopped until level 0 is compacted", "tables", n)
+	sm.stallMu.Lock()
+	defer sm.stallMu.Unlock()
+	for sm.l0Tables() >= sm.l0StopTrigger {
+		select {
+		case <-sm.closing:
+			return ErrClosed
+		default:
+		}
+		sm.stallCond.Wait()
+	}
+	return nil
+}
+
+// wakeStalledWrites is called whenever level 0 may have shrunk.
+func (sm *SSTManager) wakeStalledWrites() {
+	sm.stallMu.Lock()
+	sm.stallCond.Broadcast()
+	sm.stallMu.Unlock()
+}
+
+// l0Tables returns the most tables in level 0 of any column family.
+func (sm *SSTManager) l0Tables() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	n := 0
+	for _, ts := range sm.families {
+		n = max(n, len(ts.ssTables[0]))
+	}
+	return n
+}
+
+// rateLimiter limits the rate of compaction writes with a token bucket,
+// which holds at most one second worth of bytes.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes can be written, or cancel is closed. Tokens
+// are taken up front, so concurrent callers queue behind each other.
+func (rl *rateLimiter) wait(n int, cancel <-chan struct{}) error {
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens = min(rl.tokens+now.Sub(rl.last).Seconds()*rl.rate, rl.rate)
+	rl.last = now
+	rl.tokens -= float64(n)
+	delay := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-cancel:
+		return errCompactionCancelled
+	}
+}
@@ -0,0 +1,27 @@
+package lsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(1000)
+
+	// The bucket starts full.
+	start := time.Now()
+	assert.Nil(t, rl.wait(1000, nil))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	assert.Nil(t, rl.wait(300, nil))
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	cancel := make(chan struct{})
+	close(cancel)
+	start = time.Now()
+	assert.ErrorIs(t, rl.wait(1000, cancel), errCompactionCancelled)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
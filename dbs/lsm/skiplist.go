@@ -0,0 +1,152 @@
+package lsm
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	SKIPLIST_MAX_HEIGHT = 16
+	// SKIPLIST_BRANCHING is the inverse of the probability that a node
+	// is given another level.
+	SKIPLIST_BRANCHING = 4
+)
+
+const SKIPNODE_SIZE = uint32(unsafe.Sizeof(skipNode{}))
+
+// SkipList is a Memtable which allows concurrent inserts and reads
+// without any locks. Every version of a key is its own node, ordered by
+// key and then from newest to oldest, so an insert only ever links in a
+// new node and never modifies an existing one.
+//
+// A node is inserted from the bottom level up, and each level is linked
+// in with a compare-and-swap, which is retried from the same predecessor
+// if another insert got there first. Once a node is linked into the bottom
+// level it is visible to readers, and the higher levels only speed up
+// searches.
+type SkipList struct {
+	head   *skipNode
+	height atomic.Int32
+	size   atomic.Int64
+	nodes  atomic.Int64
+}
+
+type skipNode struct {
+	key   string
+	entry Entry
+	next  []atomic.Pointer[skipNode]
+}
+
+func NewSkipList() *SkipList {
+	sl := &SkipList{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], SKIPLIST_MAX_HEIGHT)},
+	}
+	sl.height.Store(1)
+	return sl
+}
+
+// ConcurrentInserts reports that Insert may be called concurrently.
+func (sl *SkipList) ConcurrentInserts() bool {
+	return true
+}
+
+func (sl *SkipList) Size() int {
+	return int(sl.size.Load())
+}
+
+func (sl *SkipList) Nodes() int {
+	return int(sl.nodes.Load())
+}
+
+// Find returns the newest version of the key with a sequence number at
+// or below seq.
+func (sl *SkipList) Find(key string, seq uint64) (Entry, bool) {
+	x := sl.head
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		x, _ = sl.findSplice(x, level, key, seq)
+	}
+
+	n := x.next[0].Load()
+	if n == nil || n.key != key {
+		return Entry{}, false
+	}
+	return n.entry, true
+}
+
+// Insert adds a new version of the key. Versions of the same key may be
+// inserted concurrently and in any order, but must have distinct sequence
+// numbers.
+func (sl *SkipList) Insert(key string, e Entry) {
+	height := randomHeight()
+	n := &skipNode{
+		key:   key,
+		entry: e,
+		next:  make([]atomic.Pointer[skipNode], height),
+	}
+
+	listHeight := sl.height.Load()
+	for int(listHeight) < height {
+		if sl.height.CompareAndSwap(listHeight, int32(height)) {
+			break
+		}
+		listHeight = sl.height.Load()
+	}
+
+	// Find the predecessor and successor of the node on every level, from
+	// the top down. Levels above the old height start from the head.
+	var prev, next [SKIPLIST_MAX_HEIGHT]*skipNode
+	x := sl.head
+	for level := max(int(listHeight), height) - 1; level >= 0; level-- {
+		x, next[level] = sl.findSplice(x, level, key, e.Seq)
+		prev[level] = x
+	}
+
+	for level := 0; level < height; level++ {
+		for {
+			n.next[level].Store(next[level])
+			if prev[level].next[level].CompareAndSwap(next[level], n) {
+				break
+			}
+			prev[level], next[level] = sl.findSplice(prev[level], level, key, e.Seq)
+		}
+	}
+
+	sl.size.Add(int64(len(key) + len(e.Value) + int(SKIPNODE_SIZE)))
+	sl.nodes.Add(1)
+}
+
+// Traverse calls f for every version of every key in order, and for the
+// versions of a key from newest to oldest. Versions inserted during the
+// traversal may or may not be included.
+func (sl *SkipList) Traverse(f func(k string, e Entry)) {
+	for n := sl.head.next[0].Load(); n != nil; n = n.next[0].Load() {
+		f(n.key, n.entry)
+	}
+}
+
+// findSplice walks the level from x, and returns the last node which
+// comes before the version of the key, and the node after it.
+func (sl *SkipList) findSplice(x *skipNode, level int, key string, seq uint64) (*skipNode, *skipNode) {
+	for {
+		n := x.next[level].Load()
+		if n == nil || !n.before(key, seq) {
+			return x, n
+		}
+		x = n
+	}
+}
+
+// before reports whether the node is ordered before the version of the
+// key, so versions of a key are ordered from newest to oldest.
+func (n *skipNode) before(key string, seq uint64) bool {
+	return n.key < key || (n.key == key && n.entry.Seq > seq)
+}
+
+func randomHeight() int {
+	h := 1
+	for h < SKIPLIST_MAX_HEIGHT && rand.N(SKIPLIST_BRANCHING) == 0 {
+		h++
+	}
+	return h
+}
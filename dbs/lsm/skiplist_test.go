@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipList(t *testing.T) {
+	sl := NewSkipList()
+	aa := NewAATree()
+
+	for seq := uint64(1); seq <= 10_000; seq++ {
+		k := fmt.Sprintf("%d", rand.Intn(1_000))
+		e := Entry{Value: []byte(fmt.Sprint(seq)), Seq: seq}
+		sl.Insert(k, e)
+		aa.Insert(k, e)
+	}
+
+	for range 1_000 {
+		k := fmt.Sprintf("%d", rand.Intn(1_100))
+		seq := uint64(rand.Intn(10_001))
+		e1, ok1 := sl.Find(k, seq)
+		e2, ok2 := aa.Find(k, seq)
+		assert.Equal(t, ok2, ok1)
+		assert.Equal(t, e2, e1)
+	}
+
+	type version struct {
+		k string
+		e Entry
+	}
+	var v1, v2 []version
+	sl.Traverse(func(k string, e Entry) { v1 = append(v1, version{k, e}) })
+	aa.Traverse(func(k string, e Entry) { v2 = append(v2, version{k, e}) })
+	assert.Equal(t, v2, v1)
+	assert.Equal(t, 10_000, sl.Nodes())
+}
+
+func TestSkipListConcurrentInserts(t *testing.T) {
+	sl := NewSkipList()
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 5_000 {
+				seq := uint64(w*5_000 + i + 1)
+				sl.Insert(fmt.Sprintf("%d", rand.Intn(1_000)), Entry{Seq: seq})
+				sl.Find(fmt.Sprintf("%d", rand.Intn(1_000)), seq)
+			}
+		}()
+	}
+	wg.Wait()
+
+	keys := make([]string, 0)
+	seqs := make(map[uint64]bool)
+	sl.Traverse(func(k string, e Entry) {
+		keys = append(keys, fmt.Sprintf("%s/%020d", k, ^e.Seq))
+		seqs[e.Seq] = true
+	})
+	assert.Len(t, keys, 40_000)
+	assert.Len(t, seqs, 40_000)
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, 40_000, sl.Nodes())
+}
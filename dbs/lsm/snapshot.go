@@ -0,0 +1,144 @@
+package lsm
+
+import (
+	"iter"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Snapshot is a read-only view of the LSMTree at the time it was taken.
+// Versions it can see are kept by compaction until it is released.
+type Snapshot struct {
+	lt      *LSMTree
+	seq     uint64
+	release sync.Once
+}
+
+// Snapshot returns a view which only sees writes made before it.
+func (lt *LSMTree) Snapshot() *Snapshot {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+
+	seq := lt.visible.Load()
+	lt.stm.snapshots.acquire(seq)
+	return &Snapshot{lt: lt, seq: seq}
+}
+
+// Get returns the value of the key at the time of the snapshot, or
+// ErrNotFound if the key didn't exist or had been deleted.
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	return s.lt.get(s.lt.defaultFamily, key, s.seq)
+}
+
+// NewIterator returns an iterator over the keys at the time of the
+// snapshot matching the options.
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	it := s.lt.NewIterator(opts)
+	it.snapshot = s
+	return it
+}
+
+// Scan is the same as LSMTree.Scan, at the time of the snapshot.
+func (s *Snapshot) Scan(start, end string) iter.Seq2[string, []byte] {
+	return s.NewIterator(IteratorOptions{Start: start, End: end}).All()
+}
+
+// Release allows compaction to drop the versions only the snapshot could
+// see. The snapshot must not be used afterwards.
+func (s *Snapshot) Release() {
+	s.release.Do(func() {
+		s.lt.stm.snapshots.release(s.seq)
+	})
+}
+
+// snapshotList counts the live snapshots at each sequence number.
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{seqs: make(map[uint64]int)}
+}
+
+func (sl *snapshotList) acquire(seq uint64) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.seqs[seq]++
+}
+
+func (sl *snapshotList) release(seq uint64) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.seqs[seq]--
+	if sl.seqs[seq] == 0 {
+		delete(sl.seqs, seq)
+	}
+}
+
+// sorted returns the sequence numbers of live snapshots in ascending order.
+func (sl *snapshotList) sorted() []uint64 {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(sl.seqs))
+	for seq := range sl.seqs {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	return seqs
+}
+
+// versionFilter decides which versions are kept when writing a table. It
+// must be given every version in key order, and then from newest to
+// oldest.
+//
+// A snapshot only sees the newest version at or below its sequence
+// number, so of the versions between two consecutive snapshots, only the
+// newest is kept, along with any older versions it is a merge operand of.
+type versionFilter struct {
+	snapshots []uint64
+	// bottommost allows dropping tombstones, see Compaction.
+	bottommost bool
+
+	prevKey    string
+	prevStripe int
+	first      bool
+	// merging is set while every version kept in the stripe is a merge
+	// operand, which doesn't hide older versions.
+	merging bool
+}
+
+func newVersionFilter(snapshots []uint64, bottommost bool) *versionFilter {
+	return &versionFilter{
+		snapshots:  snapshots,
+		bottommost: bottommost,
+		first:      true,
+	}
+}
+
+// stripeOf returns the index of the oldest snapshot that can see a
+// version, given the snapshots in ascending order.
+func stripeOf(snapshots []uint64, seq uint64) int {
+	return sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+}
+
+func (vf *versionFilter) keep(key string, e Entry) bool {
+	stripe := stripeOf(vf.snapshots, e.Seq)
+	shadowed := !vf.first && key == vf.prevKey && stripe == vf.prevStripe && !vf.merging
+	vf.prevKey, vf.prevStripe, vf.first = key, stripe, false
+
+	if shadowed {
+		return false
+	}
+	vf.merging = e.Kind == KindMerge
+	// A tombstone seen by every snapshot hides every older version, so it
+	// can be dropped once no older version can exist further down.
+	if e.Kind == KindDelete && vf.bottommost && stripe == 0 {
+		return false
+	}
+	return true
+}
@@ -72,7 +72,7 @@ func (si *SparseIndex) Encode(filename string) error {
 	if err != nil {
 		return fmt.Errorf("unable to encode sparse index: %w", err)
 	}
-	return nil
+	return file.Sync()
 }
 
 func (si *SparseIndex) Decode(filename string) error {
@@ -1,18 +1,18 @@
 package lsm
 
 import (
-	"bufio"
-	"bytes"
 	"container/heap"
 	"crumbs/bloom"
+	"errors"
 	"fmt"
-	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/exp/slog"
 )
@@ -26,421 +26,831 @@ type SSTManager struct {
 	logger *slog.Logger
 
 	dir       string
-	ssTables  [][]SSTable
 	ssCounter int
 	bytesPool sync.Pool
 
+	// families holds the tables of each column family, which share every
+	// other part of the SSTManager.
+	families   map[int]*tableSet
+	nextFamily int
+
+	// snapshots hold versions that must survive flushes and compactions.
+	snapshots *snapshotList
+
+	// blockCache is shared by every table, and is nil if disabled.
+	blockCache *blockCache
+
+	// manifest records every change to the set of live tables, and is
+	// opened by Load.
+	manifest *manifest
+
+	// Compactions are run in the background or when triggered manually,
+	// see scheduler.go.
+	compactMu      sync.Mutex
+	compactCond    *sync.Cond
+	compacting     map[int]bool
+	outputLevels   map[familyLevel]bool
+	running        int
+	runningWG      sync.WaitGroup
+	compactTrigger chan struct{}
+	compactorDone  chan struct{}
+	closing        chan struct{}
+	closed         bool
+	limiter        *rateLimiter
+
+	// Writes are stalled while level 0 has too many tables.
+	stallMu   sync.Mutex
+	stallCond *sync.Cond
+
+	stats dbStats
+
 	// Options.
-	sparseness int
-	errorPct   float64
+	sparseness        int
+	blockSize         int
+	compression       Compression
+	errorPct          float64
+	strategy          CompactionStrategy
+	mergeOperator     MergeOperator
+	prefixExtractor   PrefixExtractor
+	maxCompactions    int
+	l0SlowdownTrigger int
+	l0StopTrigger     int
+
+	// compactionProgress is called with the progress of every compaction.
+	compactionProgress func(CompactionProgress)
 }
 
 type SSTMOptions struct {
-	sparseness int
-	errorPct   float64
+	sparseness          int
+	blockSize           int
+	compression         Compression
+	blockCacheSize      int
+	errorPct            float64
+	strategy            CompactionStrategy
+	maxCompactions      int
+	compactionRateLimit int
+	l0SlowdownTrigger   int
+	l0StopTrigger       int
+}
+
+// tableSet holds the levels of tables of a column family.
+type tableSet struct {
+	name     string
+	ssTables [][]SSTable
+	// disjoint is set for levels whose tables cover disjoint key ranges,
+	// which is never the case for level 0.
+	disjoint []bool
+	// dropped is set once the column family is being dropped, so no more
+	// compactions are started.
+	dropped bool
+}
+
+func newTableSet(name string) *tableSet {
+	return &tableSet{
+		name:     name,
+		ssTables: [][]SSTable{make([]SSTable, 0)},
+		disjoint: make([]bool, 1),
+	}
 }
 
+type familyLevel struct {
+	cf    int
+	level int
+}
+
+// SSTable is an immutable table on disk. Tables in level 0 may overlap
+// and are kept in the order they were flushed, while tables in every
+// other level are kept sorted by key.
+//
+// The records of a table are read in chunks, which are found with the
+// index, see table.go for the format.
 type SSTable struct {
 	ID       int
 	FileSize int
+	// DataSize is the size of the records at the start of the file.
+	DataSize int
+	Format   int
 
 	Meta        *Meta
 	Index       *SparseIndex
 	BloomFilter *bloom.BloomFilterV2
-	DataFile    *os.File
+	// PrefixFilter is a bloom filter of the prefixes of every key, built
+	// by the PrefixExtractor named in Meta, if there was one.
+	PrefixFilter *bloom.BloomFilterV2
+	DataFile     *os.File
+
+	// refs counts the holders of the table, which is the SSTManager
+	// while the table is live, and any iterators reading from it. The
+	// data file is closed once there are none left.
+	refs *atomic.Int32
+}
+
+func (ss SSTable) ref() {
+	ss.refs.Add(1)
+}
+
+func (ss SSTable) unref() {
+	if ss.refs.Add(-1) == 0 {
+		ss.DataFile.Close()
+	}
+}
+
+func newRefs() *atomic.Int32 {
+	refs := &atomic.Int32{}
+	refs.Store(1)
+	return refs
 }
 
 func NewSSTManager(dir string, logger *slog.Logger, opts SSTMOptions) *SSTManager {
 	sm := &SSTManager{
-		dir:      dir,
-		ssTables: make([][]SSTable, 1),
+		dir: dir,
 		bytesPool: sync.Pool{New: func() any {
 			return new([]byte)
 		}},
-		sparseness: opts.sparseness,
-		errorPct:   opts.errorPct,
-		logger:     logger,
+		families: map[int]*tableSet{
+			DEFAULT_COLUMN_FAMILY_ID: newTableSet(DEFAULT_COLUMN_FAMILY),
+		},
+		nextFamily:        DEFAULT_COLUMN_FAMILY_ID + 1,
+		snapshots:         newSnapshotList(),
+		compacting:        make(map[int]bool),
+		outputLevels:      make(map[familyLevel]bool),
+		compactTrigger:    make(chan struct{}, 1),
+		compactorDone:     make(chan struct{}),
+		closing:           make(chan struct{}),
+		sparseness:        opts.sparseness,
+		blockSize:         opts.blockSize,
+		compression:       opts.compression,
+		errorPct:          opts.errorPct,
+		strategy:          opts.strategy,
+		maxCompactions:    opts.maxCompactions,
+		l0SlowdownTrigger: opts.l0SlowdownTrigger,
+		l0StopTrigger:     opts.l0StopTrigger,
+		logger:            logger,
+	}
+	sm.compactCond = sync.NewCond(&sm.compactMu)
+	sm.stallCond = sync.NewCond(&sm.stallMu)
+	if opts.blockCacheSize > 0 {
+		sm.blockCache = newBlockCache(opts.blockCacheSize)
+	}
+	if opts.compactionRateLimit > 0 {
+		sm.limiter = newRateLimiter(opts.compactionRateLimit)
 	}
-	sm.ssTables[0] = make([]SSTable, 0)
 	return sm
 }
 
-// Add adds and writes a memtable to disk as a SSTable. And requires
-// that the memtable is not the active (most recent) memtable.
-func (sm *SSTManager) Add(mt Memtable) error {
-	sm.mu.Lock()
-	curCounter := sm.ssCounter
-	sm.ssCounter++
-	sm.mu.Unlock()
-
-	dataPath := filepath.Join(sm.dir, fmt.Sprintf("lsm-%d.data", curCounter))
-	dataFile, err := os.OpenFile(dataPath, WR_FLAGS, 0644)
-	if err != nil {
-		return fmt.Errorf("unable to flush: %w", err)
+// Add adds and writes a memtable of a column family to disk as a
+// SSTable. And requires that the memtable is not the active (most
+// recent) memtable.
+func (sm *SSTManager) Add(cf int, mt Memtable) error {
+	if mt.Nodes() == 0 {
+		return nil
 	}
-	bw := bufferedWriter{bufio.NewWriterSize(dataFile, 1024*64)}
-	defer bw.Flush()
 
-	si := NewSparseIndex()
-	bf, err := bloom.NewBloomFilterV2(mt.Nodes(), sm.errorPct)
+	tb, err := sm.newTableBuilder(sm.nextID(), 0)
 	if err != nil {
-		return fmt.Errorf("unable to create bloom filter: %w", err)
+		return fmt.Errorf("unable to flush: %w", err)
 	}
-	meta := &Meta{Items: mt.Nodes()}
-
-	offset := 0
-	iter := 0
-	mt.Traverse(func(k string, v []byte) {
-		// TODO: Maybe exit early on fail?
-		n, _ := bw.writeKeyVal(k, v)
-		bf.Add([]byte(k))
 
-		if iter%sm.sparseness == 0 {
-			si.Append(recordOffset{Key: k, Offset: offset})
+	// Memtables may hold versions of a key that no snapshot can see.
+	vf := newVersionFilter(sm.snapshots.sorted(), false)
+	mt.Traverse(func(k string, e Entry) {
+		if err == nil && vf.keep(k, e) {
+			err = tb.add(k, e)
 		}
-
-		offset += n
-		iter++
 	})
+	if err != nil {
+		return fmt.Errorf("unable to write memtable: %w", err)
+	}
 
-	err = encodeFiles(sm.dir, curCounter, meta, si, bf)
+	// The table must be durable before the caller releases the WAL segment.
+	table, err := tb.finish()
 	if err != nil {
-		return fmt.Errorf("unable to encode compacted files: %w", err)
+		return fmt.Errorf("unable to finish table: %w", err)
+	}
+	if err := sm.manifest.log(versionEdit{added: []tableLevel{{id: table.ID, level: 0, cf: cf}}}); err != nil {
+		table.DataFile.Close()
+		removeTableFiles(sm.dir, table.ID)
+		return fmt.Errorf("unable to add table to manifest: %w", err)
 	}
 
+	// The column family may have been dropped while flushing.
 	sm.mu.Lock()
-	sm.ssTables[0] = append(sm.ssTables[0], SSTable{
-		ID:          curCounter,
-		FileSize:    offset,
-		Meta:        meta,
-		Index:       si,
-		BloomFilter: bf,
-		DataFile:    dataFile,
-	})
+	ts, ok := sm.families[cf]
+	if ok {
+		ts.ssTables[0] = append(ts.ssTables[0], table)
+	}
 	sm.mu.Unlock()
+	if !ok {
+		table.unref()
+		removeTableFiles(sm.dir, table.ID)
+		return nil
+	}
+	sm.stats.flushes.Add(1)
+	sm.stats.flushBytes.Add(int64(table.FileSize))
 
+	sm.triggerCompaction()
 	return nil
 }
 
-func (sm *SSTManager) Find(key string) ([]byte, error) {
+// Find returns the newest version of the key in a column family with a
+// sequence number at or below seq, if there is one.
+func (sm *SSTManager) Find(cf int, key string, seq uint64) (Entry, bool, error) {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	for _, level := range sm.ssTables {
-		for _, ss := range level {
-			b, found, err := sm.findInSSTable(ss, key)
+	ts, ok := sm.families[cf]
+	if !ok {
+		return Entry{}, false, nil
+	}
+
+	// Tables in level 0 may overlap, so search from newest to oldest.
+	for i := len(ts.ssTables[0]) - 1; i >= 0; i-- {
+		kvp, found, err := sm.findInSSTable(ts.ssTables[0][i], key, seq)
+		if err != nil {
+			return Entry{}, false, fmt.Errorf("unable to search in SSTables: %w", err)
+		}
+		if found {
+			return kvp.Entry, true, nil
+		}
+	}
+
+	for i, level := range ts.ssTables[1:] {
+		for _, ss := range ts.tablesContaining(i+1, level, key) {
+			kvp, found, err := sm.findInSSTable(ss, key, seq)
 			if err != nil {
-				return nil, fmt.Errorf("unable to search in SSTables: %w", err)
+				return Entry{}, false, fmt.Errorf("unable to search in SSTables: %w", err)
 			}
 			if found {
-				return b, nil
+				return kvp.Entry, true, nil
 			}
 		}
 	}
 
-	return nil, nil
+	return Entry{}, false, nil
 }
 
+// MaxSeq returns the highest sequence number of any table.
+func (sm *SSTManager) MaxSeq() uint64 {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var seq uint64
+	for _, ts := range sm.families {
+		for _, level := range ts.ssTables {
+			for _, t := range level {
+				seq = max(seq, t.Meta.MaxSeq)
+			}
+		}
+	}
+	return seq
+}
+
+// tablesContaining returns the tables in a level (other than level 0)
+// whose key range contains the key, from newest to oldest. If the level
+// is disjoint, this is at most one table.
+func (ts *tableSet) tablesContaining(levelIdx int, level []SSTable, key string) []SSTable {
+	if ts.disjoint[levelIdx] {
+		i := sort.Search(len(level), func(i int) bool {
+			return level[i].Meta.MaxKey >= key
+		})
+		if i == len(level) || level[i].Meta.MinKey > key {
+			return nil
+		}
+		return level[i : i+1]
+	}
+
+	tables := overlappingTables(level, key, key)
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].ID > tables[j].ID
+	})
+	return tables
+}
+
+// Load opens every live table and column family recorded in the
+// manifest, in either format, and removes every other table file.
+// Directories written before the manifest was added have every table in
+// the directory opened into the default column family instead.
 func (sm *SSTManager) Load() error {
+	state, manifestID, found, err := readManifest(sm.dir)
+	if err != nil {
+		return fmt.Errorf("unable to load manifest: %w", err)
+	}
 	ssFiles, err := getFiles(sm.dir)
 	if err != nil {
 		return fmt.Errorf("unable to load sstables: %w", err)
 	}
 
-	for i := range ssFiles.dataFiles {
-		meta := &Meta{}
-		if err := meta.Decode(ssFiles.metaFiles[i]); err != nil {
-			return fmt.Errorf("unable to open meta file: %w", err)
+	formats := make(map[int]int)
+	for i, id := range ssFiles.ids {
+		formats[id] = ssFiles.formats[i]
+	}
+	ids := ssFiles.ids
+	if found {
+		ids = make([]int, 0, len(state.tables))
+		for id := range state.tables {
+			ids = append(ids, id)
 		}
-
-		df, err := os.Open(ssFiles.dataFiles[i])
-		if err != nil {
-			return fmt.Errorf("unable to open data file: %w", err)
+		sort.Ints(ids)
+		for cf, name := range state.families {
+			sm.families[cf] = newTableSet(name)
 		}
+		sm.nextFamily = state.nextFamily
+	}
 
-		fi, err := os.Stat(ssFiles.dataFiles[i])
+	live := make(map[int]tableLevel)
+	for _, id := range ids {
+		format, ok := formats[id]
+		if !ok {
+			return fmt.Errorf("table %d listed in the manifest has no file", id)
+		}
+		table, err := loadTable(sm.dir, id, format)
 		if err != nil {
-			return fmt.Errorf("unable to stat data file: %w", err)
+			return fmt.Errorf("unable to open table %d: %w", id, err)
 		}
 
-		sparseIndex := NewSparseIndex()
-		if err = sparseIndex.Decode(ssFiles.indexFiles[i]); err != nil {
-			return fmt.Errorf("unable to decode sparse index: %w", err)
+		t := tableLevel{id: id, level: table.Meta.Level}
+		if found {
+			t = state.tables[id]
 		}
+		live[id] = t
+		ts := sm.families[t.cf]
+		ts.ensureLevels(t.level)
+		ts.ssTables[t.level] = append(ts.ssTables[t.level], table)
+	}
 
-		bf, _ := bloom.NewBloomFilterV2(1, 1)
-		if err = bf.Decode(ssFiles.bloomFiles[i]); err != nil {
-			return fmt.Errorf("unable to decode bloom filter: %w", err)
+	// Level 0 is already sorted by ID, but the other levels are sorted by key.
+	for _, ts := range sm.families {
+		for i := 1; i < len(ts.ssTables); i++ {
+			ts.sortLevel(i)
 		}
+	}
 
-		for meta.Level >= len(sm.ssTables) {
-			sm.ssTables = append(sm.ssTables, make([]SSTable, 0))
+	if n := len(ids); n > 0 {
+		sm.ssCounter = ids[n-1] + 1
+	}
+
+	// The new manifest must be current before anything it doesn't list
+	// is removed.
+	newID := 0
+	if found {
+		newID = manifestID + 1
+	}
+	newState := newManifestState()
+	newState.tables, newState.nextFamily = live, sm.nextFamily
+	for cf, ts := range sm.families {
+		if cf != DEFAULT_COLUMN_FAMILY_ID {
+			newState.families[cf] = ts.name
 		}
-		sm.ssTables[meta.Level] = append(sm.ssTables[meta.Level], SSTable{
-			ID:          ssFiles.ids[i],
-			FileSize:    int(fi.Size()),
-			DataFile:    df,
-			Index:       sparseIndex,
-			BloomFilter: bf,
-		})
 	}
+	sm.manifest, err = createManifest(sm.dir, newID, newState)
+	if err != nil {
+		return fmt.Errorf("unable to create manifest: %w", err)
+	}
+	removed, err := removeOrphans(sm.dir, live, newID)
+	if err != nil {
+		return fmt.Errorf("unable to remove orphaned files: %w", err)
+	}
+	if len(removed) > 0 {
+		sm.logger.Info("removed orphaned files", "files", removed)
+	}
+	return nil
+}
+
+// Close stops the background compactor, cancelling any in-progress
+// compactions, and closes the manifest.
+func (sm *SSTManager) Close() error {
+	sm.compactMu.Lock()
+	sm.closed = true
+	sm.compactCond.Broadcast()
+	sm.compactMu.Unlock()
 
-	n := len(ssFiles.dataFiles)
-	if n == 0 {
+	close(sm.closing)
+	<-sm.compactorDone
+	sm.runningWG.Wait()
+	sm.wakeStalledWrites()
+
+	if sm.manifest == nil {
 		return nil
 	}
-	sm.ssCounter = ssFiles.ids[len(ssFiles.ids)-1] + 1
-
-	return nil
+	return sm.manifest.Close()
 }
 
-// Compact calls a more fine-grained compactTables under the hood.
-// After Compact is called, we guarantee that
-//   - the SSTable counter is incremented if compaction occurs
-//   - that writeable is set to false so sm.Add operations will raise
-//     the appropriate errors while compacting
+// runCompaction expects the inputs to be reserved by pickCompaction, so
+// no other compaction can read or remove them. The input tables can then
+// be read without holding any lock, and we only need the lock to swap the
+// tables at the end.
 //
-// We only acquire RLock during compaction to allow for concurrent reads.
-// Once we are finished, we acquire a lock to first add the new table,
-// then remove stale tables.
-func (sm *SSTManager) Compact() {
-	sm.mu.Lock()
-	if len(sm.ssTables[0]) > 0 {
-		newID := sm.ssCounter
-		sm.ssCounter++
-		sm.mu.Unlock()
-
-		sm.logger.Info("compaction: in progress")
-
-		sm.mu.RLock()
-		// TODO: temporary.
-		toCompact := sm.ssTables[0]
-		newTable := sm.compactTables(newID, toCompact)
-		sm.mu.RUnlock()
-
-		sm.logger.Info("compaction: finished creating new table")
-
-		// Lock and make updates to table.
-		sm.mu.Lock()
-		if len(sm.ssTables) <= newTable.Meta.Level {
-			sm.ssTables = append(sm.ssTables, make([]SSTable, 0))
-		}
-		sm.ssTables[newTable.Meta.Level] = append(
-			sm.ssTables[newTable.Meta.Level],
-			newTable,
-		)
-
-		// TODO: temporary.
-		sm.ssTables[0] = make([]SSTable, 0)
-		sm.mu.Unlock()
-
-		for _, t := range toCompact {
-			pattern := filepath.Join(sm.dir, fmt.Sprintf("lsm-%d.*", t.ID))
-			toRemove, err := filepath.Glob(pattern)
-			if err != nil {
-				sm.logger.Error("unable to glob stale files", err)
-				continue
-			}
-			for _, f := range toRemove {
-				os.Remove(f)
-			}
+// It reports whether the compaction succeeded.
+func (sm *SSTManager) runCompaction(c *Compaction) bool {
+	start := time.Now()
+	sm.logger.Info(
+		"compaction: in progress",
+		"tablesToCompact", len(c.Inputs),
+		"outputLevel", c.OutputLevel,
+	)
+
+	newTables, err := sm.compactTables(c)
+	if errors.Is(err, errCompactionCancelled) {
+		sm.logger.Info("compaction: cancelled")
+		return false
+	}
+	if err != nil {
+		sm.logger.Error("compaction: failed", "error", err)
+		return false
+	}
+
+	sm.logger.Info("compaction: finished creating new tables")
+
+	// The compaction takes effect once the edit is durable, and its inputs
+	// can only be removed afterwards.
+	var ve versionEdit
+	for _, t := range c.Inputs {
+		ve.removed = append(ve.removed, t.ID)
+	}
+	for _, t := range newTables {
+		ve.added = append(ve.added, tableLevel{id: t.ID, level: c.OutputLevel, cf: c.cf})
+	}
+	if err := sm.manifest.log(ve); err != nil {
+		sm.logger.Error("compaction: failed", "error", err)
+		for _, t := range newTables {
+			t.DataFile.Close()
+			removeTableFiles(sm.dir, t.ID)
 		}
+		return false
+	}
 
-		sm.logger.Info(
-			"compaction: finished",
-			"tablesCompacted", len(toCompact),
-			"newTableLevel", newTable.Meta.Level,
-		)
-		return
+	// Lock and make updates to table. The column family can't be dropped
+	// while it is being compacted, see DropFamily.
+	sm.mu.Lock()
+	ts := sm.families[c.cf]
+	ts.ensureLevels(c.OutputLevel)
+	stale := c.tableIDs()
+	for level := range ts.ssTables {
+		ts.ssTables[level] = removeTables(ts.ssTables[level], stale)
+	}
+	ts.ssTables[c.OutputLevel] = append(ts.ssTables[c.OutputLevel], newTables...)
+	for level := 1; level < len(ts.ssTables); level++ {
+		ts.sortLevel(level)
 	}
 	sm.mu.Unlock()
+	sm.wakeStalledWrites()
+
+	// Files can still be read by open iterators after being removed.
+	for _, t := range c.Inputs {
+		t.unref()
+		if err := removeTableFiles(sm.dir, t.ID); err != nil {
+			sm.logger.Error("unable to remove stale files", "error", err)
+		}
+	}
+
+	sm.stats.compactions.Add(1)
+	sm.stats.compactionNanos.Add(int64(time.Since(start)))
+	for _, t := range c.Inputs {
+		sm.stats.compactionBytesRead.Add(int64(t.FileSize))
+	}
+	for _, t := range newTables {
+		sm.stats.compactionBytesWritten.Add(int64(t.FileSize))
+	}
+
+	sm.logger.Info(
+		"compaction: finished",
+		"tablesCompacted", len(c.Inputs),
+		"newTables", len(newTables),
+		"newTableLevel", c.OutputLevel,
+	)
+	return true
 }
 
-func (sm *SSTManager) compactTables(newID int, tables []SSTable) SSTable {
-	kfh := make(KeyFileHeap, len(tables))
-	level := tables[0].Meta.Level
-	totalItems := 0
+// compactTables expects the inputs to be ordered from oldest to newest,
+// so that ties are broken in favour of the newest table. It removes any
+// tables it has written if it fails.
+func (sm *SSTManager) compactTables(c *Compaction) (_ []SSTable, err error) {
+	tables := c.Inputs
+	progress := newCompactionProgress(c, sm.compactionProgress)
 
+	// Inputs are streamed, so memory is bounded by the readahead buffer and
+	// current chunk of each input, and the output table being built.
+	kfh := make(KeyFileHeap, 0, len(tables))
 	for i, t := range tables {
-		// TODO: For better memory performance, don't load the whole chunk,
-		// load smaller ones (maybe like every X intervals?).
-		chunk, _ := readChunk(t.DataFile, 0, t.FileSize)
-		buf := bytes.NewBuffer(chunk)
-
-		kvp, _, _ := readKeyVal(buf)
-		kfh[i] = KeyFile{
+		cursor := newTableCursor(t, progress)
+		kvp, ok, err := cursor.next()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read table %d: %w", t.ID, err)
+		}
+		if !ok {
+			continue
+		}
+		kfh = append(kfh, KeyFile{
 			Key:     string(kvp.key),
-			Value:   kvp.value,
+			Entry:   kvp.Entry,
 			FileIdx: i, // NOTE: this file does not represent the FileID.
-			Reader:  buf,
-		}
-		totalItems += t.Meta.Items
+			Cursor:  cursor,
+		})
 	}
 	heap.Init(&kfh)
 
-	dataPath := filepath.Join(sm.dir, fmt.Sprintf("lsm-%d.data", newID))
-	dataFile, err := os.OpenFile(dataPath, WR_FLAGS, 0644)
-	if err != nil {
-		sm.logger.Error("unable to open data file for compaction", err)
-		return SSTable{}
-	}
-	bw := bufferedWriter{bufio.NewWriterSize(dataFile, 1024*64)}
-	defer bw.Flush()
-
-	si := NewSparseIndex()
-	bf, err := bloom.NewBloomFilterV2(totalItems, sm.errorPct)
-	if err != nil {
-		sm.logger.Error("unable to create bloom filter", err)
-		return SSTable{}
+	newTables := make([]SSTable, 0)
+	var tb *tableBuilder
+	defer func() {
+		if err == nil {
+			return
+		}
+		if tb != nil {
+			newTables = append(newTables, SSTable{ID: tb.id, DataFile: tb.file})
+		}
+		for _, t := range newTables {
+			t.DataFile.Close()
+			removeTableFiles(sm.dir, t.ID)
+		}
+	}()
+	snapshots := sm.snapshots.sorted()
+	vf := newVersionFilter(snapshots, c.bottommost)
+	now := time.Now()
+
+	writeVersions := func(key string, versions []Entry) error {
+		for _, e := range sm.mergeVersions(key, versions, snapshots, c.bottommost) {
+			if !vf.keep(key, e) {
+				continue
+			}
+			// Only start a new table on key boundaries.
+			if tb != nil && c.MaxTableSize > 0 && tb.estimatedSize() >= c.MaxTableSize && tb.meta.MaxKey != key {
+				table, err := tb.finish()
+				if err != nil {
+					return fmt.Errorf("unable to finish table: %w", err)
+				}
+				newTables = append(newTables, table)
+				tb = nil
+				progress.finishTable(table)
+			}
+			if tb == nil {
+				var err error
+				tb, err = sm.newTableBuilder(sm.nextID(), c.OutputLevel)
+				if err != nil {
+					return fmt.Errorf("unable to create table: %w", err)
+				}
+				tb.limiter, tb.cancel = sm.limiter, sm.closing
+			}
+			if err := tb.add(key, e); err != nil {
+				return fmt.Errorf("unable to write to table: %w", err)
+			}
+		}
+		return nil
 	}
 
-	meta := &Meta{Level: level + 1, Items: totalItems}
-	sparseness := int(math.Pow(float64(sm.sparseness), float64(level+2)))
-
-	offset := 0
-	iter := 0
-	prevKeyFile := KeyFile{}
+	// Every version of a key is collected before any are written, so that
+	// merge operands can be applied to the versions below them.
+	var key string
+	versions := make([]Entry, 0)
 
 	for len(kfh) > 0 {
+		select {
+		case <-sm.closing:
+			return nil, errCompactionCancelled
+		default:
+		}
 		keyFile := heap.Pop(&kfh).(KeyFile)
 
-		if keyFile.Key != prevKeyFile.Key && string(keyFile.Value) != "" {
-			if iter%sparseness == 0 {
-				si.Append(recordOffset{
-					Key:    string(prevKeyFile.Key),
-					Offset: offset,
-				})
+		if len(versions) > 0 && keyFile.Key != key {
+			if err := writeVersions(key, versions); err != nil {
+				return nil, err
 			}
+			versions = versions[:0]
+		}
+		key = keyFile.Key
 
-			n, _ := bw.writeKeyVal(prevKeyFile.Key, prevKeyFile.Value)
-			bf.Add([]byte(prevKeyFile.Key))
-
-			offset += n
-			iter++
+		// An expired value still hides older versions of its key, so it is
+		// kept as a tombstone until it can be dropped like one.
+		e := keyFile.Entry
+		if e.expired(now) {
+			e = Entry{Kind: KindDelete, Seq: e.Seq}
 		}
+		versions = append(versions, e)
 
-		prevKeyFile = keyFile
-		if keyFile.Reader.Len() == 0 {
+		kvp, ok, err := keyFile.Cursor.next()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read table: %w", err)
+		}
+		progress.maybeReport(tb)
+		if !ok {
 			continue
 		}
-		kvp, _, _ := readKeyVal(keyFile.Reader)
 		heap.Push(&kfh, KeyFile{
 			Key:     string(kvp.key),
-			Value:   kvp.value,
+			Entry:   kvp.Entry,
 			FileIdx: keyFile.FileIdx,
-			Reader:  keyFile.Reader,
+			Cursor:  keyFile.Cursor,
 		})
 	}
+	if len(versions) > 0 {
+		if err := writeVersions(key, versions); err != nil {
+			return nil, err
+		}
+	}
 
-	// We need to remember to do the last one.
-	n, _ := bw.writeKeyVal(prevKeyFile.Key, prevKeyFile.Value)
-	bf.Add([]byte(prevKeyFile.Key))
-	offset += n
+	if tb != nil {
+		table, err := tb.finish()
+		if err != nil {
+			return nil, fmt.Errorf("unable to finish table: %w", err)
+		}
+		newTables = append(newTables, table)
+		progress.finishTable(table)
+	}
+	progress.done()
+	return newTables, nil
+}
 
-	err = encodeFiles(sm.dir, newID, meta, si, bf)
-	if err != nil {
-		sm.logger.Error("unable to encode compacted files", err)
-		return SSTable{}
+// refTables returns a copy of every level of a column family, and takes
+// a reference on every table which must be released with unrefTables.
+func (sm *SSTManager) refTables(cf int) ([][]SSTable, []bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	ts, ok := sm.families[cf]
+	if !ok {
+		return nil, nil
+	}
+	levels := make([][]SSTable, len(ts.ssTables))
+	for i, level := range ts.ssTables {
+		levels[i] = append([]SSTable{}, level...)
+		for _, t := range level {
+			t.ref()
+		}
 	}
+	return levels, append([]bool{}, ts.disjoint...)
+}
 
-	return SSTable{
-		ID:          newID,
-		FileSize:    offset,
-		Meta:        meta,
-		Index:       si,
-		BloomFilter: bf,
-		DataFile:    dataFile,
+func unrefTables(levels [][]SSTable) {
+	for _, level := range levels {
+		for _, t := range level {
+			t.unref()
+		}
 	}
 }
 
-// findInSSTable expects caller to acquire read lock on SSTables.
-func (sm *SSTManager) findInSSTable(ss SSTable, key string) ([]byte, bool, error) {
-	if ss.BloomFilter != nil && !ss.BloomFilter.In([]byte(key)) {
-		return nil, false, nil
+// ensureLevels expects the caller to acquire a lock on SSTables.
+func (ts *tableSet) ensureLevels(level int) {
+	for len(ts.ssTables) <= level {
+		ts.ssTables = append(ts.ssTables, make([]SSTable, 0))
+		ts.disjoint = append(ts.disjoint, true)
 	}
+}
+
+// sortLevel expects the caller to acquire a lock on SSTables.
+func (ts *tableSet) sortLevel(level int) {
+	tables := ts.ssTables[level]
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Meta.MinKey < tables[j].Meta.MinKey
+	})
+	ts.disjoint[level] = isDisjoint(tables)
+}
+
+func (sm *SSTManager) nextID() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := sm.ssCounter
+	sm.ssCounter++
+	return id
+}
 
-	offset, maxOffset := ss.Index.GetOffsets(key)
-	if maxOffset < 0 {
-		maxOffset = ss.FileSize
+// findInSSTable expects caller to acquire read lock on SSTables.
+func (sm *SSTManager) findInSSTable(ss SSTable, key string, seq uint64) (keyValue, bool, error) {
+	if ss.BloomFilter != nil {
+		sm.stats.bloomChecks.Add(1)
+		if !ss.BloomFilter.In([]byte(key)) {
+			sm.stats.bloomUseful.Add(1)
+			return keyValue{}, false, nil
+		}
 	}
 
-	chunkB := *sm.bytesPool.Get().(*[]byte)
-	if cap(chunkB) < maxOffset-offset {
-		chunkB = make([]byte, maxOffset-offset)
+	i := ss.chunkFor(key)
+	if i < 0 {
+		return keyValue{}, false, nil
 	}
-	chunkB = chunkB[:maxOffset-offset]
-	defer sm.bytesPool.Put(&chunkB)
 
-	chunk, err := readChunkWithBuffer(ss.DataFile, offset, chunkB)
+	var chunk []byte
+	var err error
+	if sm.blockCache != nil {
+		chunk, err = sm.cachedChunk(ss, i)
+	} else {
+		chunkB := sm.bytesPool.Get().(*[]byte)
+		defer sm.bytesPool.Put(chunkB)
+
+		chunk, err = sm.readChunk(ss, i, *chunkB)
+		*chunkB = chunk
+	}
 	if err != nil {
-		return nil, false, fmt.Errorf("unable to read chunk: %w", err)
+		return keyValue{}, false, fmt.Errorf("unable to read chunk: %w", err)
 	}
-	buf := bytes.NewBuffer(chunk)
 
-	for buf.Len() > 0 {
-		kvp, _, err := readKeyVal(buf)
-		if err != nil {
-			return nil, false, fmt.Errorf("unable to find in SSTable: %w", err)
-		}
-		if key == string(kvp.key) {
-			return kvp.value, true, nil
-		}
+	kvp, found, err := ss.findInChunk(i, chunk, key, seq)
+	if err != nil {
+		return keyValue{}, false, fmt.Errorf("unable to find in SSTable: %w", err)
 	}
-
-	return nil, false, nil
+	if !found && ss.BloomFilter != nil {
+		sm.stats.bloomFalsePositives.Add(1)
+	}
+	return kvp, found, nil
 }
 
-type ssFiles struct {
-	ids        []int
-	metaFiles  []string
-	dataFiles  []string
-	indexFiles []string
-	bloomFiles []string
+// readChunk is the same as SSTable.readChunk, but counts the bytes read.
+func (sm *SSTManager) readChunk(ss SSTable, i int, buf []byte) ([]byte, error) {
+	start, end := ss.chunkBounds(i)
+	sm.stats.bytesRead.Add(int64(end - start))
+	return ss.readChunk(i, buf)
 }
 
-func encodeFiles(dir string, id int, meta *Meta, si *SparseIndex, bf *bloom.BloomFilterV2) error {
-	metaPath := filepath.Join(dir, fmt.Sprintf("lsm-%d.meta", id))
-	indexPath := filepath.Join(dir, fmt.Sprintf("lsm-%d.index", id))
-	bloomPath := filepath.Join(dir, fmt.Sprintf("lsm-%d.bloom", id))
+// cachedChunk returns a chunk of the table from the block cache, reading
+// it from disk on a miss. The chunk must not be modified.
+func (sm *SSTManager) cachedChunk(ss SSTable, i int) ([]byte, error) {
+	offset := ss.Index.Index[i].Offset
+	if chunk, ok := sm.blockCache.get(ss.ID, offset); ok {
+		return chunk, nil
+	}
 
-	if err := si.Encode(indexPath); err != nil {
-		return fmt.Errorf("unable to flush sparse index: %w", err)
+	chunk, err := sm.readChunk(ss, i, nil)
+	if err != nil {
+		return nil, err
 	}
-	if err := bf.Encode(bloomPath); err != nil {
-		return fmt.Errorf("unable to flush bloom filter: %w", err)
+	sm.blockCache.add(ss.ID, offset, chunk)
+	return chunk, nil
+}
+
+// loadChunk is the same as SSTable.loadChunk, but reads through the block
+// cache if there is one.
+func (sm *SSTManager) loadChunk(ss SSTable, i int) ([]keyValue, error) {
+	var chunk []byte
+	var err error
+	if sm.blockCache != nil {
+		chunk, err = sm.cachedChunk(ss, i)
+	} else {
+		chunk, err = sm.readChunk(ss, i, nil)
 	}
-	if err := meta.Encode(metaPath); err != nil {
-		return fmt.Errorf("unable to flush metadata: %w", err)
+	if err != nil {
+		return nil, err
 	}
+	return ss.decodeChunk(i, chunk)
+}
 
+func removeTableFiles(dir string, id int) error {
+	toRemove, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("lsm-%d.*", id)))
+	if err != nil {
+		return fmt.Errorf("unable to glob table files: %w", err)
+	}
+	for _, f := range toRemove {
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("unable to remove table file: %w", err)
+		}
+	}
 	return nil
 }
 
+func removeTables(tables []SSTable, ids map[int]bool) []SSTable {
+	kept := make([]SSTable, 0, len(tables))
+	for _, t := range tables {
+		if !ids[t.ID] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+type ssFiles struct {
+	ids     []int
+	formats []int
+}
+
+// getFiles returns the ID and format of every table in the directory,
+// sorted by ID. Legacy tables are found by their meta file.
 func getFiles(dir string) (ssFiles, error) {
+	tableFiles, err := filepath.Glob(filepath.Join(dir, "lsm-*.sst"))
+	if err != nil {
+		return ssFiles{}, fmt.Errorf("unable to glob table files: %w", err)
+	}
 	metaFiles, err := filepath.Glob(filepath.Join(dir, "lsm-*.meta"))
 	if err != nil {
 		return ssFiles{}, fmt.Errorf("unable to glob meta files: %w", err)
 	}
 
-	dataFiles := make([]string, len(metaFiles))
-	indexFiles := make([]string, len(metaFiles))
-	bloomFiles := make([]string, len(metaFiles))
-
-	sortedIDs := getSortedFileIDs(metaFiles)
-	for i, id := range sortedIDs {
-		metaFiles[i] = filepath.Join(dir, fmt.Sprintf("lsm-%d.meta", id))
-		dataFiles[i] = filepath.Join(dir, fmt.Sprintf("lsm-%d.data", id))
-		indexFiles[i] = filepath.Join(dir, fmt.Sprintf("lsm-%d.index", id))
-		bloomFiles[i] = filepath.Join(dir, fmt.Sprintf("lsm-%d.bloom", id))
+	formats := make(map[int]int)
+	for _, id := range getSortedFileIDs(tableFiles) {
+		formats[id] = TABLE_FORMAT_BLOCK
+	}
+	for _, id := range getSortedFileIDs(metaFiles) {
+		formats[id] = TABLE_FORMAT_LEGACY
 	}
 
-	return ssFiles{
-		ids:        sortedIDs,
-		metaFiles:  metaFiles,
-		dataFiles:  dataFiles,
-		indexFiles: indexFiles,
-		bloomFiles: bloomFiles,
-	}, nil
+	files := ssFiles{
+		ids:     make([]int, 0, len(formats)),
+		formats: make([]int, 0, len(formats)),
+	}
+	for id := range formats {
+		files.ids = append(files.ids, id)
+	}
+	sort.Ints(files.ids)
+	for _, id := range files.ids {
+		files.formats = append(files.formats, formats[id])
+	}
+	return files, nil
 }
 
 func getSortedFileIDs(files []string) []int {
@@ -454,7 +864,7 @@ func getSortedFileIDs(files []string) []int {
 
 func getFileID(file string) int {
 	re := regexp.MustCompile("[0-9]+")
-	match := re.FindString(file)
+	match := re.FindString(filepath.Base(file))
 	id, _ := strconv.Atoi(match)
 	return id
 }
@@ -0,0 +1,233 @@
+package lsm
+
+import (
+	"crumbs/cache/lru"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a summary of the LSMTree at the time it is returned, where
+// every count is since it was opened. Every column family is included.
+type Stats struct {
+	// Levels holds the tables in each level.
+	Levels []LevelStats
+	// Memtables is the number of memtables, including those waiting to be
+	// flushed, and MemtableSize is their total size.
+	Memtables    int
+	MemtableSize int
+
+	// BloomFilterChecks is the number of times a bloom filter was checked
+	// by Get. It was useful when the key wasn't in it, so the table wasn't
+	// read, and a false positive when the table had no visible version.
+	BloomFilterChecks         int64
+	BloomFilterUseful         int64
+	BloomFilterFalsePositives int64
+
+	// BytesIngested is the size of the keys and values written.
+	BytesIngested int64
+	// BytesRead is the size of the blocks read from tables by Get and
+	// iterators, excluding reads served by the block cache.
+	BytesRead  int64
+	WALBytes   int64
+	BlockCache lru.Stats
+
+	Flushes                int64
+	FlushBytes             int64
+	Compactions            int64
+	CompactionTime         time.Duration
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// WriteAmplification is the number of bytes written to the WAL and
+	// tables for each byte ingested.
+	WriteAmplification float64
+
+	// Stalls is the number of writes slowed down or stopped while level 0
+	// had too many tables, and StallTime is the total time they waited.
+	Stalls    int64
+	StallTime time.Duration
+}
+
+type LevelStats struct {
+	Tables int
+	Size   int64
+}
+
+// dbStats counts the events reported by Stats.
+type dbStats struct {
+	bytesIngested atomic.Int64
+	bytesRead     atomic.Int64
+	walBytes      atomic.Int64
+
+	bloomChecks         atomic.Int64
+	bloomUseful         atomic.Int64
+	bloomFalsePositives atomic.Int64
+
+	flushes                atomic.Int64
+	flushBytes             atomic.Int64
+	compactions            atomic.Int64
+	compactionNanos        atomic.Int64
+	compactionBytesRead    atomic.Int64
+	compactionBytesWritten atomic.Int64
+
+	stalls     atomic.Int64
+	stallNanos atomic.Int64
+}
+
+// Stats returns the tables and memtables of the LSMTree, and counts of
+// its reads, writes, flushes and compactions.
+func (lt *LSMTree) Stats() Stats {
+	ds := &lt.stm.stats
+	s := Stats{
+		BloomFilterChecks:         ds.bloomChecks.Load(),
+		BloomFilterUseful:         ds.bloomUseful.Load(),
+		BloomFilterFalsePositives: ds.bloomFalsePositives.Load(),
+		BytesIngested:             ds.bytesIngested.Load(),
+		BytesRead:                 ds.bytesRead.Load(),
+		WALBytes:                  ds.walBytes.Load(),
+		BlockCache:                lt.BlockCacheStats(),
+		Flushes:                   ds.flushes.Load(),
+		FlushBytes:                ds.flushBytes.Load(),
+		Compactions:               ds.compactions.Load(),
+		CompactionTime:            time.Duration(ds.compactionNanos.Load()),
+		CompactionBytesRead:       ds.compactionBytesRead.Load(),
+		CompactionBytesWritten:    ds.compactionBytesWritten.Load(),
+		Stalls:                    ds.stalls.Load(),
+		StallTime:                 time.Duration(ds.stallNanos.Load()),
+	}
+	if s.BytesIngested > 0 {
+		written := s.WALBytes + s.FlushBytes + s.CompactionBytesWritten
+		s.WriteAmplification = float64(written) / float64(s.BytesIngested)
+	}
+
+	lt.mu.RLock()
+	for _, cf := range lt.families {
+		for _, mt := range cf.tables {
+			s.Memtables++
+			s.MemtableSize += mt.Size()
+		}
+	}
+	lt.mu.RUnlock()
+
+	lt.stm.mu.RLock()
+	for _, ts := range lt.stm.families {
+		for len(s.Levels) < len(ts.ssTables) {
+			s.Levels = append(s.Levels, LevelStats{})
+		}
+		for i, level := range ts.ssTables {
+			for _, t := range level {
+				s.Levels[i].Tables++
+				s.Levels[i].Size += int64(t.FileSize)
+			}
+		}
+	}
+	lt.stm.mu.RUnlock()
+	return s
+}
+
+// Property returns the value of a named property, or false if there is
+// no such property. The supported properties are
+//
+//   - "lsm.stats": every field of Stats, one per line
+//   - "lsm.levelstats": the number of tables and size of each level
+//   - "lsm.num-files-at-level<N>": the number of tables in level N
+//   - "lsm.num-memtables": the number of memtables
+//   - "lsm.cur-size-all-mem-tables": the total size of the memtables
+//   - "lsm.estimate-num-keys": the number of versions in every table and
+//     memtable, which overcounts keys with several versions
+//   - "lsm.column-families": the name of every column family
+func (lt *LSMTree) Property(name string) (string, bool) {
+	if n, ok := strings.CutPrefix(name, "lsm.num-files-at-level"); ok {
+		level, err := strconv.Atoi(n)
+		if err != nil || level < 0 {
+			return "", false
+		}
+		s := lt.Stats()
+		if level >= len(s.Levels) {
+			return "0", true
+		}
+		return strconv.Itoa(s.Levels[level].Tables), true
+	}
+
+	switch name {
+	case "lsm.stats":
+		return lt.Stats().String(), true
+	case "lsm.levelstats":
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%-5s %6s %12s\n", "Level", "Files", "Size")
+		for i, level := range lt.Stats().Levels {
+			fmt.Fprintf(&sb, "%-5d %6d %12d\n", i, level.Tables, level.Size)
+		}
+		return sb.String(), true
+	case "lsm.num-memtables":
+		return strconv.Itoa(lt.Stats().Memtables), true
+	case "lsm.cur-size-all-mem-tables":
+		return strconv.Itoa(lt.Stats().MemtableSize), true
+	case "lsm.estimate-num-keys":
+		return strconv.Itoa(lt.estimateNumKeys()), true
+	case "lsm.column-families":
+		return strings.Join(lt.ColumnFamilies(), "\n"), true
+	}
+	return "", false
+}
+
+func (s Stats) String() string {
+	var sb strings.Builder
+	for i, level := range s.Levels {
+		fmt.Fprintf(&sb, "level %d: %d tables, %d bytes\n", i, level.Tables, level.Size)
+	}
+
+	fields := []struct {
+		name  string
+		value any
+	}{
+		{"memtables", s.Memtables},
+		{"memtable size", s.MemtableSize},
+		{"bloom filter checks", s.BloomFilterChecks},
+		{"bloom filter useful", s.BloomFilterUseful},
+		{"bloom filter false positives", s.BloomFilterFalsePositives},
+		{"bytes ingested", s.BytesIngested},
+		{"bytes read", s.BytesRead},
+		{"WAL bytes", s.WALBytes},
+		{"block cache hits", s.BlockCache.Hits},
+		{"block cache misses", s.BlockCache.Misses},
+		{"block cache evictions", s.BlockCache.Evicted},
+		{"flushes", s.Flushes},
+		{"flush bytes", s.FlushBytes},
+		{"compactions", s.Compactions},
+		{"compaction time", s.CompactionTime},
+		{"compaction bytes read", s.CompactionBytesRead},
+		{"compaction bytes written", s.CompactionBytesWritten},
+		{"write amplification", fmt.Sprintf("%.2f", s.WriteAmplification)},
+		{"stalls", s.Stalls},
+		{"stall time", s.StallTime},
+	}
+	for _, f := range fields {
+		fmt.Fprintf(&sb, "%s: %v\n", f.name, f.value)
+	}
+	return sb.String()
+}
+
+func (lt *LSMTree) estimateNumKeys() int {
+	n := 0
+	lt.mu.RLock()
+	for _, cf := range lt.families {
+		for _, mt := range cf.tables {
+			n += mt.Nodes()
+		}
+	}
+	lt.mu.RUnlock()
+
+	lt.stm.mu.RLock()
+	for _, ts := range lt.stm.families {
+		for _, level := range ts.ssTables {
+			for _, t := range level {
+				n += t.Meta.Items
+			}
+		}
+	}
+	lt.stm.mu.RUnlock()
+	return n
+}
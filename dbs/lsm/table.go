@@ -0,0 +1,433 @@
+package lsm
+
+import (
+	"bytes"
+	"crumbs/bloom"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Tables are written in a single file with the following layout
+//
+//	+--------------+-----+--------------+--------------+------------+-------------+--------+
+//	| Data block 0 | ... | Data block N | Filter block | Meta block | Index block | Footer |
+//	+--------------+-----+--------------+--------------+------------+-------------+--------+
+//
+// Data blocks are roughly the configured block size, see blockBuilder.
+// The filter block is a bloom filter of every key, the meta block holds
+// the Meta of the table, and the index block holds the first key and
+// offset of every data block. Tables written with a PrefixExtractor also
+// have a prefix filter block after the filter block, which the meta block
+// points to. The footer has a fixed size, and holds the
+// offset and size of the other blocks, followed by the format version
+// and a magic number.
+//
+// Every block is followed by a CRC32C checksum of its contents (after
+// compression) as a u32, which is included in its size. Tables written
+// before checksums were added are still read without them.
+//
+// Tables used to be written as four files (data, index, bloom and meta),
+// which can still be read but are no longer written.
+const (
+	TABLE_FORMAT_LEGACY    = 0
+	TABLE_FORMAT_BLOCK     = 1
+	TABLE_FORMAT_BLOCK_CRC = 2
+
+	TABLE_MAGIC   uint64 = 0x4c534d5441424c45 // "LSMTABLE"
+	FOOTER_SIZE          = 3*16 + 4 + 8
+	CHECKSUM_SIZE        = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption is returned when part of a table fails its checksum, or
+// can't be decoded.
+type ErrCorruption struct {
+	TableID int
+	// Offset is the start of the corrupted block in the table file, or
+	// of the corrupted chunk for legacy tables.
+	Offset int
+	Err    error
+}
+
+func (e ErrCorruption) Error() string {
+	return fmt.Sprintf("table %d is corrupted at offset %d: %v", e.TableID, e.Offset, e.Err)
+}
+
+func (e ErrCorruption) Unwrap() error {
+	return e.Err
+}
+
+// checkBlock verifies the checksum at the end of a block, and returns the
+// block without it.
+func checkBlock(b []byte) ([]byte, error) {
+	if len(b) < CHECKSUM_SIZE {
+		return nil, fmt.Errorf("block is too short: %d bytes", len(b))
+	}
+	n := len(b) - CHECKSUM_SIZE
+	if want, got := binary.LittleEndian.Uint32(b[n:]), crc32.Checksum(b[:n], crcTable); want != got {
+		return nil, fmt.Errorf("checksum mismatch: got %08x, want %08x", got, want)
+	}
+	return b[:n], nil
+}
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type footer struct {
+	filter  blockHandle
+	meta    blockHandle
+	index   blockHandle
+	version uint32
+}
+
+func (f footer) marshal() []byte {
+	b := make([]byte, 0, FOOTER_SIZE)
+	for _, h := range []blockHandle{f.filter, f.meta, f.index} {
+		b = binary.LittleEndian.AppendUint64(b, h.offset)
+		b = binary.LittleEndian.AppendUint64(b, h.size)
+	}
+	b = binary.LittleEndian.AppendUint32(b, TABLE_FORMAT_BLOCK_CRC)
+	return binary.LittleEndian.AppendUint64(b, TABLE_MAGIC)
+}
+
+// decodeFooter decodes the footer of a table file of the given size.
+func decodeFooter(b []byte, fileSize int) (footer, error) {
+	if len(b) != FOOTER_SIZE {
+		return footer{}, fmt.Errorf("unexpected footer size: %d", len(b))
+	}
+	if magic := binary.LittleEndian.Uint64(b[FOOTER_SIZE-8:]); magic != TABLE_MAGIC {
+		return footer{}, fmt.Errorf("unexpected magic number: %x", magic)
+	}
+
+	var f footer
+	for i, h := range []*blockHandle{&f.filter, &f.meta, &f.index} {
+		h.offset = binary.LittleEndian.Uint64(b[i*16:])
+		h.size = binary.LittleEndian.Uint64(b[i*16+8:])
+		if h.offset+h.size > uint64(fileSize-FOOTER_SIZE) {
+			return footer{}, fmt.Errorf("block at %d of size %d is out of bounds", h.offset, h.size)
+		}
+	}
+	f.version = binary.LittleEndian.Uint32(b[48:])
+	if f.version != TABLE_FORMAT_BLOCK && f.version != TABLE_FORMAT_BLOCK_CRC {
+		return footer{}, fmt.Errorf("unsupported format version: %d", f.version)
+	}
+	return f, nil
+}
+
+// encodeIndex encodes the index as a block, with the offset of each data
+// block as a uvarint value.
+func encodeIndex(si *SparseIndex) []byte {
+	bb := newBlockBuilder(DEFAULT_SPARSENESS)
+	for _, ro := range si.Index {
+		bb.add(ro.Key, Entry{Value: binary.AppendUvarint(nil, uint64(ro.Offset))})
+	}
+	return bb.finish()
+}
+
+func decodeIndex(b []byte) (*SparseIndex, error) {
+	blk, err := newBlock(b)
+	if err != nil {
+		return nil, err
+	}
+	kvps, err := blk.all()
+	if err != nil {
+		return nil, err
+	}
+
+	si := NewSparseIndex()
+	for _, kvp := range kvps {
+		offset, n := binary.Uvarint(kvp.Value)
+		if n <= 0 {
+			return nil, fmt.Errorf("unable to decode offset of %s", kvp.key)
+		}
+		si.Append(recordOffset{Key: string(kvp.key), Offset: int(offset)})
+	}
+	return si, nil
+}
+
+// loadTable opens a table in either the format found by getFiles.
+func loadTable(dir string, id, format int) (SSTable, error) {
+	if format == TABLE_FORMAT_LEGACY {
+		return openLegacyTable(dir, id)
+	}
+	return openTable(dir, id)
+}
+
+// openTable opens a table written by tableBuilder.
+func openTable(dir string, id int) (_ SSTable, err error) {
+	file, err := os.Open(tableFile(dir, id))
+	if err != nil {
+		return SSTable{}, fmt.Errorf("unable to open table file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return SSTable{}, fmt.Errorf("unable to stat table file: %w", err)
+	}
+	if fi.Size() < FOOTER_SIZE {
+		return SSTable{}, fmt.Errorf("table file is too short: %d bytes", fi.Size())
+	}
+
+	footerOffset := int(fi.Size()) - FOOTER_SIZE
+	b, err := readChunk(file, footerOffset, FOOTER_SIZE)
+	if err != nil {
+		return SSTable{}, fmt.Errorf("unable to read footer: %w", err)
+	}
+	ft, err := decodeFooter(b, int(fi.Size()))
+	if err != nil {
+		return SSTable{}, ErrCorruption{TableID: id, Offset: footerOffset, Err: err}
+	}
+
+	// decodeBlock reads and decodes a block, where any error after reading
+	// it is corruption.
+	decodeBlock := func(name string, h blockHandle, decode func([]byte) error) error {
+		b, err := readChunk(file, int(h.offset), int(h.size))
+		if err != nil {
+			return fmt.Errorf("unable to read %s block: %w", name, err)
+		}
+		if ft.version == TABLE_FORMAT_BLOCK_CRC {
+			b, err = checkBlock(b)
+		}
+		if err == nil {
+			err = decode(b)
+		}
+		if err != nil {
+			err = fmt.Errorf("unable to decode %s block: %w", name, err)
+			return ErrCorruption{TableID: id, Offset: int(h.offset), Err: err}
+		}
+		return nil
+	}
+
+	meta := &Meta{}
+	if err := decodeBlock("meta", ft.meta, meta.unmarshal); err != nil {
+		return SSTable{}, err
+	}
+
+	var index *SparseIndex
+	err = decodeBlock("index", ft.index, func(b []byte) (err error) {
+		index, err = decodeIndex(b)
+		return err
+	})
+	if err != nil {
+		return SSTable{}, err
+	}
+
+	bf := &bloom.BloomFilterV2{}
+	if err := decodeBlock("filter", ft.filter, bf.UnmarshalBinary); err != nil {
+		return SSTable{}, err
+	}
+	var pf *bloom.BloomFilterV2
+	if meta.PrefixExtractor != "" {
+		pf = &bloom.BloomFilterV2{}
+		if err := decodeBlock("prefix filter", meta.prefixFilter, pf.UnmarshalBinary); err != nil {
+			return SSTable{}, err
+		}
+	}
+
+	return SSTable{
+		ID:           id,
+		FileSize:     int(fi.Size()),
+		DataSize:     int(ft.filter.offset),
+		Format:       int(ft.version),
+		Meta:         meta,
+		Index:        index,
+		BloomFilter:  bf,
+		PrefixFilter: pf,
+		DataFile:     file,
+		refs:         newRefs(),
+	}, nil
+}
+
+// openLegacyTable opens a table written as separate data, index, bloom
+// and meta files.
+func openLegacyTable(dir string, id int) (_ SSTable, err error) {
+	path := func(ext string) string {
+		return filepath.Join(dir, fmt.Sprintf("lsm-%d.%s", id, ext))
+	}
+
+	meta := &Meta{}
+	if err := meta.Decode(path("meta")); err != nil {
+		return SSTable{}, fmt.Errorf("unable to open meta file: %w", err)
+	}
+
+	df, err := os.Open(path("data"))
+	if err != nil {
+		return SSTable{}, fmt.Errorf("unable to open data file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			df.Close()
+		}
+	}()
+
+	fi, err := df.Stat()
+	if err != nil {
+		return SSTable{}, fmt.Errorf("unable to stat data file: %w", err)
+	}
+
+	sparseIndex := NewSparseIndex()
+	if err = sparseIndex.Decode(path("index")); err != nil {
+		return SSTable{}, fmt.Errorf("unable to decode sparse index: %w", err)
+	}
+
+	bf, _ := bloom.NewBloomFilterV2(1, 1)
+	if err = bf.Decode(path("bloom")); err != nil {
+		return SSTable{}, fmt.Errorf("unable to decode bloom filter: %w", err)
+	}
+
+	ss := SSTable{
+		ID:          id,
+		FileSize:    int(fi.Size()),
+		DataSize:    int(fi.Size()),
+		Format:      TABLE_FORMAT_LEGACY,
+		Meta:        meta,
+		Index:       sparseIndex,
+		BloomFilter: bf,
+		DataFile:    df,
+		refs:        newRefs(),
+	}
+	if meta.RecordFormat == 0 && len(sparseIndex.Index) > 0 {
+		chunk, err := ss.readChunk(0, nil)
+		if err != nil {
+			return SSTable{}, fmt.Errorf("unable to read first chunk: %w", err)
+		}
+		if meta.RecordFormat, err = detectRecordFormat(chunk, sparseIndex.Index[0].Key); err != nil {
+			return SSTable{}, ss.corruption(0, err)
+		}
+	}
+	return ss, nil
+}
+
+// chunkFor returns the index of the only chunk that can contain the key,
+// or -1 if there is none. A chunk is a data block, or the records between
+// two entries of the sparse index in the legacy format.
+func (ss SSTable) chunkFor(key string) int {
+	return sort.Search(len(ss.Index.Index), func(i int) bool {
+		return ss.Index.Index[i].Key > key
+	}) - 1
+}
+
+func (ss SSTable) chunkBounds(i int) (int, int) {
+	end := ss.DataSize
+	if i+1 < len(ss.Index.Index) {
+		end = ss.Index.Index[i+1].Offset
+	}
+	return ss.Index.Index[i].Offset, end
+}
+
+// readChunk reads every record in a chunk into the buffer, which is
+// grown if needed. The checksum of the chunk is verified, and compressed
+// blocks are decompressed into a new buffer.
+func (ss SSTable) readChunk(i int, buf []byte) ([]byte, error) {
+	start, end := ss.chunkBounds(i)
+	if cap(buf) < end-start {
+		buf = make([]byte, end-start)
+	}
+	chunk, err := readChunkWithBuffer(ss.DataFile, start, buf[:end-start])
+	if err != nil {
+		return nil, err
+	}
+	return ss.checkChunk(i, chunk)
+}
+
+// checkChunk verifies the checksum of chunk i as read from disk, and
+// decompresses it.
+func (ss SSTable) checkChunk(i int, chunk []byte) ([]byte, error) {
+	var err error
+	if ss.Format == TABLE_FORMAT_BLOCK_CRC {
+		if chunk, err = checkBlock(chunk); err != nil {
+			return nil, ss.corruption(i, err)
+		}
+	}
+	chunk, err = ss.Meta.Compression.decompress(chunk)
+	if err != nil {
+		return nil, ss.corruption(i, err)
+	}
+	return chunk, nil
+}
+
+// loadChunk reads and decodes every record in a chunk, which never splits
+// the versions of a key.
+func (ss SSTable) loadChunk(i int) ([]keyValue, error) {
+	chunk, err := ss.readChunk(i, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ss.decodeChunk(i, chunk)
+}
+
+// decodeChunk decodes every record in chunk i, read by readChunk.
+func (ss SSTable) decodeChunk(i int, chunk []byte) ([]keyValue, error) {
+	if ss.Format != TABLE_FORMAT_LEGACY {
+		blk, err := newBlock(chunk)
+		if err != nil {
+			return nil, ss.corruption(i, err)
+		}
+		kvps, err := blk.all()
+		if err != nil {
+			return nil, ss.corruption(i, err)
+		}
+		return kvps, nil
+	}
+
+	buf := bytes.NewBuffer(chunk)
+	kvps := make([]keyValue, 0)
+	for buf.Len() > 0 {
+		kvp, _, err := readKeyVal(buf, ss.Meta.RecordFormat)
+		if err != nil {
+			return nil, ss.corruption(i, err)
+		}
+		kvps = append(kvps, kvp)
+	}
+	return kvps, nil
+}
+
+// findInChunk returns the newest version of the key with a sequence
+// number at or below seq in chunk i, read by readChunk.
+func (ss SSTable) findInChunk(i int, chunk []byte, key string, seq uint64) (keyValue, bool, error) {
+	if ss.Format != TABLE_FORMAT_LEGACY {
+		blk, err := newBlock(chunk)
+		if err != nil {
+			return keyValue{}, false, ss.corruption(i, err)
+		}
+		kvp, found, err := blk.find(key, seq)
+		if err != nil {
+			return keyValue{}, false, ss.corruption(i, err)
+		}
+		return kvp, found, nil
+	}
+
+	buf := bytes.NewBuffer(chunk)
+	for buf.Len() > 0 {
+		kvp, _, err := readKeyVal(buf, ss.Meta.RecordFormat)
+		if err != nil {
+			return keyValue{}, false, ss.corruption(i, err)
+		}
+		// Versions of a key are ordered from newest to oldest.
+		if key == string(kvp.key) && kvp.Seq <= seq {
+			return kvp, true, nil
+		}
+	}
+	return keyValue{}, false, nil
+}
+
+// corruption returns an ErrCorruption for chunk i.
+func (ss SSTable) corruption(i int, err error) error {
+	return ErrCorruption{TableID: ss.ID, Offset: ss.Index.Index[i].Offset, Err: err}
+}
+
+func tableFile(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("lsm-%d.sst", id))
+}
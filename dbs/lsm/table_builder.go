@@ -0,0 +1,219 @@
+package lsm
+
+import (
+	"bufio"
+	"crumbs/bloom"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// tableBuilder writes a single SSTable from keys added in sorted order,
+// see SSTable for the format.
+type tableBuilder struct {
+	id     int
+	file   *os.File
+	writer *bufio.Writer
+
+	block *blockBuilder
+	index *SparseIndex
+	keys  []string
+	meta  *Meta
+
+	// prefixes holds the distinct prefixes of the keys, if there is a
+	// prefix extractor.
+	extractor PrefixExtractor
+	prefixes  []string
+
+	offset      int
+	blockSize   int
+	compression Compression
+	errorPct    float64
+
+	// limiter limits the rate of writes until cancel is closed, and is
+	// only set for compactions.
+	limiter *rateLimiter
+	cancel  <-chan struct{}
+}
+
+func (sm *SSTManager) newTableBuilder(id, level int) (*tableBuilder, error) {
+	file, err := os.OpenFile(tableFile(sm.dir, id), WR_FLAGS, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open table file: %w", err)
+	}
+
+	return &tableBuilder{
+		id:          id,
+		file:        file,
+		writer:      bufio.NewWriterSize(file, 1024*64),
+		block:       newBlockBuilder(sm.sparseness),
+		index:       NewSparseIndex(),
+		keys:        make([]string, 0),
+		meta:        &Meta{Level: level, Compression: sm.compression},
+		blockSize:   sm.blockSize,
+		compression: sm.compression,
+		errorPct:    sm.errorPct,
+		extractor:   sm.prefixExtractor,
+	}, nil
+}
+
+// add expects keys in sorted order, and the versions of each key from
+// newest to oldest.
+func (tb *tableBuilder) add(key string, e Entry) error {
+	// Versions of a key are never split across blocks, so they can be
+	// read together.
+	newKey := tb.meta.Items == 0 || key != tb.meta.MaxKey
+	if newKey && tb.block.size() >= tb.blockSize {
+		if err := tb.flushBlock(); err != nil {
+			return err
+		}
+	}
+	if tb.block.empty() {
+		tb.index.Append(recordOffset{Key: key, Offset: tb.offset})
+	}
+	tb.block.add(key, e)
+
+	if tb.meta.Items == 0 {
+		tb.meta.MinKey = key
+	}
+	if newKey {
+		tb.keys = append(tb.keys, key)
+		if tb.extractor != nil {
+			p, ok := tb.extractor.Prefix(key)
+			if ok && (len(tb.prefixes) == 0 || tb.prefixes[len(tb.prefixes)-1] != p) {
+				tb.prefixes = append(tb.prefixes, p)
+			}
+		}
+	}
+	tb.meta.MaxKey = key
+	tb.meta.MaxSeq = max(tb.meta.MaxSeq, e.Seq)
+	tb.meta.Items++
+
+	return nil
+}
+
+// estimatedSize returns the size of the data blocks written so far,
+// including the one being built.
+func (tb *tableBuilder) estimatedSize() int {
+	return tb.offset + tb.block.size()
+}
+
+// finish durably writes the remaining data block, followed by the filter,
+// meta and index blocks and the footer, and returns the resulting table.
+func (tb *tableBuilder) finish() (SSTable, error) {
+	if !tb.block.empty() {
+		if err := tb.flushBlock(); err != nil {
+			return SSTable{}, err
+		}
+	}
+	dataSize := tb.offset
+
+	bf, filter, err := tb.bloomFilter(tb.keys)
+	if err != nil {
+		return SSTable{}, err
+	}
+	var ft footer
+	if ft.filter, err = tb.writeBlock(filter); err != nil {
+		return SSTable{}, fmt.Errorf("unable to write filter block: %w", err)
+	}
+
+	// The prefix filter block follows the filter block, and is found
+	// through the meta block, so that older readers still understand the
+	// footer.
+	var pf *bloom.BloomFilterV2
+	if tb.extractor != nil {
+		if pf, filter, err = tb.bloomFilter(tb.prefixes); err != nil {
+			return SSTable{}, err
+		}
+		if tb.meta.prefixFilter, err = tb.writeBlock(filter); err != nil {
+			return SSTable{}, fmt.Errorf("unable to write prefix filter block: %w", err)
+		}
+		tb.meta.PrefixExtractor = tb.extractor.Name()
+	}
+	if ft.meta, err = tb.writeBlock(tb.meta.marshal()); err != nil {
+		return SSTable{}, fmt.Errorf("unable to write meta block: %w", err)
+	}
+	if ft.index, err = tb.writeBlock(encodeIndex(tb.index)); err != nil {
+		return SSTable{}, fmt.Errorf("unable to write index block: %w", err)
+	}
+	if _, err = tb.write(ft.marshal()); err != nil {
+		return SSTable{}, fmt.Errorf("unable to write footer: %w", err)
+	}
+
+	if err := tb.writer.Flush(); err != nil {
+		return SSTable{}, fmt.Errorf("unable to flush table file: %w", err)
+	}
+	if err := tb.file.Sync(); err != nil {
+		return SSTable{}, fmt.Errorf("unable to sync table file: %w", err)
+	}
+
+	return SSTable{
+		ID:           tb.id,
+		FileSize:     tb.offset,
+		DataSize:     dataSize,
+		Format:       TABLE_FORMAT_BLOCK_CRC,
+		Meta:         tb.meta,
+		Index:        tb.index,
+		BloomFilter:  bf,
+		PrefixFilter: pf,
+		DataFile:     tb.file,
+		refs:         newRefs(),
+	}, nil
+}
+
+// bloomFilter returns a bloom filter of the keys, and its encoding.
+func (tb *tableBuilder) bloomFilter(keys []string) (*bloom.BloomFilterV2, []byte, error) {
+	bf, err := bloom.NewBloomFilterV2(max(len(keys), 1), tb.errorPct)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create bloom filter: %w", err)
+	}
+	for _, k := range keys {
+		bf.Add([]byte(k))
+	}
+	b, err := bf.MarshalBinary()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode bloom filter: %w", err)
+	}
+	return bf, b, nil
+}
+
+func (tb *tableBuilder) flushBlock() error {
+	b, err := tb.compression.compress(tb.block.finish())
+	if err != nil {
+		return err
+	}
+	if _, err := tb.writeBlock(b); err != nil {
+		return fmt.Errorf("unable to write data block: %w", err)
+	}
+	return nil
+}
+
+// writeBlock writes a block followed by its checksum.
+func (tb *tableBuilder) writeBlock(b []byte) (blockHandle, error) {
+	handle, err := tb.write(b)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	crc := binary.LittleEndian.AppendUint32(nil, crc32.Checksum(b, crcTable))
+	if _, err := tb.write(crc); err != nil {
+		return blockHandle{}, err
+	}
+	handle.size += CHECKSUM_SIZE
+	return handle, nil
+}
+
+func (tb *tableBuilder) write(b []byte) (blockHandle, error) {
+	if tb.limiter != nil {
+		if err := tb.limiter.wait(len(b), tb.cancel); err != nil {
+			return blockHandle{}, err
+		}
+	}
+	n, err := tb.writer.Write(b)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	handle := blockHandle{offset: uint64(tb.offset), size: uint64(n)}
+	tb.offset += n
+	return handle, nil
+}
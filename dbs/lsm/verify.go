@@ -0,0 +1,60 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Verify reads every table in the directory, and checks that every block
+// matches its checksum and can be decoded, and that its records are in
+// order. It returns an ErrCorruption for every corrupted table, joined
+// together, and must not be run on a directory an LSMTree has open.
+func Verify(dir string) error {
+	files, err := getFiles(dir)
+	if err != nil {
+		return fmt.Errorf("unable to find tables: %w", err)
+	}
+
+	errs := make([]error, 0)
+	for i, id := range files.ids {
+		if err := verifyTable(dir, id, files.formats[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func verifyTable(dir string, id, format int) error {
+	ss, err := loadTable(dir, id, format)
+	if err != nil {
+		return err
+	}
+	defer ss.DataFile.Close()
+
+	var prev keyValue
+	items := 0
+	for i := range ss.Index.Index {
+		kvps, err := ss.loadChunk(i)
+		if err != nil {
+			return err
+		}
+
+		// Keys are in ascending order, and the versions of each key are
+		// from newest to oldest.
+		for _, kvp := range kvps {
+			cmp := bytes.Compare(prev.key, kvp.key)
+			if items > 0 && (cmp > 0 || cmp == 0 && prev.Seq <= kvp.Seq) {
+				return ss.corruption(i, fmt.Errorf("record %s@%d is out of order", kvp.key, kvp.Seq))
+			}
+			prev = kvp
+			items++
+		}
+	}
+
+	if items != ss.Meta.Items {
+		err := fmt.Errorf("table has %d records, but its meta has %d", items, ss.Meta.Items)
+		return ErrCorruption{TableID: id, Offset: ss.DataSize, Err: err}
+	}
+	return nil
+}
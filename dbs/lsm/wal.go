@@ -0,0 +1,369 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	WAL_HEADER_SIZE = 8
+	WAL_BUFFER_SIZE = 1024 * 64
+)
+
+// SyncMode controls when appended WAL records are fsynced to disk.
+type SyncMode int
+
+const (
+	// SyncPeriodic fsyncs the active segment on a fixed interval, so a
+	// crash can lose at most one period worth of writes.
+	SyncPeriodic SyncMode = iota
+	// SyncAlways fsyncs the active segment after every append.
+	SyncAlways
+	// SyncGroup makes every writer wait until its record is fsynced,
+	// but lets a single fsync cover every writer waiting at that time.
+	SyncGroup
+)
+
+type WALOptions struct {
+	syncMode   SyncMode
+	syncPeriod time.Duration
+}
+
+// WAL is a segmented write-ahead log. Each segment holds the writes of
+// exactly one memtable, so segments are created and released in lockstep
+// with the memtables of the LSMTree.
+//
+// Every record has the following binary format
+//
+//	+-----------+--------------+---------+
+//	| CRC (u32) | Length (u32) | Payload |
+//	+-----------+--------------+---------+
+//
+// where the checksum covers only the payload.
+type WAL struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	logger *slog.Logger
+
+	dir    string
+	segs   []int
+	file   *os.File
+	writer *bufio.Writer
+
+	// Log sequence numbers of the last appended and synced records.
+	written  uint64
+	synced   uint64
+	syncing  bool
+	syncErr  error
+	syncStop chan struct{}
+	syncDone chan struct{}
+
+	// Options.
+	syncMode   SyncMode
+	syncPeriod time.Duration
+}
+
+func NewWAL(dir string, logger *slog.Logger, opts WALOptions) *WAL {
+	w := &WAL{
+		dir:        dir,
+		segs:       make([]int, 0),
+		syncStop:   make(chan struct{}),
+		syncDone:   make(chan struct{}),
+		syncMode:   opts.syncMode,
+		syncPeriod: opts.syncPeriod,
+		logger:     logger,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Replay reads every existing segment in order, calling f with the segment
+// ID and payload of each valid record. Reading a segment stops at the first
+// torn or corrupted record. Segments without any records are removed.
+func (w *WAL) Replay(f func(seg int, payload []byte) error) error {
+	files, err := filepath.Glob(filepath.Join(w.dir, "wal-*.log"))
+	if err != nil {
+		return fmt.Errorf("unable to glob wal segments: %w", err)
+	}
+
+	for _, seg := range getSortedFileIDs(files) {
+		path := walFile(w.dir, seg)
+		n, torn, err := readRecords(path, func(payload []byte) error {
+			return f(seg, payload)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to replay segment %d: %w", seg, err)
+		}
+		if torn {
+			w.logger.Warn("wal segment has a torn or corrupted tail", slog.Int("segment", seg))
+		}
+
+		if n == 0 {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("unable to remove empty segment: %w", err)
+			}
+			continue
+		}
+		w.segs = append(w.segs, seg)
+		w.logger.Info("replayed wal segment", slog.Int("segment", seg), slog.Int("records", n))
+	}
+
+	return nil
+}
+
+// Open creates a new active segment following any replayed segments, and
+// starts the background syncer if needed.
+func (w *WAL) Open() error {
+	seg := 0
+	if n := len(w.segs); n > 0 {
+		seg = w.segs[n-1] + 1
+	}
+	if err := w.openSegment(seg); err != nil {
+		return err
+	}
+
+	if w.syncMode == SyncPeriodic {
+		go w.syncPeriodically()
+	} else {
+		close(w.syncDone)
+	}
+	return nil
+}
+
+// Append writes a record to the active segment and returns its log
+// sequence number. Under SyncAlways the record is durable on return,
+// otherwise the caller should pass the number to WaitDurable.
+func (w *WAL) Append(payload []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := writeRecord(w.writer, payload); err != nil {
+		return 0, err
+	}
+	w.written++
+
+	if w.syncMode == SyncAlways {
+		if err := w.syncLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return w.written, nil
+}
+
+// WaitDurable blocks until the record with the given log sequence number
+// has been fsynced. It is a no-op unless the WAL uses SyncGroup.
+//
+// The first waiter to find no sync in progress becomes the leader and
+// syncs on behalf of everyone who appended before it, while the rest wait.
+func (w *WAL) WaitDurable(lsn uint64) error {
+	if w.syncMode != SyncGroup {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < lsn {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		w.syncing = true
+		target := w.written
+		err := w.writer.Flush()
+		if err == nil {
+			file := w.file
+			w.mu.Unlock()
+			err = file.Sync()
+			w.mu.Lock()
+		}
+		w.syncing = false
+
+		if err != nil {
+			w.syncErr = fmt.Errorf("unable to sync wal: %w", err)
+		} else {
+			w.synced = max(w.synced, target)
+		}
+		w.cond.Broadcast()
+	}
+	return nil
+}
+
+// Rotate syncs and closes the active segment, then starts a new one.
+// It must be called whenever the active memtable is rotated.
+func (w *WAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("unable to close segment: %w", err)
+	}
+	return w.openSegment(w.segs[len(w.segs)-1] + 1)
+}
+
+// Segment returns the ID of the active segment.
+func (w *WAL) Segment() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segs[len(w.segs)-1]
+}
+
+// Release removes every segment up to and including seg, once their
+// memtables have been durably written to SSTables. The active segment is
+// never removed.
+func (w *WAL) Release(seg int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := 0
+	for n < len(w.segs)-1 && w.segs[n] <= seg {
+		n++
+	}
+	for _, seg := range w.segs[:n] {
+		if err := os.Remove(walFile(w.dir, seg)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove segment %d: %w", seg, err)
+		}
+	}
+	w.segs = w.segs[n:]
+	return nil
+}
+
+// Close stops the background syncer, and syncs and closes the active segment.
+func (w *WAL) Close() error {
+	close(w.syncStop)
+	<-w.syncDone
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// syncLocked expects the caller to hold the lock.
+func (w *WAL) syncLocked() error {
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("unable to flush wal: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync wal: %w", err)
+	}
+	w.synced = w.written
+	return nil
+}
+
+func (w *WAL) syncPeriodically() {
+	defer close(w.syncDone)
+
+	t := time.NewTicker(w.syncPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.syncStop:
+			return
+		case <-t.C:
+			w.mu.Lock()
+			if w.synced < w.written {
+				if err := w.syncLocked(); err != nil {
+					w.logger.Warn("failed to sync wal periodically", "error", err)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// openSegment expects the caller to hold the lock, or to have exclusive
+// access to the WAL.
+func (w *WAL) openSegment(seg int) error {
+	file, err := os.OpenFile(walFile(w.dir, seg), WR_FLAGS, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open segment %d: %w", seg, err)
+	}
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, WAL_BUFFER_SIZE)
+	w.segs = append(w.segs, seg)
+	return nil
+}
+
+// writeRecord writes a record with the payload, in the format of WAL
+// records.
+func writeRecord(w io.Writer, payload []byte) error {
+	header := make([]byte, WAL_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(header[:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("unable to write record header: %w", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("unable to write record payload: %w", err)
+	}
+	return nil
+}
+
+// readRecords calls f with the payload of every record in a file written
+// by writeRecord. It returns the number of valid records read, and whether
+// reading stopped early because of a torn or corrupted record.
+func readRecords(path string, f func(payload []byte) error) (int, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to open file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, WAL_BUFFER_SIZE)
+	header := make([]byte, WAL_HEADER_SIZE)
+	n := 0
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// A partially written header is a torn write from a crash.
+			return n, err != io.EOF, nil
+		}
+		crc := binary.LittleEndian.Uint32(header[:4])
+		length := binary.LittleEndian.Uint32(header[4:])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return n, true, nil
+		}
+		if crc32.ChecksumIEEE(payload) != crc {
+			return n, true, nil
+		}
+
+		if err := f(payload); err != nil {
+			return n, false, err
+		}
+		n++
+	}
+}
+
+func walFile(dir string, seg int) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%d.log", seg))
+}
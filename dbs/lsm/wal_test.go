@@ -0,0 +1,76 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestWALTornTail(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	w := NewWAL(TEST_DIR, logger, WALOptions{syncMode: SyncAlways})
+	assert.Nil(t, w.Open())
+
+	for i := 0; i < 100; i++ {
+		_, err := w.Append([]byte(fmt.Sprintf("record_%d", i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+
+	// Chop off part of the last record.
+	path := walFile(TEST_DIR, 0)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, fi.Size()-3))
+
+	w = NewWAL(TEST_DIR, logger, WALOptions{syncMode: SyncAlways})
+	replayed := make([]string, 0)
+	err = w.Replay(func(seg int, payload []byte) error {
+		replayed = append(replayed, string(payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(replayed))
+	assert.Equal(t, "record_98", replayed[len(replayed)-1])
+}
+
+func TestWALRelease(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(TEST_DIR, 0755))
+	defer cleanUp()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	w := NewWAL(TEST_DIR, logger, WALOptions{syncMode: SyncAlways})
+	assert.Nil(t, w.Open())
+	for i := 0; i < 4; i++ {
+		_, err := w.Append([]byte(fmt.Sprintf("record_%d", i)))
+		assert.Nil(t, err)
+		assert.Nil(t, w.Rotate())
+	}
+	assert.Equal(t, 4, w.Segment())
+
+	exists := func(seg int) bool {
+		_, err := os.Stat(walFile(TEST_DIR, seg))
+		return err == nil
+	}
+
+	// Segments are released by ID, so releasing the same segment twice
+	// doesn't remove newer ones.
+	assert.Nil(t, w.Release(1))
+	assert.Nil(t, w.Release(1))
+	assert.False(t, exists(0))
+	assert.False(t, exists(1))
+	assert.True(t, exists(2))
+	assert.True(t, exists(3))
+
+	// The active segment is never released.
+	assert.Nil(t, w.Release(10))
+	assert.False(t, exists(3))
+	assert.True(t, exists(4))
+	assert.Nil(t, w.Close())
+}
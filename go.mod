@@ -1,6 +1,6 @@
 module crumbs
 
-go 1.22
+go 1.23
 
 require (
 	github.com/asecurityteam/rolling v2.0.4+incompatible